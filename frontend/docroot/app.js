@@ -15,6 +15,9 @@ var playSound = null;
 var sound = new Audio("warning.mp3");
 var currentImageTimestamp = 0; // used by the sound.play() logic to determine if we have already played the emergency sound on this image
 var resumeButton = null;
+var pendingCount = null;
+var resumeCountdown = null;
+var resumeCountdownTimer = null;
 
 // https://www.w3schools.com/howto/howto_js_snackbar.asp
 function showMessage(msg) {
@@ -99,6 +102,32 @@ function setPrompt(data) {
   prompt.innerText = obj.prompt;
 }
 
+// the analysis is cancelled when the prompt is changed, or with /api/cancel
+function processLLMRequestCancelledEvent(event) {
+  if (event == null || event.data == null) return;
+  let obj = null;
+  try {
+    obj = JSON.parse(event.data);
+  } catch (e) {
+    console.log(e);
+  }
+  hideOllamaResponseSpinner();
+  hideOpenaiResponseSpinner();
+  if (obj != null && obj.reason == "requested") showMessage("Analysis cancelled");
+}
+
+function processAlertExpiredEvent(event) {
+  if (event == null || event.data == null) return;
+  let obj = null;
+  try {
+    obj = JSON.parse(event.data);
+  } catch (e) {
+    console.log(e);
+  }
+  if (obj == null || obj.camera == null) return;
+  showMessage("Alert from " + obj.camera + " expired without being analyzed");
+}
+
 function processPromptEvent(event) {
   if (event == null || event.data == null) return;
   setPrompt(event.data);
@@ -114,14 +143,16 @@ function loadCurrentState() {
   .then(response => response.json())
   .then(response => {
     if (response == null) return;
-    if (response.annotated_image != null && response.annotated_image != "") annotatedImage = response.annotated_image;
-    if (response.raw_image != null && response.raw_image != "") rawImage = response.raw_image;
-    if ((response.annotated_image != null && response.annotated_image != "") || (response.raw_image != null && response.raw_image != "")) refreshPhoto();
+    if (response.annotated_image_url != null && response.annotated_image_url != "") annotatedImage = response.annotated_image_url;
+    if (response.raw_image_url != null && response.raw_image_url != "") rawImage = response.raw_image_url;
+    if ((response.annotated_image_url != null && response.annotated_image_url != "") || (response.raw_image_url != null && response.raw_image_url != "")) refreshPhoto();
     if (response.timestamp != null) setTimestamp(response.timestamp);
     if (response.prompt != null) setPrompt(response.prompt);
     if (response.image_analysis != null) ollamaResponse.value = response.image_analysis;
     if (response.threat_analysis != null) openaiResponse.value = response.threat_analysis;
     if (response.events_paused != null) response.events_paused?showResumeButton():hideResumeButton();
+    if (response.pending_count != null) setPendingCount(response.pending_count);
+    setResumeAt(response.resume_at == null ? 0 : response.resume_at);
   })
   .catch(error => {console.log(error);showMessage(error);});
 }
@@ -181,7 +212,7 @@ function refreshPhoto() {
     clearPhoto();
     return;
   }
-  photo.setAttribute('src', 'data:image/jpeg;charset=utf-8;base64,' + data);
+  photo.setAttribute('src', data);
 }
 
 function setTimestamp(data) {
@@ -209,10 +240,19 @@ function processTimestampEvent(event) {
 function processImageEvent(event) {
   sseErrors = 0;
   if (event == null || event.data == null || event.type == null) return;
+  let obj = null;
+  try {
+    obj = JSON.parse(event.data);
+  } catch (e) {
+    console.log(e);
+    console.log(event);
+  }
+  if (obj == null) return;
+  let url = (obj.url == null || obj.url == "")?null:obj.url;
   if (event.type == "annotated_image")
-    annotatedImage = event.data;
+    annotatedImage = url;
   else
-    rawImage = event.data;
+    rawImage = url;
   refreshPhoto();
 }
 
@@ -227,8 +267,74 @@ function showResumeButton() {
   resumeButton.style.display = 'block';
 }
 
+function setPendingCount(count) {
+  pendingCount.innerText = (count > 0 ? " (" + count + " pending)" : "");
+}
+
+// alerts that arrived while the events were paused
+function processPendingCountEvent(event) {
+  if (event == null || event.data == null) return;
+  let obj = null;
+  try {
+    obj = JSON.parse(event.data);
+  } catch (e) {
+    console.log(e);
+  }
+  if (obj == null || obj.count == null) return;
+  setPendingCount(obj.count);
+}
+
 function hideResumeButton() {
   resumeButton.style.display = 'none';
+  setResumeAt(0);
+}
+
+// resumeAt is the unix time that the events will be resumed at - the
+// countdown is cleared if it is 0
+function setResumeAt(resumeAt) {
+  if (resumeCountdownTimer != null) {
+    clearInterval(resumeCountdownTimer);
+    resumeCountdownTimer = null;
+  }
+  resumeCountdown.innerText = "";
+  if (resumeAt <= 0) return;
+  let update = function() {
+    let remaining = Math.max(0, Math.round(resumeAt - Date.now() / 1000));
+    resumeCountdown.innerText = " - resuming in " + remaining + "s";
+  };
+  update();
+  resumeCountdownTimer = setInterval(update, 1000);
+}
+
+// the events will be resumed without an operator because of the pause policy
+function processResumeCountdownEvent(event) {
+  if (event == null || event.data == null) return;
+  let obj = null;
+  try {
+    obj = JSON.parse(event.data);
+  } catch (e) {
+    console.log(e);
+  }
+  if (obj == null) return;
+  setResumeAt(obj.remaining > 0 && obj.resume_at != null ? obj.resume_at : 0);
+}
+
+// alerts are not received while the frontend is not connected to the MQTT
+// broker
+function processMQTTStatusEvent(event) {
+  if (event == null || event.data == null) return;
+  let obj = null;
+  try {
+    obj = JSON.parse(event.data);
+  } catch (e) {
+    console.log(e);
+  }
+  if (obj == null || obj.state == null) return;
+  if (obj.state == "disconnected") {
+    showMessage("Disconnected from MQTT broker" + (obj.error == null ? "" : ": " + obj.error));
+  } else if (obj.state == "connected") {
+    showMessage("Connected to MQTT broker");
+  }
 }
 
 function startup() {
@@ -246,6 +352,8 @@ function startup() {
   promptChoicesSpinner = document.getElementById('prompt-choices-spinner');
   playSound = document.getElementById('play-sound');
   resumeButton = document.getElementById('resume');
+  pendingCount = document.getElementById('pending-count');
+  resumeCountdown = document.getElementById('resume-countdown');
 
   const evtSource = new EventSource("/api/sse");
   evtSource.addEventListener("timestamp", processTimestampEvent);
@@ -256,8 +364,16 @@ function startup() {
   evtSource.addEventListener("openai_response", processOpenaiResponse);
   evtSource.addEventListener("openai_response_start", hideOpenaiResponseSpinner);
   evtSource.addEventListener("prompt", processPromptEvent);
+  evtSource.addEventListener("prompts_changed", loadPromptChoices);
+  evtSource.addEventListener("llm_request_cancelled", processLLMRequestCancelledEvent);
+  evtSource.addEventListener("alert_expired", processAlertExpiredEvent);
   evtSource.addEventListener("pause_events", showResumeButton);
   evtSource.addEventListener("resume_events", hideResumeButton);
+  evtSource.addEventListener("mqtt_status", processMQTTStatusEvent);
+  evtSource.addEventListener("pending_count", processPendingCountEvent);
+  evtSource.addEventListener("resume_countdown", processResumeCountdownEvent);
+  // events were missed while we were disconnected and they cannot be replayed
+  evtSource.addEventListener("reset", loadCurrentState);
 
   evtSource.onerror = (e) => {
     sseErrors++;
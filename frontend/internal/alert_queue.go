@@ -0,0 +1,251 @@
+package internal
+
+// Alerts wait in a priority queue until a worker can analyze them. Alerts
+// that the user asked to be analyzed again go first, followed by alerts from
+// high-risk cameras and alerts with a priority class, followed by every other
+// alert. Alerts that have been waiting for too long are expired instead of
+// being analyzed, and the oldest alert with the lowest priority is dropped
+// when the queue is full.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultQueueSize = 100
+
+// ErrLLMQueueFull is returned if an alert could not be queued because every
+// alert in the queue has a higher priority
+var ErrLLMQueueFull = errors.New("LLM queue is full")
+
+// Priorities of queued alerts - alerts with a higher priority are analyzed
+// first
+const (
+	priorityNormal = iota
+	priorityHigh   // from a high-risk camera or with a priority class
+	priorityUser   // analyzed again because the user changed the prompt
+)
+
+// QueuePolicy decides the order that alerts are analyzed in
+type QueuePolicy struct {
+	Size            int           // alerts that can wait to be analyzed
+	HighRiskCameras []string      // alerts from these cameras are analyzed first
+	PriorityClasses []string      // alerts with any of these classes are analyzed first
+	MaxAge          time.Duration // older alerts are expired instead of analyzed - 0 to analyze alerts regardless of age
+}
+
+// SetQueuePolicy sets the size of the queue of alerts waiting to be
+// analyzed, and the alerts that go first
+func (controller *AlertsController) SetQueuePolicy(policy QueuePolicy) {
+	if policy.Size < 1 {
+		policy.Size = defaultQueueSize
+	}
+	controller.queuePolicy.Store(&policy)
+	controller.queue.setSize(policy.Size)
+	log.Printf("queueing up to %d alerts - high-risk cameras %v, priority classes %v, max age %v", policy.Size, policy.HighRiskCameras, policy.PriorityClasses, policy.MaxAge)
+}
+
+type queuedAlert struct {
+	event    alertEvent
+	priority int
+	seq      uint64 // alerts with the same priority are analyzed in the order they were queued
+}
+
+// before returns true if a should be analyzed before b
+func (a *queuedAlert) before(b *queuedAlert) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	return a.seq < b.seq
+}
+
+type alertQueue struct {
+	mux     sync.Mutex
+	alerts  []*queuedAlert
+	size    int
+	seq     uint64
+	dropped uint64
+	expired uint64
+	ready   chan struct{} // signalled when an alert is queued or a worker has room
+}
+
+func newAlertQueue(size int) *alertQueue {
+	return &alertQueue{
+		size:  size,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *alertQueue) setSize(size int) {
+	q.mux.Lock()
+	q.size = size
+	q.mux.Unlock()
+}
+
+// push returns the alert that was dropped to make room, which may be the
+// alert that was pushed
+func (q *alertQueue) push(event alertEvent, priority int) (alertEvent, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.seq++
+	q.alerts = append(q.alerts, &queuedAlert{event: event, priority: priority, seq: q.seq})
+	defer q.wake()
+	if len(q.alerts) <= q.size {
+		return alertEvent{}, false
+	}
+	// the oldest alert with the lowest priority
+	lowest := 0
+	for i, alert := range q.alerts {
+		if alert.priority < q.alerts[lowest].priority {
+			lowest = i
+		}
+	}
+	dropped := q.alerts[lowest].event
+	q.alerts = append(q.alerts[:lowest], q.alerts[lowest+1:]...)
+	q.dropped++
+	return dropped, true
+}
+
+// next waits for the alert with the highest priority that can be handed to a
+// worker - pick returns the worker for the camera, or nil if the camera's
+// alerts cannot be handed to a worker yet. false is returned if the context
+// is cancelled.
+func (q *alertQueue) next(ctx context.Context, pick func(camera string) *analysisWorker) (alertEvent, *analysisWorker, bool) {
+	for {
+		q.mux.Lock()
+		best := -1
+		var worker *analysisWorker
+		workers := make(map[string]*analysisWorker)
+		for i, alert := range q.alerts {
+			w, ok := workers[alert.event.camera]
+			if !ok {
+				w = pick(alert.event.camera)
+				workers[alert.event.camera] = w
+			}
+			if w != nil && (best < 0 || alert.before(q.alerts[best])) {
+				best = i
+				worker = w
+			}
+		}
+		if best >= 0 {
+			event := q.alerts[best].event
+			q.alerts = append(q.alerts[:best], q.alerts[best+1:]...)
+			q.mux.Unlock()
+			return event, worker, true
+		}
+		q.mux.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return alertEvent{}, nil, false
+		case <-q.ready:
+		}
+	}
+}
+
+// wake makes next look for an alert again
+func (q *alertQueue) wake() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *alertQueue) addExpired() {
+	q.mux.Lock()
+	q.expired++
+	q.mux.Unlock()
+}
+
+// returns the number of queued, dropped and expired alerts
+func (q *alertQueue) counts() (int, uint64, uint64) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return len(q.alerts), q.dropped, q.expired
+}
+
+// queueAlert queues the alert for analysis - ErrLLMQueueFull is returned if
+// the queue is full of alerts with a higher priority
+func (controller *AlertsController) queueAlert(event alertEvent) error {
+	event.camera = controller.camera(event.camera).name
+	dropped, ok := controller.queue.push(event, controller.alertPriority(event))
+	if !ok {
+		return nil
+	}
+	if dropped.id == event.id {
+		return ErrLLMQueueFull
+	}
+	log.Printf("dropped alert %s from camera %s to make room for alert %s because the LLM queue is full", dropped.id, dropped.camera, event.id)
+	return nil
+}
+
+func (controller *AlertsController) alertPriority(event alertEvent) int {
+	if event.reanalyze {
+		return priorityUser
+	}
+	policy := controller.queuePolicy.Load()
+	if policy == nil {
+		return priorityNormal
+	}
+	for _, camera := range policy.HighRiskCameras {
+		if camera == event.camera {
+			return priorityHigh
+		}
+	}
+	for _, class := range event.classes {
+		for _, priorityClass := range policy.PriorityClasses {
+			if strings.EqualFold(class, priorityClass) {
+				return priorityHigh
+			}
+		}
+	}
+	return priorityNormal
+}
+
+// returns the age of the alert and true if the alert is too old to be
+// analyzed - alerts that the user asked to be analyzed again and alerts
+// without a timestamp do not expire
+func (controller *AlertsController) alertExpired(event alertEvent) (time.Duration, bool) {
+	policy := controller.queuePolicy.Load()
+	if policy == nil || policy.MaxAge <= 0 || event.reanalyze || event.timestamp <= 0 {
+		return 0, false
+	}
+	age := time.Since(time.Unix(event.timestamp, 0))
+	return age, age > policy.MaxAge
+}
+
+// expireAlert lets the browsers know that the alert will not be analyzed - if
+// this was a pending alert, the camera's next pending alert is analyzed
+// instead
+func (controller *AlertsController) expireAlert(event alertEvent, age time.Duration) {
+	controller.queue.addExpired()
+	log.Printf("alert %s from camera %s expired after %v without being analyzed", event.id, event.camera, age.Round(time.Second))
+	expired := struct {
+		Camera    string `json:"camera"`
+		AlertID   string `json:"alert_id"`
+		Timestamp int64  `json:"timestamp"`
+		Age       int64  `json:"age"` // seconds
+	}{
+		Camera:    event.camera,
+		AlertID:   event.id,
+		Timestamp: event.timestamp,
+		Age:       int64(age / time.Second),
+	}
+	if marshaled, err := json.Marshal(&expired); err != nil {
+		log.Printf("error converting expired alert to json: %v", err)
+	} else {
+		controller.sendToSSECh(SSEEvent{
+			EventType: "alert_expired",
+			Data:      marshaled,
+			Camera:    event.camera,
+		})
+	}
+	if state := controller.camera(event.camera); !state.paused() {
+		controller.analyzeNextPending(state)
+	}
+}
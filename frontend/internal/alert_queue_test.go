@@ -0,0 +1,128 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kwkoo/threat-detection-frontend/internal"
+)
+
+// Test that alerts from high-risk cameras and alerts with a priority class go
+// ahead of alerts that were queued before them
+func TestQueuePriority(t *testing.T) {
+	promptsFilename, err := createTempPromptFile(t, []string{"slow|slowprompt", "fast|fastprompt"})
+	if err != nil {
+		t.Errorf("error create prompts file: %v", err)
+		return
+	}
+	m := newMocks(t, promptsFilename)
+	defer m.close()
+	m.controller.SetQueuePolicy(internal.QueuePolicy{HighRiskCameras: []string{"yard"}, PriorityClasses: []string{"person"}})
+	m.holdOllamaPrompt("slowprompt")
+	for _, camera := range []string{"lobby", "street", "yard", "door"} {
+		if abort := setPrompt(t, m.controller, `{"id":1,"camera":"`+camera+`"}`, true); abort {
+			return
+		}
+	}
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1,"camera":"gate"}`))
+	if abort := waitForHeldRequest(t, m); abort {
+		return
+	}
+	// the alert from lobby waits for the worker before the other alerts arrive
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":2,"camera":"lobby"}`))
+	if abort := waitForWorkerQueue(t, m, 1); abort {
+		return
+	}
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":3,"camera":"street"}`))
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":4,"camera":"yard"}`))
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":5,"camera":"door","classes":["Person"]}`))
+	if status, abort := getQueueStatus(t, m); abort || status.LLMQueue != 3 {
+		t.Errorf("expected 3 alerts to be waiting in the queue but got %+v", status)
+		return
+	}
+
+	m.controller.CancelAnalysis("gate")
+	if _, abort := waitForCameraAnalysis(t, m.controller, "street"); abort {
+		return
+	}
+	var order []string
+	for _, event := range m.sseEvents() {
+		if event.EventType == "llm_request_start" && event.Camera != "gate" {
+			order = append(order, event.Camera)
+		}
+	}
+	expected := []string{"lobby", "yard", "door", "street"}
+	if len(order) != len(expected) {
+		t.Errorf("expected alerts to be analyzed in the order %v but got %v", expected, order)
+		return
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("expected alerts to be analyzed in the order %v but got %v", expected, order)
+			return
+		}
+	}
+}
+
+// Test that an alert that is older than the max age is expired instead of
+// analyzed
+func TestQueueMaxAge(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+	m.controller.SetQueuePolicy(internal.QueuePolicy{MaxAge: time.Minute})
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1,"camera":"gate"}`))
+	if !waitForSSEEvent(m, "alert_expired", `{"camera":"gate","alert_id":`) {
+		t.Error("expected alert_expired event for the old alert")
+		return
+	}
+	status, abort := getQueueStatus(t, m)
+	if abort {
+		return
+	}
+	if status.ExpiredAlerts != 1 {
+		t.Errorf("expected 1 expired alert but got %+v", status)
+	}
+	if m.sseEventsExist("llm_request_start") {
+		t.Error("expected the expired alert not to be analyzed")
+	}
+}
+
+type queueStatus struct {
+	LLMQueue      int    `json:"llm_queue"`
+	DroppedAlerts uint64 `json:"dropped_alerts"`
+	ExpiredAlerts uint64 `json:"expired_alerts"`
+}
+
+// returns true if subsequent tests should be aborted
+func getQueueStatus(t *testing.T, m *mocks) (queueStatus, bool) {
+	w := httptest.NewRecorder()
+	m.controller.StatusHandler(w, httptest.NewRequest(http.MethodGet, "/api/alertsstatus", nil))
+	var status queueStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Errorf("error decoding status: %v", err)
+		return status, true
+	}
+	return status, false
+}
+
+// returns true if subsequent tests should be aborted
+func waitForWorkerQueue(t *testing.T, m *mocks, queued int) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		workers, abort := getWorkerStatus(t, m)
+		if abort {
+			return true
+		}
+		if len(workers) > 0 && workers[0].Queue == queued {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("timed out waiting for %d alerts to be waiting for the worker", queued)
+	return true
+}
@@ -0,0 +1,226 @@
+package internal
+
+// Alerts are validated before they are queued for analysis so that a
+// misbehaving image-acquirer does not fill the history with images that
+// cannot be shown or send garbage to the LLM. Rejected alerts are counted by
+// reason, and can be republished to a dead-letter MQTT topic.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"sync"
+	"time"
+)
+
+// RejectReason says why an alert was rejected
+type RejectReason string
+
+const (
+	RejectInvalidJSON       RejectReason = "invalid_json"
+	RejectMissingImage      RejectReason = "missing_image"
+	RejectInvalidBase64     RejectReason = "invalid_base64"
+	RejectImageTooLarge     RejectReason = "image_too_large"
+	RejectUnsupportedImage  RejectReason = "unsupported_image"
+	RejectResolutionTooHigh RejectReason = "resolution_too_high"
+	RejectInvalidTimestamp  RejectReason = "invalid_timestamp"
+	RejectFutureTimestamp   RejectReason = "future_timestamp"
+)
+
+// AlertRejectedError is returned for alerts that fail validation
+type AlertRejectedError struct {
+	Reason RejectReason
+	Err    error
+}
+
+func (e *AlertRejectedError) Error() string {
+	return fmt.Sprintf("alert rejected (%s): %v", e.Reason, e.Err)
+}
+
+func (e *AlertRejectedError) Unwrap() error {
+	return e.Err
+}
+
+func rejected(reason RejectReason, format string, a ...any) *AlertRejectedError {
+	return &AlertRejectedError{Reason: reason, Err: fmt.Errorf(format, a...)}
+}
+
+// AlertLimits sets the limits that alerts are validated against - a limit
+// that is 0 is not checked
+type AlertLimits struct {
+	MaxImageBytes  int           // size of each decoded image
+	MaxImageWidth  int           // in pixels
+	MaxImageHeight int           // in pixels
+	MaxClockSkew   time.Duration // how far the timestamp can be in the future
+}
+
+// AlertValidator checks that alerts have at least one image, that every
+// image is a base64-encoded JPEG or PNG within the limits, and that the
+// timestamp is not in the future
+type AlertValidator struct {
+	limits AlertLimits
+}
+
+func NewAlertValidator(limits AlertLimits) *AlertValidator {
+	return &AlertValidator{limits: limits}
+}
+
+// Validate returns an *AlertRejectedError if the alert is not valid
+func (v *AlertValidator) Validate(msg alertMQTT) error {
+	if err := requireImage(msg); err != nil {
+		return err
+	}
+	for _, img := range []struct {
+		field   string
+		encoded string
+	}{
+		{"annotated_image", msg.AnnotatedImage},
+		{"raw_image", msg.RawImage},
+	} {
+		if img.encoded == "" {
+			continue
+		}
+		if err := v.validateImage(img.field, img.encoded); err != nil {
+			return err
+		}
+	}
+	if msg.Timestamp <= 0 {
+		return rejected(RejectInvalidTimestamp, "timestamp %d is not a unix time in seconds", msg.Timestamp)
+	}
+	if v.limits.MaxClockSkew > 0 {
+		if latest := time.Now().Add(v.limits.MaxClockSkew).Unix(); msg.Timestamp > latest {
+			return rejected(RejectFutureTimestamp, "timestamp %d is more than %v in the future - check the clock of the camera, or that the timestamp is not in milliseconds", msg.Timestamp, v.limits.MaxClockSkew)
+		}
+	}
+	return nil
+}
+
+func (v *AlertValidator) validateImage(field, encoded string) error {
+	limit := v.limits.MaxImageBytes
+	if limit > 0 && base64.StdEncoding.DecodedLen(len(encoded)) > limit+2 {
+		// the decoded length can be up to 2 bytes more than the actual length
+		// because of padding - check again after decoding
+		return rejected(RejectImageTooLarge, "%s is larger than %d bytes", field, limit)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return rejected(RejectInvalidBase64, "%s is not valid base64: %v", field, err)
+	}
+	if limit > 0 && len(decoded) > limit {
+		return rejected(RejectImageTooLarge, "%s is %d bytes - the limit is %d bytes", field, len(decoded), limit)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(decoded))
+	if err != nil {
+		return rejected(RejectUnsupportedImage, "%s is not a JPEG or PNG image: %v", field, err)
+	}
+	if format != "jpeg" && format != "png" {
+		return rejected(RejectUnsupportedImage, "%s is a %s image - only JPEG and PNG are supported", field, format)
+	}
+	if (v.limits.MaxImageWidth > 0 && config.Width > v.limits.MaxImageWidth) || (v.limits.MaxImageHeight > 0 && config.Height > v.limits.MaxImageHeight) {
+		return rejected(RejectResolutionTooHigh, "%s is %dx%d - the limit is %dx%d", field, config.Width, config.Height, v.limits.MaxImageWidth, v.limits.MaxImageHeight)
+	}
+	return nil
+}
+
+// rejectionCounts counts the rejected alerts by reason
+type rejectionCounts struct {
+	mux    sync.Mutex
+	counts map[RejectReason]uint64
+}
+
+func (r *rejectionCounts) add(reason RejectReason) {
+	r.mux.Lock()
+	if r.counts == nil {
+		r.counts = make(map[RejectReason]uint64)
+	}
+	r.counts[reason]++
+	r.mux.Unlock()
+}
+
+func (r *rejectionCounts) snapshot() map[RejectReason]uint64 {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	counts := make(map[RejectReason]uint64, len(r.counts))
+	for reason, count := range r.counts {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// SetDeadLetterPublisher makes the controller publish rejected alerts
+func (controller *AlertsController) SetDeadLetterPublisher(publisher *DeadLetterPublisher) {
+	controller.deadLetters.Store(publisher)
+}
+
+// SetAlertValidator makes the controller reject alerts that fail validation
+// - alerts are not validated if this is not called
+func (controller *AlertsController) SetAlertValidator(validator *AlertValidator) {
+	controller.validator.Store(validator)
+}
+
+// an alert without an image cannot be analyzed, so this is checked even if
+// alerts are not validated
+func requireImage(msg alertMQTT) error {
+	if msg.AnnotatedImage == "" && msg.RawImage == "" {
+		return rejected(RejectMissingImage, "alert must have an annotated_image or a raw_image")
+	}
+	return nil
+}
+
+// returns nil if the alert should be analyzed - the same rules apply to
+// alerts from MQTT and HTTP
+func (controller *AlertsController) validateAlert(msg alertMQTT) error {
+	validator := controller.validator.Load()
+	if validator == nil {
+		return requireImage(msg)
+	}
+	return validator.Validate(msg)
+}
+
+// DeadLetter is published to the dead-letter topic for every rejected alert
+type DeadLetter struct {
+	Reason     RejectReason    `json:"reason"`
+	Error      string          `json:"error"`
+	Source     string          `json:"source"`          // mqtt or http
+	Topic      string          `json:"topic,omitempty"` // MQTT topic that the alert was published to
+	ReceivedAt int64           `json:"received_at"`
+	Payload    json.RawMessage `json:"payload,omitempty"` // the alert as it was received if it is valid JSON
+	RawPayload string          `json:"raw_payload,omitempty"`
+}
+
+// rejectAlert counts and logs the rejection, and publishes the alert to the
+// dead-letter topic
+func (controller *AlertsController) rejectAlert(err error, source, topic string, payload []byte) {
+	var rejection *AlertRejectedError
+	if !errors.As(err, &rejection) {
+		rejection = &AlertRejectedError{Reason: RejectInvalidJSON, Err: err}
+	}
+	controller.rejections.add(rejection.Reason)
+	log.Printf("rejected alert from %s: %v", source, rejection)
+
+	publisher := controller.deadLetters.Load()
+	if publisher == nil {
+		return
+	}
+	letter := DeadLetter{
+		Reason:     rejection.Reason,
+		Error:      rejection.Err.Error(),
+		Source:     source,
+		Topic:      topic,
+		ReceivedAt: time.Now().Unix(),
+	}
+	if json.Valid(payload) {
+		letter.Payload = payload
+	} else {
+		letter.RawPayload = string(payload)
+	}
+	if err := publisher.Publish(letter); err != nil {
+		log.Printf("could not publish rejected alert to dead-letter topic: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package internal_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kwkoo/threat-detection-frontend/internal"
+)
+
+func TestAlertValidation(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+
+	client := mockPublisher{published: make(chan mockPublishedMessage, 10)}
+	deadLetters, err := internal.NewDeadLetterPublisher(&client, "alerts/rejected")
+	if err != nil {
+		t.Errorf("could not create dead-letter publisher: %v", err)
+		return
+	}
+	m.controller.SetDeadLetterPublisher(deadLetters)
+	m.controller.SetAlertValidator(internal.NewAlertValidator(internal.AlertLimits{
+		MaxImageBytes:  10000,
+		MaxImageWidth:  64,
+		MaxImageHeight: 48,
+		MaxClockSkew:   time.Minute,
+	}))
+
+	now := time.Now().Unix()
+	smallPNG := encodeTestImage(t, "png", 64, 48)
+	smallJPEG := encodeTestImage(t, "jpeg", 32, 32)
+	tests := []struct {
+		payload string
+		reason  internal.RejectReason // empty if the alert is valid
+	}{
+		{`{"raw_image":`, internal.RejectInvalidJSON},
+		{fmt.Sprintf(`{"timestamp":%d}`, now), internal.RejectMissingImage},
+		{fmt.Sprintf(`{"raw_image":"not base64!","timestamp":%d}`, now), internal.RejectInvalidBase64},
+		{fmt.Sprintf(`{"raw_image":"%s","timestamp":%d}`, base64.StdEncoding.EncodeToString(make([]byte, 20000)), now), internal.RejectImageTooLarge},
+		{fmt.Sprintf(`{"raw_image":"%s","timestamp":%d}`, base64.StdEncoding.EncodeToString([]byte("dummy")), now), internal.RejectUnsupportedImage},
+		{fmt.Sprintf(`{"raw_image":"%s","timestamp":%d}`, encodeTestImage(t, "gif", 8, 8), now), internal.RejectUnsupportedImage},
+		{fmt.Sprintf(`{"raw_image":"%s","timestamp":%d}`, encodeTestImage(t, "png", 65, 48), now), internal.RejectResolutionTooHigh},
+		{fmt.Sprintf(`{"raw_image":"%s","annotated_image":"%s","timestamp":%d}`, smallPNG, encodeTestImage(t, "png", 64, 49), now), internal.RejectResolutionTooHigh},
+		{fmt.Sprintf(`{"raw_image":"%s"}`, smallPNG), internal.RejectInvalidTimestamp},
+		{fmt.Sprintf(`{"raw_image":"%s","timestamp":%d}`, smallPNG, now*1000), internal.RejectFutureTimestamp},
+		{fmt.Sprintf(`{"raw_image":"%s","annotated_image":"%s","timestamp":%d}`, smallPNG, smallJPEG, now), ""},
+	}
+	expected := make(map[internal.RejectReason]uint64)
+	for _, test := range tests {
+		m.controller.MQTTHandler(nil, newMockMQTTMessage(test.payload))
+		if test.reason == "" {
+			continue
+		}
+		expected[test.reason]++
+
+		var msg mockPublishedMessage
+		select {
+		case msg = <-client.published:
+		case <-time.After(5 * time.Second):
+			t.Errorf("alert with %s was not published to the dead-letter topic", test.reason)
+			return
+		}
+		var letter internal.DeadLetter
+		if err := json.Unmarshal(msg.payload, &letter); err != nil {
+			t.Errorf("error unmarshalling dead letter: %v", err)
+			return
+		}
+		if msg.topic != "alerts/rejected" || letter.Reason != test.reason || letter.Source != "mqtt" || letter.Topic != "alerts" {
+			t.Errorf("expected %s alert from mqtt topic alerts to be published to alerts/rejected but got %s from %s topic %s published to %s: %s", test.reason, letter.Reason, letter.Source, letter.Topic, msg.topic, letter.Error)
+		}
+		if len(letter.Payload) == 0 && letter.RawPayload != test.payload {
+			t.Errorf("expected dead letter to contain the alert but got %s", msg.payload)
+		}
+	}
+
+	// only the valid alert is analyzed
+	if _, abort := waitForCameraAnalysis(t, m.controller, "default"); abort {
+		return
+	}
+	// the frontend's own dead letters are not treated as alerts
+	m.controller.MQTTHandler(nil, mockMQTTMessage{payload: []byte(`{"reason":"missing_image"}`), topic: "alerts/rejected"})
+	select {
+	case msg := <-client.published:
+		t.Errorf("did not expect the valid alert or the dead letter to be published to the dead-letter topic but got %s", msg.payload)
+	default:
+	}
+
+	w := httptest.NewRecorder()
+	m.controller.StatusHandler(w, httptest.NewRequest(http.MethodGet, "/api/alertsstatus", nil))
+	var status struct {
+		RejectedAlerts map[internal.RejectReason]uint64 `json:"rejected_alerts"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Errorf("error decoding status: %v", err)
+		return
+	}
+	for reason, count := range expected {
+		if status.RejectedAlerts[reason] != count {
+			t.Errorf("expected %d alerts to be rejected with %s but got %d", count, reason, status.RejectedAlerts[reason])
+		}
+	}
+}
+
+// Test that alerts submitted over HTTP are validated
+func TestIngestValidation(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+	m.controller.SetIngestToken(mockIngestToken)
+	m.controller.SetAlertValidator(internal.NewAlertValidator(internal.AlertLimits{}))
+
+	w := ingest(m.controller, mockIngestToken, "application/json", `{"raw_image":"dummy"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), string(internal.RejectInvalidBase64)) {
+		t.Errorf("expected status %d with reason %s but got %d: %s", http.StatusBadRequest, internal.RejectInvalidBase64, w.Code, w.Body.String())
+	}
+	// the timestamp defaults to the time the alert is received
+	w = ingest(m.controller, mockIngestToken, "application/json", fmt.Sprintf(`{"raw_image":"%s"}`, encodeTestImage(t, "jpeg", 16, 16)))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("expected status %d but got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+
+	// alerts without an image are rejected even if alerts are not validated
+	m.controller.SetAlertValidator(nil)
+	w = ingest(m.controller, mockIngestToken, "application/json", `{"camera":"yard"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), string(internal.RejectMissingImage)) {
+		t.Errorf("expected status %d with reason %s but got %d: %s", http.StatusBadRequest, internal.RejectMissingImage, w.Code, w.Body.String())
+	}
+}
+
+// returns the base64-encoded image
+func encodeTestImage(t *testing.T, format string, width, height int) string {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Errorf("could not encode %s image: %v", format, err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
@@ -5,86 +5,88 @@ package internal
 // sends REST calls to the LLM.
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/kwkoo/threat-detection-frontend/internal/history"
+	"github.com/kwkoo/threat-detection-frontend/internal/llm"
+	"github.com/kwkoo/threat-detection-frontend/internal/pipeline"
 	"github.com/kwkoo/threat-detection-frontend/internal/prompts"
-	"github.com/sashabaranov/go-openai"
+	"github.com/kwkoo/threat-detection-frontend/internal/verdict"
 )
 
 const llmRequestTimeoutSeconds = 60
-const llmChannelSize = 3
 
-const mockOllamaOutput = "/tmp/ollama.txt"
-const mockOpenAIOutput = "/tmp/openai.txt"
+var ErrNoPendingAlert = errors.New("we do not have any pending alerts")
 
-// Alert coming from the image-acquirer via MQTT
+// Alert coming from the image-acquirer via MQTT. Alerts without a camera are
+// assigned the camera in the topic if they are published to
+// <alerts topic>/<camera>.
 type alertMQTT struct {
-	AnnotatedImage string `json:"annotated_image"`
-	RawImage       string `json:"raw_image"`
-	Timestamp      int64  `json:"timestamp"`
+	AnnotatedImage string   `json:"annotated_image"`
+	RawImage       string   `json:"raw_image"`
+	Timestamp      int64    `json:"timestamp"`
+	Camera         string   `json:"camera,omitempty"`
+	Classes        []string `json:"classes,omitempty"` // objects detected in the image
 }
 
-// Alert going to the browsers via SSE
+// Alert going to the browsers via SSE. The images are only carried until the
+// alert is saved to the history - after that, the browsers retrieve them from
+// /api/alerts/{id}/images/{raw|annotated}.
 type alertEvent struct {
-	annotatedImage []byte
-	rawImage       []byte
+	id             string
+	annotatedImage string
+	rawImage       string
 	timestamp      int64
+	camera         string
+	classes        []string
 	prompt         prompts.PromptItem
-}
-
-func (s alertEvent) copy() alertEvent {
-	d := alertEvent{
-		timestamp: s.timestamp,
-		prompt:    s.prompt,
-	}
-	if s.annotatedImage != nil {
-		d.annotatedImage = make([]byte, len(s.annotatedImage))
-		copy(d.annotatedImage, s.annotatedImage)
-	}
-	if s.rawImage != nil {
-		d.rawImage = make([]byte, len(s.rawImage))
-		copy(d.rawImage, s.rawImage)
-	}
-	return d
+	reanalyze      bool // analyzed again because the prompt was changed
 }
 
 type AlertsController struct {
-	eventsPaused       atomic.Bool
-	sseCh              chan SSEEvent
-	ollamaURL          string
-	ollamaModel        string
-	keepAlive          string
-	prompts            *prompts.PromptsContainer
-	openAIModel        string
-	openAIPrompt       string
-	openAIURL          string
-	latestAlert        alertEvent
-	latestAlertMux     sync.RWMutex
-	imageAnalysis      AtomicString
-	threatAnalysis     AtomicString
-	llmCh              chan alertEvent
-	saveModelResponses bool
-	ollamaFile         *os.File
-	openaiFile         *os.File
+	sseCh         chan SSEEvent
+	pipeline      *pipeline.Pipeline
+	prompts       atomic.Pointer[prompts.PromptsContainer] // replaced when the prompts file is reloaded
+	promptsMux    sync.Mutex                               // prevents a prompt selection from being lost while the prompts are reloaded
+	cameras       map[string]*cameraState
+	camerasMux    sync.RWMutex
+	latestCamera  AtomicString // camera of the alert that was analyzed most recently
+	queue         *alertQueue
+	queuePolicy   atomic.Pointer[QueuePolicy] // nil if every alert has the same priority and alerts do not expire
+	history       *history.Store
+	results       atomic.Pointer[ResultsPublisher] // nil if results are not published
+	ingestToken   string                           // alerts cannot be submitted over HTTP if this is not set
+	validator     atomic.Pointer[AlertValidator]   // nil if alerts are not validated
+	rejections    rejectionCounts
+	deadLetters   atomic.Pointer[DeadLetterPublisher] // nil if rejected alerts are not published
+	maxPending    atomic.Int32                        // alerts that arrive while a camera is paused are discarded if this is 0
+	llmWorkers    atomic.Int32                        // number of alerts that can be analyzed at the same time
+	workers       atomic.Pointer[workerPool]          // nil until the LLMChannelProcessor is started
+	pausePolicies atomic.Pointer[pausePolicies]       // nil if every camera stays paused until it is resumed
+	countdowns    sync.WaitGroup                      // resume countdowns - the LLMChannelProcessor waits for them before it returns
+	alertsTopic   string
+	location      *time.Location // time zone of the time in prompt templates
 }
 
 // Ensure that ch is a buffered channel - if the channel is not buffered,
-// sending events to this channel will fail
-func NewAlertsController(ch chan SSEEvent, ollamaURL, ollamaModel, keepAlive, promptsFile, openAIModel, openAIPrompt, openAIURL string) *AlertsController {
+// sending events to this channel will fail.
+// The pipeline must have been initialized.
+// alertsTopic is used to get the camera from the topic of alerts that are
+// published to alertsTopic/<camera>.
+// location is the time zone that times are shown to the LLM in.
+func NewAlertsController(ch chan SSEEvent, promptsFile string, analysisPipeline *pipeline.Pipeline, historyStore *history.Store, alertsTopic string, location *time.Location) *AlertsController {
 	if cap(ch) < 1 {
 		log.Fatal("SSEEvent channel cannot be unbuffered")
 	}
@@ -94,62 +96,35 @@ func NewAlertsController(ch chan SSEEvent, ollamaURL, ollamaModel, keepAlive, pr
 		log.Fatal(err)
 	}
 
-	log.Printf("alerts controller initializing with ollamaURL=%s, ollamaModel=%s, keepAlive=%s, openAIModel=%s, openAIPrompt=%s, openAIURL=%s", ollamaURL, ollamaModel, keepAlive, openAIModel, openAIPrompt, openAIURL)
-
-	if openAIURL == "" {
-		log.Print("openAIURL is not set so we will not call it - will stream Ollama responses to client")
+	for _, stage := range analysisPipeline.Stages {
+		log.Printf("alerts controller initializing with pipeline stage %s (backend %s, input %s)", stage.Name, stage.Backend, stage.Input)
 	}
 
 	c := AlertsController{
-		sseCh:        ch,
-		ollamaURL:    ollamaURL,
-		ollamaModel:  ollamaModel,
-		keepAlive:    keepAlive,
-		prompts:      prompts,
-		openAIModel:  openAIModel,
-		openAIPrompt: openAIPrompt,
-		openAIURL:    openAIURL,
-		llmCh:        make(chan alertEvent, llmChannelSize),
-	}
+		sseCh:       ch,
+		pipeline:    analysisPipeline,
+		cameras:     make(map[string]*cameraState),
+		queue:       newAlertQueue(defaultQueueSize),
+		history:     historyStore,
+		alertsTopic: alertsTopic,
+		location:    location,
+	}
+	c.prompts.Store(prompts)
 	return &c
 }
 
-func (controller *AlertsController) Shutdown() {
-	if controller.ollamaFile != nil {
-		controller.ollamaFile.Close()
-		controller.ollamaFile = nil
-	}
-	if controller.openaiFile != nil {
-		controller.openaiFile.Close()
-		controller.openaiFile = nil
-	}
-}
-
-// Used to save mock data
-func (controller *AlertsController) SaveModelResponses() {
-	controller.saveModelResponses = true
-	var err error
-	controller.ollamaFile, err = os.Create(mockOllamaOutput)
-	if err != nil {
-		log.Printf("could not create %s: %v", mockOllamaOutput, err)
-	}
-	controller.openaiFile, err = os.Create(mockOpenAIOutput)
-	if err != nil {
-		log.Printf("could not create %s: %v", mockOpenAIOutput, err)
-	}
-}
-
 // PromptHandler gets invoked when a REST call is made to list the available prompts or to set the prompt
 func (controller *AlertsController) PromptHandler(w http.ResponseWriter, r *http.Request) {
 	// get prompts
 	if r.Method != http.MethodPost && r.Method != http.MethodPut {
-		controller.prompts.StreamShortPrompts(w)
+		controller.prompts.Load().StreamShortPrompts(w)
 		return
 	}
 
 	// set prompts
 	in := struct {
-		ID *int `json:"id"`
+		ID     *prompts.ID `json:"id"`
+		Camera string      `json:"camera"`
 	}{}
 	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
 		http.Error(w, fmt.Sprintf("error decoding HTTP request body for prompt endpoint: %v", err), http.StatusPreconditionFailed)
@@ -160,333 +135,668 @@ func (controller *AlertsController) PromptHandler(w http.ResponseWriter, r *http
 		return
 	}
 	newID := *in.ID
-	if err := controller.prompts.SetSelectedPrompt(newID); err != nil {
-		http.Error(w, fmt.Sprintf("error setting prompt to %d: %v", newID, err), http.StatusPreconditionFailed)
-		return
+	err := controller.SetPrompt(in.Camera, newID)
+	switch {
+	case err == nil:
+		w.Write([]byte(fmt.Sprintf("prompt set to %s", newID)))
+	case errors.Is(err, ErrNoPendingAlert):
+		http.Error(w, "prompt set - but we do not have any pending alerts", http.StatusFailedDependency)
+	case errors.Is(err, ErrLLMQueueFull):
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	}
+}
+
+// PromptsListHandler returns every prompt with all of its fields
+func (controller *AlertsController) PromptsListHandler(w http.ResponseWriter, r *http.Request) {
+	controller.prompts.Load().ListHandler(w, r)
+}
+
+// PromptItemHandler adds, changes or deletes a prompt - the URL path should
+// be stripped down to the prompt ID
+func (controller *AlertsController) PromptItemHandler(w http.ResponseWriter, r *http.Request) {
+	controller.prompts.Load().ItemHandler(w, r)
+}
+
+// SetPrompt selects a new prompt for the camera and sends the camera's latest
+// alert to be analyzed again with that prompt. If camera is empty, the prompt
+// is selected for every camera that has not selected a prompt of its own, and
+// for the camera of the alert that was analyzed most recently.
+// ErrNoPendingAlert is returned if the prompt was set but there is no alert
+// to analyze.
+func (controller *AlertsController) SetPrompt(camera string, newID prompts.ID) error {
+	controller.promptsMux.Lock()
+	container := controller.prompts.Load()
+	var err error
+	if camera == "" {
+		err = container.SetSelectedPrompt(newID)
+		camera = controller.latestCamera.Load()
+	} else {
+		_, err = container.GetPromptItem(newID)
+	}
+	var state *cameraState
+	if err == nil && camera != "" {
+		state = controller.camera(camera)
+		state.setSelectedPrompt(newID)
+	}
+	controller.promptsMux.Unlock()
+	if err != nil {
+		return fmt.Errorf("error setting prompt to %s: %w", newID, err)
 	}
-	event := controller.getLatestAlert()
 
 	// if we don't have a latest alert, we don't have to pass it to the LLMChannelProcessor
-	if event.annotatedImage == nil && event.rawImage == nil && event.timestamp == 0 {
-		http.Error(w, "prompt set - but we do not have any pending alerts", http.StatusFailedDependency)
-		return
+	if state == nil {
+		return ErrNoPendingAlert
 	}
-	selectedPrompt, err := controller.prompts.GetSelectedPromptItem()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("error getting selected prompt: %v", err), http.StatusPreconditionFailed)
-		return
+	event := state.getLatestAlert()
+	if event.id == "" {
+		return ErrNoPendingAlert
 	}
-	if selectedPrompt == nil {
-		http.Error(w, "could not get selected prompt", http.StatusPreconditionFailed)
-		return
+	selectedPrompt, err := container.GetPromptItem(newID)
+	if err != nil {
+		return fmt.Errorf("error getting selected prompt: %w", err)
 	}
 	event.prompt = *selectedPrompt
-	select {
-	case controller.llmCh <- event:
-		w.Write([]byte(fmt.Sprintf("prompt set to %d", newID)))
-	default:
-		msg := "LLM channel is full"
-		log.Print(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+	event.reanalyze = true
+	running := state.runningAnalysis()
+	if err := controller.queueAlert(event); err != nil {
+		log.Print(err)
+		return err
+	}
+	// the analysis with the old prompt is not needed anymore - the new event
+	// may already be being analyzed, so only the analysis that was in
+	// progress before it was queued is cancelled
+	if running != 0 && state.cancelAnalysis(running, cancelPromptChanged) {
+		log.Printf("cancelling analysis of camera %s because the prompt was changed", state.name)
+	}
+	return nil
+}
+
+// returns the prompt that the camera has selected, or the prompt that is
+// selected for every camera if the camera has not selected one (or if its
+// prompt has since been removed)
+func (controller *AlertsController) promptFor(state *cameraState) (*prompts.PromptItem, error) {
+	container := controller.prompts.Load()
+	if id := state.selectedPrompt(); id != "" {
+		if item, err := container.GetPromptItem(id); err == nil {
+			return item, nil
+		}
 	}
+	return container.GetSelectedPromptItem()
 }
 
 // ResumeEventsHandler is called when the user clicks on the "Resume Stream" button in the web UI
+// - set the camera query parameter to only resume the events of that camera
 func (controller *AlertsController) ResumeEventsHandler(w http.ResponseWriter, r *http.Request) {
-	log.Print("resuming event stream")
-	controller.eventsPaused.Store(false)
+	controller.ResumeEvents(r.URL.Query().Get("camera"))
 	w.Write([]byte("OK"))
+}
+
+// ResumeEvents resumes the events of every camera if camera is empty
+func (controller *AlertsController) ResumeEvents(camera string) {
+	if camera == "" {
+		log.Print("resuming event stream of every camera")
+		for _, state := range controller.cameraStates() {
+			state.stopCountdown()
+			state.setPaused(false)
+		}
+	} else {
+		log.Printf("resuming event stream of camera %s", camera)
+		if state, ok := controller.findCamera(camera); ok {
+			state.stopCountdown()
+			state.setPaused(false)
+		}
+	}
 	controller.sseCh <- SSEEvent{
 		EventType: "resume_events",
 		Data:      nil,
+		Camera:    camera,
+	}
+
+	if camera == "" {
+		for _, state := range controller.cameraStates() {
+			controller.analyzeNextPending(state)
+		}
+	} else if state, ok := controller.findCamera(camera); ok {
+		controller.analyzeNextPending(state)
 	}
 }
 
-// CurrentStateHandler is called when the web UI is first loaded
+// AcknowledgeAlert records that an operator has seen the alert and lets the
+// other browsers know - history.ErrNotFound is returned if the alert is not
+// in the history
+func (controller *AlertsController) AcknowledgeAlert(id string) error {
+	var acknowledgedAt int64
+	var camera string
+	err := controller.history.Update(id, func(record *history.Record) {
+		if record.AcknowledgedAt == 0 {
+			record.AcknowledgedAt = time.Now().Unix()
+		}
+		acknowledgedAt = record.AcknowledgedAt
+		camera = record.Camera
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("alert %s acknowledged", id)
+	marshaled, err := json.Marshal(struct {
+		AlertID        string `json:"alert_id"`
+		AcknowledgedAt int64  `json:"acknowledged_at"`
+	}{
+		AlertID:        id,
+		AcknowledgedAt: acknowledgedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("error converting acknowledgement to json: %w", err)
+	}
+	return controller.sendToSSECh(SSEEvent{
+		EventType: "alert_acknowledged",
+		Data:      marshaled,
+		Camera:    camera,
+	})
+}
+
+// CurrentStateHandler is called when the web UI is first loaded - set the
+// camera query parameter to get the state of that camera, otherwise the state
+// of the camera of the alert that was analyzed most recently is returned
 func (controller *AlertsController) CurrentStateHandler(w http.ResponseWriter, r *http.Request) {
-	latestAlert := controller.getLatestAlert()
+	camera := r.URL.Query().Get("camera")
+	if camera == "" {
+		camera = controller.latestCamera.Load()
+	}
+	var view cameraView
+	if camera != "" {
+		state, ok := controller.findCamera(camera)
+		if !ok {
+			http.Error(w, fmt.Sprintf("camera %s not found", camera), http.StatusNotFound)
+			return
+		}
+		view = state.view()
+	}
+	cameras := []string{}
+	for _, state := range controller.cameraStates() {
+		cameras = append(cameras, state.name)
+	}
+	latestAlert := view.latestAlert
 	resp := struct {
-		AnnotatedImage string `json:"annotated_image"`
-		RawImage       string `json:"raw_image"`
-		Timestamp      int64  `json:"timestamp"`
-		Prompt         string `json:"prompt"`
-		ImageAnalysis  string `json:"image_analysis"`
-		ThreatAnalysis string `json:"threat_analysis"`
-		EventsPaused   bool   `json:"events_paused"`
+		Camera         string          `json:"camera,omitempty"`
+		Cameras        []string        `json:"cameras"`
+		AlertID        string          `json:"alert_id,omitempty"`
+		AnnotatedImage string          `json:"annotated_image_url,omitempty"`
+		RawImage       string          `json:"raw_image_url,omitempty"`
+		Timestamp      int64           `json:"timestamp"`
+		Prompt         string          `json:"prompt"`
+		ImageAnalysis  string          `json:"image_analysis"`
+		ThreatAnalysis string          `json:"threat_analysis"`
+		ThreatVerdict  json.RawMessage `json:"threat_verdict,omitempty"`
+		EventsPaused   bool            `json:"events_paused"`
+		PendingCount   int             `json:"pending_count"`
+		PendingDropped uint64          `json:"pending_dropped"`
+		PendingAlerts  []pendingAlert  `json:"pending_alerts"`
+		PausePolicy    string          `json:"pause_policy"`
+		ResumeAt       int64           `json:"resume_at,omitempty"` // the camera is resumed at this time unless it is resumed first
 	}{
-		AnnotatedImage: string(latestAlert.annotatedImage),
-		RawImage:       string(latestAlert.rawImage),
+		Camera:         camera,
+		Cameras:        cameras,
 		Timestamp:      latestAlert.timestamp,
 		Prompt:         string(latestAlert.prompt.GetJSONBytes()),
-		ImageAnalysis:  controller.imageAnalysis.Load(),
-		ThreatAnalysis: controller.threatAnalysis.Load(),
-		EventsPaused:   controller.eventsPaused.Load(),
+		ImageAnalysis:  view.imageAnalysis,
+		ThreatAnalysis: view.threatAnalysis,
+		ThreatVerdict:  json.RawMessage(view.threatVerdict),
+		EventsPaused:   view.eventsPaused,
+		PendingCount:   len(view.pending),
+		PendingDropped: view.pendingDropped,
+		PendingAlerts:  view.pending,
+		PausePolicy:    controller.pausePolicy(camera).String(),
+	}
+	if !view.resumeAt.IsZero() {
+		resp.ResumeAt = view.resumeAt.Unix()
+	}
+	if resp.PendingAlerts == nil {
+		resp.PendingAlerts = []pendingAlert{}
+	}
+	if latestAlert.id != "" {
+		resp.AlertID = latestAlert.id
+		resp.AnnotatedImage = history.ImageURL(latestAlert.id, history.ImageAnnotated)
+		resp.RawImage = history.ImageURL(latestAlert.id, history.ImageRaw)
 	}
 	json.NewEncoder(w).Encode(resp)
 }
 
 // MQTTHandler gets invoked when a message is received on the alerts MQTT topic
 func (controller *AlertsController) MQTTHandler(_ MQTT.Client, mqttMessage MQTT.Message) {
+	if controller.publishesTo(mqttMessage.Topic()) {
+		// a rejected alert would otherwise be rejected and republished forever
+		log.Printf("ignoring message on topic %s because the frontend publishes to it", mqttMessage.Topic())
+		return
+	}
 	var msg alertMQTT
 	if err := json.Unmarshal(mqttMessage.Payload(), &msg); err != nil {
-		log.Printf("error trying to unmarshal alert MQTT message: %v", err)
+		controller.rejectAlert(fmt.Errorf("error trying to unmarshal alert MQTT message: %w", err), "mqtt", mqttMessage.Topic(), mqttMessage.Payload())
 		return
 	}
+	if err := controller.validateAlert(msg); err != nil {
+		controller.rejectAlert(err, "mqtt", mqttMessage.Topic(), mqttMessage.Payload())
+		return
+	}
+
+	camera := controller.cameraFromAlert(msg, mqttMessage.Topic())
+	log.Printf("received alert MQTT message from camera %s", camera)
+	if _, err := controller.submitAlert(msg, camera); err != nil {
+		log.Print(err)
+	}
+}
 
-	log.Print("received alert MQTT message")
+// returns true if topic is the dead-letter or results topic
+func (controller *AlertsController) publishesTo(topic string) bool {
+	if publisher := controller.deadLetters.Load(); publisher != nil && publisher.topic == topic {
+		return true
+	}
+	if publisher := controller.results.Load(); publisher != nil && publisher.topic == topic {
+		return true
+	}
+	return false
+}
 
-	currentPrompt, err := controller.prompts.GetSelectedPromptItem()
+// submitAlert queues the alert for analysis with the camera's prompt and
+// returns the alert's ID - ErrLLMQueueFull is returned if the alert could
+// not be queued
+func (controller *AlertsController) submitAlert(msg alertMQTT, camera string) (string, error) {
+	currentPrompt, err := controller.promptFor(controller.camera(camera))
 	if err != nil {
-		log.Printf("could not get currently selected prompt: %v", err)
-		return
+		return "", fmt.Errorf("could not get currently selected prompt: %w", err)
 	}
 	if currentPrompt == nil {
-		log.Print("could not get currently selected prompt")
-		return
+		return "", errors.New("could not get currently selected prompt")
 	}
 	event := alertEvent{
-		annotatedImage: []byte(msg.AnnotatedImage),
-		rawImage:       []byte(msg.RawImage),
+		id:             history.NewID(),
+		annotatedImage: msg.AnnotatedImage,
+		rawImage:       msg.RawImage,
 		timestamp:      msg.Timestamp,
+		camera:         camera,
+		classes:        msg.Classes,
 		prompt:         *currentPrompt,
 	}
 
-	select {
-	case controller.llmCh <- event:
-		log.Print("added alertEvent to LLM channel")
-	default:
-		msg := "LLM channel is full"
-		log.Print(msg)
+	if err := controller.queueAlert(event); err != nil {
+		return "", err
+	}
+	log.Print("added alertEvent to LLM queue")
+	return event.id, nil
+}
+
+// WatchPromptsFile checks the prompts file for changes at every interval and
+// reloads the prompts when the file changes. Browsers are sent a
+// prompts_changed event so that they can refresh their list of prompts.
+// Start this in a goroutine - cancel the Context to terminate the goroutine.
+func (controller *AlertsController) WatchPromptsFile(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		log.Print("prompts file will not be reloaded because the reload interval is not set")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := controller.prompts.Load().FileChanged()
+			if err != nil {
+				log.Printf("could not check prompts file for changes: %v", err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			if err := controller.ReloadPrompts(); err != nil {
+				log.Printf("keeping existing prompts: %v", err)
+			}
+		}
+	}
+}
+
+// ReloadPrompts replaces the prompts with the contents of the prompts file.
+// The selected prompt is kept if it still exists in the file.
+func (controller *AlertsController) ReloadPrompts() error {
+	controller.promptsMux.Lock()
+	reloaded, err := controller.prompts.Load().Reload()
+	if err != nil {
+		controller.promptsMux.Unlock()
+		return err
+	}
+	controller.prompts.Store(reloaded)
+	controller.promptsMux.Unlock()
+
+	var shortPrompts bytes.Buffer
+	if err := reloaded.StreamShortPrompts(&shortPrompts); err != nil {
+		return err
+	}
+	selected := reloaded.SelectedPromptID()
+	log.Printf("reloaded %d prompts - selected prompt is %s", len(reloaded.ListPromptItems()), selected)
+	marshaled, err := json.Marshal(struct {
+		Selected prompts.ID      `json:"selected"`
+		Prompts  json.RawMessage `json:"prompts"`
+	}{
+		Selected: selected,
+		Prompts:  shortPrompts.Bytes(),
+	})
+	if err != nil {
+		return fmt.Errorf("error converting prompts to json: %w", err)
 	}
+	return controller.sendToSSECh(SSEEvent{
+		EventType: "prompts_changed",
+		Data:      marshaled,
+	})
+}
+
+// BroadcastMQTTStatus lets the browsers know when the connection to the MQTT
+// broker changes state - alerts are not received while it is not connected
+func (controller *AlertsController) BroadcastMQTTStatus(status MQTTStatus) {
+	marshaled, err := json.Marshal(&status)
+	if err != nil {
+		log.Printf("error converting MQTT status to json: %v", err)
+		return
+	}
+	controller.sendToSSECh(SSEEvent{
+		EventType: "mqtt_status",
+		Data:      marshaled,
+	})
+}
+
+// the camera in the alert takes precedence over the camera in the topic
+func (controller *AlertsController) cameraFromAlert(msg alertMQTT, topic string) string {
+	if camera := strings.TrimSpace(msg.Camera); camera != "" {
+		return camera
+	}
+	if camera := strings.TrimPrefix(topic, controller.alertsTopic+"/"); controller.alertsTopic != "" && camera != topic && camera != "" {
+		return camera
+	}
+	return defaultCamera
 }
 
 // REST endpoint that returns the size of the output channels
 func (controller *AlertsController) StatusHandler(w http.ResponseWriter, r *http.Request) {
 	status := struct {
-		SSEChannel int `json:"sse_channel"`
-		LLMChannel int `json:"llm_channel"`
+		SSEChannel     int                     `json:"sse_channel"`
+		LLMQueue       int                     `json:"llm_queue"`
+		DroppedAlerts  uint64                  `json:"dropped_alerts"`
+		ExpiredAlerts  uint64                  `json:"expired_alerts"`
+		LLMWorkers     []workerStatus          `json:"llm_workers"`
+		RejectedAlerts map[RejectReason]uint64 `json:"rejected_alerts"`
 	}{
-		SSEChannel: len(controller.sseCh),
-		LLMChannel: len(controller.llmCh),
+		SSEChannel:     len(controller.sseCh),
+		LLMWorkers:     controller.workers.Load().status(),
+		RejectedAlerts: controller.rejections.snapshot(),
 	}
+	status.LLMQueue, status.DroppedAlerts, status.ExpiredAlerts = controller.queue.counts()
 	json.NewEncoder(w).Encode(&status)
 }
 
-func (controller *AlertsController) broadcastImages(alert alertEvent) {
+// The image events only carry the URL of each image together with its
+// metadata
+func (controller *AlertsController) broadcastImages(alert alertEvent, record *history.Record) {
 	controller.sseCh <- SSEEvent{
 		EventType: "timestamp",
 		Data:      []byte(strconv.FormatInt(alert.timestamp, 10)),
+		Camera:    alert.camera,
 	}
-	controller.sseCh <- SSEEvent{
-		EventType: "annotated_image",
-		Data:      alert.annotatedImage,
-	}
-	controller.sseCh <- SSEEvent{
-		EventType: "raw_image",
-		Data:      alert.rawImage,
+	for _, kind := range []string{history.ImageAnnotated, history.ImageRaw} {
+		marshaled, err := json.Marshal(record.ImageInfo(kind))
+		if err != nil {
+			log.Printf("error converting %s image info to json: %v", kind, err)
+			continue
+		}
+		controller.sseCh <- SSEEvent{
+			EventType: kind + "_image",
+			Data:      marshaled,
+			Camera:    alert.camera,
+		}
 	}
 	controller.sseCh <- SSEEvent{
 		EventType: "llm_request_start",
 		Data:      nil,
+		Camera:    alert.camera,
 	}
 }
 
-// Start this in a goroutine - cancel the Context to terminate the goroutine
+// Start this in a goroutine - cancel the Context to terminate the goroutine.
+// Alerts are passed on to the analysis workers - this returns once the
+// workers and the resume countdowns that they started have finished, so the
+// SSEEvent channel can be closed after this returns.
 func (controller *AlertsController) LLMChannelProcessor(ctx context.Context) {
-	oldPromptID := -1
+	pool := newWorkerPool(int(controller.llmWorkers.Load()))
+	controller.workers.Store(pool)
+	var wg sync.WaitGroup
+	for _, worker := range pool.workers {
+		wg.Add(1)
+		go func(worker *analysisWorker) {
+			controller.runWorker(ctx, pool, worker)
+			wg.Done()
+		}(worker)
+	}
+	defer func() {
+		wg.Wait()
+		// the workers start the countdowns, so no countdown is started once
+		// the workers have finished
+		controller.countdowns.Wait()
+	}()
+
 	for {
-		select {
-		case <-ctx.Done():
+		event, worker, ok := controller.queue.next(ctx, pool.pick)
+		if !ok {
 			return
-		case event, ok := <-controller.llmCh:
-			if !ok {
-				log.Print("LLM channel processor could not read from LLM channel")
-				return
-			}
-			promptID := event.prompt.ID
-
-			// ignore incoming event if events are paused
-			// make an exception for events with a new prompt because that
-			// means the user has changed the prompt
-			if oldPromptID == promptID && controller.eventsPaused.Load() {
-				log.Print("ignoring alert event because events are paused")
-				continue
-			}
-
-			// pause stream
-			controller.eventsPaused.Store(true)
-
-			oldPromptID = promptID
-			controller.setLatestAlert(event)
-			controller.broadcastImages(event)
-
-			controller.sendToSSECh(SSEEvent{
-				EventType: "prompt",
-				Data:      []byte(event.prompt.GetJSONBytes()),
-			})
-
-			ollamaReq := struct {
-				Model     string   `json:"model"`
-				KeepAlive string   `json:"keep_alive"`
-				Stream    bool     `json:"stream"`
-				Prompt    string   `json:"prompt"`
-				Images    []string `json:"images,omitempty"`
-			}{
-				Model:     controller.ollamaModel,
-				KeepAlive: controller.keepAlive,
-				Stream:    true,
-				Prompt:    event.prompt.Descriptive,
-			}
-			if event.rawImage != nil {
-				ollamaReq.Images = []string{string(event.rawImage)}
-			}
-
-			payload, err := json.Marshal(ollamaReq)
-			if err != nil {
-				log.Printf("error trying to marshal JSON for LLM request: %v", err)
-				continue
-			}
-			controller.ollamaRequest(ctx, payload)
-			controller.sseCh <- SSEEvent{
-				EventType: "pause_events",
-				Data:      nil,
-			}
 		}
+		if age, expired := controller.alertExpired(event); expired {
+			controller.expireAlert(event, age)
+			continue
+		}
+		pool.assign(event.camera, worker)
+		worker.queue <- event // pick only returns workers that have room
 	}
 }
 
-func (controller *AlertsController) ollamaRequest(parentCtx context.Context, payload []byte) {
-	ctx, cancel := context.WithTimeout(parentCtx, llmRequestTimeoutSeconds*time.Second)
-	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, controller.ollamaURL, bytes.NewReader(payload))
-	if err != nil {
-		log.Printf("error creating request to %s: %v", controller.ollamaURL, err)
+// processAlert is called by the camera's analysis worker for each alert
+func (controller *AlertsController) processAlert(ctx context.Context, event alertEvent) {
+	state := controller.camera(event.camera)
+	promptID := event.prompt.ID
+
+	// queue incoming event if events are paused
+	// make an exception for events that are analyzed again or have a new
+	// prompt because that means the user has changed the prompt
+	if !event.reanalyze && state.oldPromptID == promptID && state.paused() {
+		maxPending := int(controller.maxPending.Load())
+		if maxPending <= 0 {
+			log.Printf("ignoring alert event because events from camera %s are paused", state.name)
+			return
+		}
+		state.queuePending(event, maxPending)
+		log.Printf("queued alert event %s because events from camera %s are paused", event.id, state.name)
+		controller.broadcastPendingCount(state)
 		return
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	record, err := controller.loadAlert(&event)
 	if err != nil {
-		log.Printf("error making request to %s: %v", controller.ollamaURL, err)
+		log.Printf("ignoring alert event %s: %v", event.id, err)
 		return
 	}
-	log.Printf("LLM response status code %d", res.StatusCode)
-	if res.StatusCode != 200 {
-		log.Print("skipping processing of LLM response")
-		return
+
+	// pause stream unless the camera is never paused
+	controller.stopResumeCountdown(state)
+	policy := controller.pausePolicy(state.name)
+	if policy.Mode != PauseNever {
+		state.setPaused(true)
 	}
-	defer res.Body.Close()
-	controller.sendToSSECh(SSEEvent{
-		EventType: "ollama_response_start",
-		Data:      nil,
-	})
 
-	var b bytes.Buffer
-	scanner := bufio.NewScanner(res.Body)
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		text := scanner.Text()
-		if controller.ollamaFile != nil {
-			controller.ollamaFile.WriteString(text)
-			controller.ollamaFile.Write([]byte{'\n'})
-		}
-		decodedResponse, err := decodeOllamaResponse(text)
-		if err != nil {
-			log.Print(err)
-			continue
-		}
-		b.WriteString(decodedResponse)
+	state.oldPromptID = promptID
+	state.startAlert(event)
+	controller.latestCamera.Store(state.name)
+	controller.broadcastImages(event, record)
 
-		controller.sendToSSECh(SSEEvent{
-			EventType: "ollama_response",
-			Data:      []byte(text),
-		})
-	}
 	controller.sendToSSECh(SSEEvent{
-		EventType: "ollama_response_stop",
-		Data:      nil,
+		EventType: "prompt",
+		Data:      []byte(event.prompt.GetJSONBytes()),
+		Camera:    event.camera,
 	})
 
-	llmResponse := b.String()
-	controller.imageAnalysis.Store(llmResponse)
-
-	if controller.openAIURL != "" {
-		// make request to OpenAI API here, passing it the prompt and the response from Ollama
-		if err := controller.openAIRequest(parentCtx, llmResponse); err != nil {
-			log.Printf("error making openai request: %v", err)
-			return
-		}
+	// an alert that is analyzed again with a new prompt keeps the same
+	// previous verdict
+	if event.id != state.currentAlertID {
+		state.previousVerdict = state.currentVerdict
+		state.currentAlertID = event.id
+	}
+	analysisCtx, cancelAnalysis := context.WithCancel(ctx)
+	state.startAnalysis(cancelAnalysis)
+	outputs := controller.analyze(analysisCtx, state, event, record.RawImage)
+	reason := state.finishAnalysis()
+	cancelAnalysis()
+	if reason != "" {
+		controller.finishCancelledAnalysis(ctx, state, policy, event, reason)
 		return
 	}
+	threatVerdict := controller.parseVerdict(state, outputs)
+	state.currentVerdict = ""
+	if threatVerdict != nil {
+		state.currentVerdict = string(threatVerdict.Level)
+	}
+	controller.saveToHistory(event, outputs, threatVerdict)
+	controller.publishResult(event, outputs, threatVerdict)
+	controller.applyPausePolicy(ctx, state, policy, threatVerdict)
+}
 
+// runs the alert through each stage of the pipeline and returns the output
+// of every stage that was executed
+func (controller *AlertsController) analyze(ctx context.Context, state *cameraState, event alertEvent, rawImage string) map[string]string {
+	outputs := make(map[string]string)
+	prompt, err := event.prompt.Render(controller.templateData(event, state.previousVerdict))
+	if err != nil {
+		// templates are validated when the prompts are loaded so this should
+		// not happen
+		log.Printf("sending prompt %s without rendering it: %v", event.prompt.ID, err)
+		prompt = event.prompt.Descriptive
+	}
+	for _, stage := range controller.pipeline.Stages {
+		output, err := controller.streamLLMResponse(ctx, event.camera, stage.Events, func(ctx context.Context, onToken llm.TokenFunc) (string, error) {
+			return stage.Execute(ctx, rawImage, prompt, event.prompt.LLMOptions(), outputs, onToken)
+		})
+		outputs[stage.Name] = output
+		switch stage.Name {
+		case pipeline.ImageAnalysisStage:
+			state.setImageAnalysis(output)
+		case pipeline.ThreatAnalysisStage:
+			state.setThreatAnalysis(output)
+		}
+		if err != nil {
+			log.Printf("error executing pipeline stage %s - skipping remaining stages: %v", stage.Name, err)
+			break
+		}
+	}
+	return outputs
 }
 
-func (controller *AlertsController) openAIRequest(ctx context.Context, text string) error {
-	config := openai.DefaultConfig("dummy")
-	config.BaseURL = controller.openAIURL
-	client := openai.NewClientWithConfig(config)
-	req := openai.ChatCompletionRequest{
-		Model:       controller.openAIModel,
-		Temperature: 0,
-		N:           1,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role:    "user",
-				Content: controller.openAIPrompt + "\n\n" + text,
-			},
-		},
+// alerts without a timestamp are treated as if they happened now
+func (controller *AlertsController) templateData(event alertEvent, previousVerdict string) prompts.TemplateData {
+	timestamp := time.Now()
+	if event.timestamp != 0 {
+		timestamp = time.Unix(event.timestamp, 0)
 	}
+	return prompts.NewTemplateData(event.camera, timestamp.In(controller.location), event.classes, previousVerdict)
+}
 
-	stream, err := client.CreateChatCompletionStream(ctx, req)
+// parses the output of the threat analysis stage and broadcasts the verdict
+// - returns nil if the pipeline does not have a threat analysis stage or if
+// the stage was not executed
+func (controller *AlertsController) parseVerdict(state *cameraState, outputs map[string]string) *verdict.Verdict {
+	threatAnalysis, ok := outputs[pipeline.ThreatAnalysisStage]
+	if !ok {
+		return nil
+	}
+	v := verdict.Parse(threatAnalysis)
+	marshaled, err := json.Marshal(&v)
 	if err != nil {
-		return fmt.Errorf("error creating openai chat completion stream: %w", err)
+		log.Printf("error converting threat verdict to json: %v", err)
+		return &v
 	}
-	defer stream.Close()
-	defer controller.sendToSSECh(SSEEvent{
-		EventType: "openai_response_stop",
-		Data:      nil,
+	state.setThreatVerdict(string(marshaled))
+	controller.sendToSSECh(SSEEvent{
+		EventType: "threat_verdict",
+		Data:      marshaled,
+		Camera:    state.name,
 	})
+	return &v
+}
 
-	var llmResponse bytes.Buffer
-	defer func(resp *bytes.Buffer) {
-		controller.threatAnalysis.Store(resp.String())
-	}(&llmResponse)
+// Relays each token to the browsers as an SSE event. The start event is sent
+// when the first token arrives, and the stop event is sent when the response
+// is complete.
+func (controller *AlertsController) streamLLMResponse(parentCtx context.Context, camera string, events pipeline.Events, request func(context.Context, llm.TokenFunc) (string, error)) (string, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, llmRequestTimeoutSeconds*time.Second)
+	defer cancel()
 
-	controller.sendToSSECh(SSEEvent{
-		EventType: "openai_response_start",
-		Data:      nil,
-	})
-	for {
-		resp, err := stream.Recv()
-		if errors.Is(err, io.EOF) {
-			return nil
-		}
-		if err != nil {
-			return fmt.Errorf("error receiving openai stream response: %w", err)
+	started := false
+	response, err := request(ctx, func(token string) {
+		if !started {
+			started = true
+			controller.sendToSSECh(SSEEvent{
+				EventType: events.Start,
+				Data:      nil,
+				Camera:    camera,
+			})
 		}
-		if controller.openaiFile != nil {
-			json.NewEncoder(controller.openaiFile).Encode(resp)
+		message := struct {
+			Response string `json:"response"`
+		}{
+			Response: token,
 		}
-		for _, choice := range resp.Choices {
-			message := struct {
-				Model    string `json:"model"`
-				Response string `json:"response"`
-				Done     bool   `json:"true"`
-			}{
-				Model:    "openai",
-				Response: choice.Delta.Content,
-				Done:     choice.FinishReason == openai.FinishReasonStop,
-			}
-			marshaled, err := json.Marshal(&message)
-			if err != nil {
-				log.Printf("error converting openai stream response to json: %v", err)
-				continue
-			}
-			llmResponse.WriteString(message.Response)
-			controller.sendToSSECh((SSEEvent{
-				EventType: "openai_response",
-				Data:      marshaled,
-			}))
+		marshaled, err := json.Marshal(&message)
+		if err != nil {
+			log.Printf("error converting LLM response to json: %v", err)
+			return
 		}
+		controller.sendToSSECh(SSEEvent{
+			EventType: events.Token,
+			Data:      marshaled,
+			Camera:    camera,
+			Token:     true,
+		})
+	})
+	if started {
+		controller.sendToSSECh(SSEEvent{
+			EventType: events.Stop,
+			Data:      nil,
+			Camera:    camera,
+		})
+	}
+	return response, err
+}
+
+// SetResultsPublisher publishes the result of every analysis from now on
+func (controller *AlertsController) SetResultsPublisher(publisher *ResultsPublisher) {
+	controller.results.Store(publisher)
+}
+
+func (controller *AlertsController) publishResult(event alertEvent, outputs map[string]string, threatVerdict *verdict.Verdict) {
+	publisher := controller.results.Load()
+	if publisher == nil {
+		return
+	}
+	result := AnalysisResult{
+		AlertID:       event.id,
+		Camera:        event.camera,
+		Timestamp:     event.timestamp,
+		PromptID:      event.prompt.ID,
+		ImageAnalysis: outputs[pipeline.ImageAnalysisStage],
+		ThreatLevel:   string(verdict.LevelUnknown),
+		Verdict:       threatVerdict,
+	}
+	if threatVerdict != nil {
+		result.ThreatLevel = string(threatVerdict.Level)
+	}
+	if err := publisher.Publish(result); err != nil {
+		log.Printf("could not publish result of alert %s: %v", event.id, err)
 	}
 }
 
@@ -501,35 +811,45 @@ func (controller *AlertsController) sendToSSECh(event SSEEvent) error {
 	}
 }
 
-func (controller *AlertsController) getLatestAlert() alertEvent {
-	controller.latestAlertMux.RLock()
-	defer controller.latestAlertMux.RUnlock()
-
-	if controller.latestAlert.annotatedImage == nil && controller.latestAlert.rawImage == nil && controller.latestAlert.timestamp == 0 {
-		return alertEvent{}
-	}
-
-	return controller.latestAlert.copy()
-}
-
-func (controller *AlertsController) setLatestAlert(newAlert alertEvent) {
-	controller.latestAlertMux.Lock()
-	controller.latestAlert = newAlert.copy()
-	controller.latestAlertMux.Unlock()
+// Saves a newly received alert to the history so that its images can be
+// served by URL, and removes the images from the event. Alerts that are being
+// analyzed again with a new prompt are already in the history, so they are
+// retrieved from there instead.
+func (controller *AlertsController) loadAlert(event *alertEvent) (*history.Record, error) {
+	if event.annotatedImage == "" && event.rawImage == "" {
+		return controller.history.Get(event.id)
+	}
+	record := history.Record{
+		ID:             event.id,
+		Timestamp:      event.timestamp,
+		Camera:         event.camera,
+		Prompt:         event.prompt,
+		AnnotatedImage: event.annotatedImage,
+		RawImage:       event.rawImage,
+		ThreatLevel:    string(verdict.LevelUnknown),
+	}
+	if err := controller.history.Put(record); err != nil {
+		return nil, fmt.Errorf("error saving alert to history: %w", err)
+	}
+	event.annotatedImage = ""
+	event.rawImage = ""
+	return &record, nil
 }
 
-// extracts response field from JSON
-func decodeOllamaResponse(j string) (string, error) {
-	if j == "" {
-		return "", errors.New("unexpected response from ollama - did not contain JSON")
-	}
-
-	// parse res.Body as JSON - grab response field
-	ollamaResponse := struct {
-		Response string `json:"response"`
-	}{}
-	if err := json.Unmarshal([]byte(j), &ollamaResponse); err != nil {
-		return "", fmt.Errorf("error trying to decode ollama response: %v", err)
+// records the analysis that was just streamed together with the alert
+func (controller *AlertsController) saveToHistory(event alertEvent, outputs map[string]string, threatVerdict *verdict.Verdict) {
+	err := controller.history.Update(event.id, func(record *history.Record) {
+		record.Prompt = event.prompt
+		record.ImageAnalysis = outputs[pipeline.ImageAnalysisStage]
+		record.ThreatAnalysis = outputs[pipeline.ThreatAnalysisStage]
+		record.ThreatLevel = string(verdict.LevelUnknown)
+		record.Verdict = threatVerdict
+		record.Stages = outputs
+		if threatVerdict != nil {
+			record.ThreatLevel = string(threatVerdict.Level)
+		}
+	})
+	if err != nil {
+		log.Printf("error saving alert %s to history: %v", event.id, err)
 	}
-	return ollamaResponse.Response, nil
 }
@@ -12,6 +12,8 @@ import (
 	"time"
 
 	"github.com/kwkoo/threat-detection-frontend/internal"
+	"github.com/kwkoo/threat-detection-frontend/internal/history"
+	"github.com/kwkoo/threat-detection-frontend/internal/verdict"
 )
 
 // Test that the AlertsController makes a request to ollama whenever an MQTT
@@ -25,10 +27,11 @@ func TestMQTTToOllama(t *testing.T) {
 	// wait for request to be received by ollama
 	m.waitForOllamaRequest()
 
-	if m.ollama.req.Images == nil || len(m.ollama.req.Images) == 0 {
+	req := m.ollamaRequest()
+	if req.Images == nil || len(req.Images) == 0 {
 		t.Error("ollama did not receive any images")
-	} else if m.ollama.req.Images[0] != "dummy" {
-		t.Errorf(`ollama received an image ("%s") different from what was expected`, m.ollama.req.Images[0])
+	} else if req.Images[0] != "dummy" {
+		t.Errorf(`ollama received an image ("%s") different from what was expected`, req.Images[0])
 	} else {
 		t.Log("ollama received the raw image correctly")
 	}
@@ -69,11 +72,9 @@ func TestSetPrompt(t *testing.T) {
 	}
 
 	// simulate alert coming in from MQTT
-	m.controller.MQTTHandler(nil, mockMQTTMessage{[]byte(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1234}`)})
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1234}`))
 	// wait for request to be received by ollama
-	t.Log("waiting for request to be received by ollama...")
-	<-m.ollama.requestReceived
-	t.Log("ollama request received")
+	m.waitForOllamaRequest()
 	m.resetOllamaRequestReceivedChannel()
 
 	if abort := setPrompt(t, m.controller, fmt.Sprintf(`{"id":%d}`, newPromptID), false); abort {
@@ -88,10 +89,10 @@ func TestSetPrompt(t *testing.T) {
 	// we are using the default prompts so the descriptive prompts are set to
 	// the short prompts; that's why we're ok to compare ollama's prompt with
 	// the short prompt
-	if m.ollama.req.Prompt == "descriptiveprompt2" {
+	if prompt := m.ollamaRequest().Prompt; prompt == "descriptiveprompt2" {
 		t.Log("ollama prompt was set correctly")
 	} else {
-		t.Errorf(`ollama prompt was expected to be "descriptiveprompt2" but was "%s" instead`, m.ollama.req.Prompt)
+		t.Errorf(`ollama prompt was expected to be "descriptiveprompt2" but was "%s" instead`, prompt)
 	}
 
 	// pause to allow mockSSEClient to consume the new prompt event
@@ -142,7 +143,7 @@ func TestSetPromptREST(t *testing.T) {
 	}
 
 	// simulate alert coming in from MQTT
-	m.controller.MQTTHandler(nil, mockMQTTMessage{[]byte(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1234}`)})
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1234}`))
 	// wait for request to be received by ollama
 	m.waitForOllamaRequest()
 
@@ -155,8 +156,11 @@ func TestSetPromptREST(t *testing.T) {
 	// missing required field
 	setPrompt(t, m.controller, `{"prompt":2}`, true)
 
+	// prompt IDs can be strings
+	setPrompt(t, m.controller, `{"id":"2"}`, false)
+
 	// wrong type
-	setPrompt(t, m.controller, `{"id":"2"}`, true)
+	setPrompt(t, m.controller, `{"id":true}`, true)
 }
 
 type shortPrompt struct {
@@ -229,3 +233,331 @@ func createTempPromptFile(t *testing.T, lines []string) (string, error) {
 	}
 	return f.Name(), nil
 }
+
+// Test that the alert and the LLM responses are saved to the history once
+// the analysis completes
+func TestAlertSavedToHistory(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummyannotated","raw_image":"dummy","timestamp":1234}`))
+	m.waitForOllamaRequest()
+
+	// the alert is saved when it is received - wait for the analysis to be
+	// added to it
+	var record *history.Record
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		summaries, _, err := m.history.List(history.Query{})
+		if err != nil {
+			t.Errorf("error listing history: %v", err)
+			return
+		}
+		if len(summaries) == 1 && summaries[0].Verdict != nil {
+			if record, err = m.history.Get(summaries[0].ID); err != nil {
+				t.Errorf("error getting record %s: %v", summaries[0].ID, err)
+				return
+			}
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if record == nil {
+		t.Errorf("expected 1 analyzed record in history but got %d records", m.history.Len())
+		return
+	}
+	if record.RawImage != "dummy" {
+		t.Errorf(`expected raw image to be "dummy" but got "%s"`, record.RawImage)
+	}
+	if record.ImageAnalysis != "dummy ollama response" {
+		t.Errorf(`expected image analysis to be "dummy ollama response" but got "%s"`, record.ImageAnalysis)
+	}
+	if record.ThreatLevel != "medium" {
+		t.Errorf(`expected threat level to be "medium" but got "%s"`, record.ThreatLevel)
+	}
+	if record.Verdict == nil || record.Verdict.Level != verdict.LevelMedium {
+		t.Errorf("expected verdict with medium threat level but got %v", record.Verdict)
+	}
+	// pause to allow mockSSEClient to consume the threat_verdict event
+	time.Sleep(time.Second)
+	if !m.sseEventsExist("threat_verdict") {
+		t.Error("did not receive expected threat_verdict SSE event")
+	}
+}
+
+// Test that the image SSE events carry the image URL instead of the image
+func TestImageEvents(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"ZHVtbXk=","raw_image":"dummy","timestamp":1234}`))
+	m.waitForOllamaRequest()
+
+	// pause to allow mockSSEClient to consume the image events
+	time.Sleep(time.Second)
+	info := m.getSSEClientImageInfo("annotated_image")
+	if info == nil {
+		t.Error("did not receive expected annotated_image SSE event")
+		return
+	}
+	if info.URL != history.ImageURL(info.AlertID, history.ImageAnnotated) {
+		t.Errorf(`unexpected annotated image URL "%s"`, info.URL)
+	}
+	if info.Size != len("dummy") {
+		t.Errorf("expected annotated image size to be %d but got %d", len("dummy"), info.Size)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/currentstate", nil)
+	w := httptest.NewRecorder()
+	m.controller.CurrentStateHandler(w, req)
+	var state struct {
+		AnnotatedImage string `json:"annotated_image_url"`
+		RawImage       string `json:"raw_image_url"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&state); err != nil {
+		t.Errorf("error decoding current state: %v", err)
+		return
+	}
+	if state.AnnotatedImage != info.URL {
+		t.Errorf(`expected current state annotated image URL to be "%s" but got "%s"`, info.URL, state.AnnotatedImage)
+	}
+	if state.RawImage != history.ImageURL(info.AlertID, history.ImageRaw) {
+		t.Errorf(`unexpected current state raw image URL "%s"`, state.RawImage)
+	}
+}
+
+func TestAcknowledgeAlert(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+
+	if err := m.controller.AcknowledgeAlert("does-not-exist"); err != history.ErrNotFound {
+		t.Errorf("expected ErrNotFound but got %v", err)
+	}
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1234}`))
+	m.waitForOllamaRequest()
+	summaries, _, err := m.history.List(history.Query{})
+	if err != nil || len(summaries) != 1 {
+		t.Errorf("expected 1 record in history but got %d (%v)", len(summaries), err)
+		return
+	}
+	id := summaries[0].ID
+	if err := m.controller.AcknowledgeAlert(id); err != nil {
+		t.Errorf("error acknowledging alert %s: %v", id, err)
+		return
+	}
+	record, err := m.history.Get(id)
+	if err != nil {
+		t.Errorf("error getting record %s: %v", id, err)
+		return
+	}
+	if record.AcknowledgedAt == 0 {
+		t.Error("expected alert to be marked as acknowledged")
+	}
+	// pause to allow mockSSEClient to consume the alert_acknowledged event
+	time.Sleep(time.Second)
+	if !m.sseEventsExist("alert_acknowledged") {
+		t.Error("did not receive expected alert_acknowledged SSE event")
+	}
+}
+
+// Test that the prompts are reloaded when the prompts file changes, and that
+// the browsers are told about it
+func TestPromptsReload(t *testing.T) {
+	promptsFilename, err := createTempPromptFile(t, []string{"short0", "short1"})
+	if err != nil {
+		t.Errorf("error create prompts file: %v", err)
+		return
+	}
+
+	m := newMocks(t, promptsFilename)
+	defer m.close()
+	m.wg.Add(1)
+	go func() {
+		m.controller.WatchPromptsFile(m.ctx, 50*time.Millisecond)
+		m.wg.Done()
+	}()
+
+	// there is no pending alert so only the prompt is set
+	if err := m.controller.SetPrompt("", "1"); err != internal.ErrNoPendingAlert {
+		t.Errorf("unexpected error setting prompt: %v", err)
+		return
+	}
+
+	if err := os.WriteFile(promptsFilename, []byte("prompts:\n- id: 1\n  short: changed\n- id: 2\n  short: Weapons\n"), 0644); err != nil {
+		t.Errorf("error writing prompts file: %v", err)
+		return
+	}
+
+	var changed *internal.SSEEvent
+	deadline := time.Now().Add(5 * time.Second)
+	for changed == nil && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		events := m.sseEvents()
+		for i, event := range events {
+			if event.EventType == "prompts_changed" {
+				changed = &events[i]
+			}
+		}
+	}
+	if changed == nil {
+		t.Error("did not receive expected prompts_changed SSE event")
+		return
+	}
+	var data struct {
+		Selected int           `json:"selected"`
+		Prompts  []shortPrompt `json:"prompts"`
+	}
+	if err := json.Unmarshal(changed.Data, &data); err != nil {
+		t.Errorf("error unmarshalling prompts_changed event: %v", err)
+		return
+	}
+	if data.Selected != 1 {
+		t.Errorf("expected selected prompt to still be 1 but got %d", data.Selected)
+	}
+	if len(data.Prompts) != 2 || data.Prompts[0].Prompt != "changed" {
+		t.Errorf("unexpected prompts in prompts_changed event: %v", data.Prompts)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/currentstate", nil)
+	w := httptest.NewRecorder()
+	m.controller.PromptsListHandler(w, req)
+	if !strings.Contains(w.Body.String(), `"Weapons"`) {
+		t.Errorf("expected reloaded prompts to be listed but got %s", w.Body.String())
+	}
+}
+
+// Test that the alert's details are filled in to the prompt before it is sent
+// to the LLM
+func TestPromptTemplate(t *testing.T) {
+	promptsFilename, err := createTempPromptFile(t, []string{"Describe|{{.Camera}} saw {{.Classes}} in the {{.TimeOfDay}} ({{.Timestamp.Format \"15:04\"}})"})
+	if err != nil {
+		t.Errorf("error create prompts file: %v", err)
+		return
+	}
+
+	m := newMocks(t, promptsFilename)
+	defer m.close()
+
+	timestamp := time.Date(2024, time.March, 4, 14, 5, 0, 0, time.UTC).Unix()
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(fmt.Sprintf(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":%d,"camera":"gate","classes":["person","dog"]}`, timestamp)))
+	m.waitForOllamaRequest()
+
+	expected := "gate saw person, dog in the afternoon (14:05)"
+	if prompt := m.ollamaRequest().Prompt; prompt != expected {
+		t.Errorf(`expected ollama prompt to be "%s" but got "%s"`, expected, prompt)
+	}
+}
+
+type cameraState struct {
+	Camera        string   `json:"camera"`
+	Cameras       []string `json:"cameras"`
+	AlertID       string   `json:"alert_id"`
+	ImageAnalysis string   `json:"image_analysis"`
+	EventsPaused  bool     `json:"events_paused"`
+}
+
+// Test that each camera has its own latest alert, pause state and prompt
+func TestMultipleCameras(t *testing.T) {
+	promptsFilename, err := createTempPromptFile(t, []string{"short0|descriptive0", "short1|descriptive1"})
+	if err != nil {
+		t.Errorf("error create prompts file: %v", err)
+		return
+	}
+
+	m := newMocks(t, promptsFilename)
+	defer m.close()
+
+	// the camera comes from the alert or from the topic
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1234,"camera":"gate"}`))
+	gate, abort := waitForCameraAnalysis(t, m.controller, "gate")
+	if abort {
+		return
+	}
+	msg := newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1235}`)
+	msg.topic = "alerts/yard"
+	m.controller.MQTTHandler(nil, msg)
+	// events from gate are paused, but that does not stop alerts from yard
+	yard, abort := waitForCameraAnalysis(t, m.controller, "yard")
+	if abort {
+		return
+	}
+	if gate.AlertID == yard.AlertID {
+		t.Errorf("expected gate and yard to have different alerts but both have %s", gate.AlertID)
+	}
+	if len(yard.Cameras) != 2 || yard.Cameras[0] != "gate" || yard.Cameras[1] != "yard" {
+		t.Errorf("expected cameras gate and yard but got %v", yard.Cameras)
+	}
+
+	// without a camera, the state of the latest camera is returned
+	latest, statusCode := getCameraState(t, m.controller, "")
+	if statusCode != http.StatusOK || latest.Camera != "yard" || latest.AlertID != yard.AlertID {
+		t.Errorf("expected state of camera yard but got %d %v", statusCode, latest)
+	}
+	if _, statusCode := getCameraState(t, m.controller, "unknown"); statusCode != http.StatusNotFound {
+		t.Errorf("expected status code %d for an unknown camera but got %d", http.StatusNotFound, statusCode)
+	}
+
+	// the gate alert is analyzed again with the new prompt
+	m.resetOllamaRequestReceivedChannel()
+	if err := m.controller.SetPrompt("gate", "1"); err != nil {
+		t.Errorf("error setting prompt of camera gate: %v", err)
+		return
+	}
+	m.waitForOllamaRequest()
+	if prompt := m.ollamaRequest().Prompt; prompt != "descriptive1" {
+		t.Errorf(`expected ollama prompt to be "descriptive1" but got "%s"`, prompt)
+	}
+	time.Sleep(time.Second)
+	if latest, _ := getCameraState(t, m.controller, ""); latest.Camera != "gate" || latest.AlertID != gate.AlertID {
+		t.Errorf("expected latest camera to be gate with alert %s but got %v", gate.AlertID, latest)
+	}
+
+	// resuming one camera leaves the other paused
+	m.controller.ResumeEvents("gate")
+	if state, _ := getCameraState(t, m.controller, "gate"); state.EventsPaused {
+		t.Error("expected events from gate to be resumed")
+	}
+	if state, _ := getCameraState(t, m.controller, "yard"); !state.EventsPaused {
+		t.Error("expected events from yard to still be paused")
+	}
+
+	// a prompt can be selected for a camera before its first alert
+	if abort := setPrompt(t, m.controller, `{"id":1,"camera":"porch"}`, true); abort {
+		return
+	}
+	m.resetOllamaRequestReceivedChannel()
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1236,"camera":"porch"}`))
+	m.waitForOllamaRequest()
+	if prompt := m.ollamaRequest().Prompt; prompt != "descriptive1" {
+		t.Errorf(`expected alert from porch to be analyzed with "descriptive1" but got "%s"`, prompt)
+	}
+}
+
+func getCameraState(t *testing.T, controller *internal.AlertsController, camera string) (cameraState, int) {
+	req := httptest.NewRequest(http.MethodGet, "/api/currentstate?camera="+camera, nil)
+	w := httptest.NewRecorder()
+	controller.CurrentStateHandler(w, req)
+	var state cameraState
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&state); err != nil {
+			t.Errorf("error decoding current state: %v", err)
+		}
+	}
+	return state, w.Code
+}
+
+// waits for the camera's latest alert to be analyzed
+// returns true if subsequent tests should be aborted
+func waitForCameraAnalysis(t *testing.T, controller *internal.AlertsController, camera string) (cameraState, bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		state, statusCode := getCameraState(t, controller, camera)
+		if statusCode == http.StatusOK && state.EventsPaused && state.ImageAnalysis != "" {
+			return state, false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("alert from camera %s was not analyzed", camera)
+	return cameraState{}, true
+}
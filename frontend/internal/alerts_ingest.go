@@ -0,0 +1,157 @@
+package internal
+
+// Alerts can also be submitted to /api/alerts/ingest so that cloud cameras
+// and scripts can raise alerts without connecting to the MQTT broker. The
+// request is authenticated with the shared token in an
+// "Authorization: Bearer <token>" header.
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxIngestBytes = 32 << 20
+
+// SetIngestToken enables /api/alerts/ingest - call this before the web
+// server is started
+func (controller *AlertsController) SetIngestToken(token string) {
+	controller.ingestToken = token
+}
+
+// IngestHandler accepts the same JSON as the alerts MQTT topic, or a
+// multipart form with the images as files. It responds with 202 and the ID
+// of the alert once the alert has been queued for analysis.
+func (controller *AlertsController) IngestHandler(w http.ResponseWriter, r *http.Request) {
+	if controller.ingestToken == "" {
+		http.Error(w, "alert ingestion is disabled because the ingest token is not set", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !controller.validIngestToken(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid or missing ingest token", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxIngestBytes)
+	msg, err := decodeIngestRequest(r)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("alert is larger than %d bytes", maxIngestBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().Unix()
+	}
+	if err := controller.validateAlert(msg); err != nil {
+		payload, _ := json.Marshal(&msg)
+		controller.rejectAlert(err, "http", "", payload)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	camera := controller.cameraFromAlert(msg, "")
+	log.Printf("received alert over HTTP from camera %s", camera)
+	id, err := controller.submitAlert(msg, camera)
+	if errors.Is(err, ErrLLMQueueFull) {
+		log.Print(err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		ID string `json:"id"`
+	}{
+		ID: id,
+	})
+}
+
+func (controller *AlertsController) validIngestToken(r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	return subtle.ConstantTimeCompare([]byte(token), []byte(controller.ingestToken)) == 1
+}
+
+func decodeIngestRequest(r *http.Request) (alertMQTT, error) {
+	var msg alertMQTT
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return msg, fmt.Errorf("error decoding alert: %w", err)
+		}
+		return msg, nil
+	}
+
+	if err := r.ParseMultipartForm(maxIngestBytes); err != nil {
+		return msg, fmt.Errorf("error parsing multipart form: %w", err)
+	}
+	msg.Camera = r.FormValue("camera")
+	if timestamp := r.FormValue("timestamp"); timestamp != "" {
+		t, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return msg, fmt.Errorf("invalid timestamp %s: %w", timestamp, err)
+		}
+		msg.Timestamp = t
+	}
+	// classes can be repeated or comma-separated
+	for _, value := range r.MultipartForm.Value["classes"] {
+		for _, class := range strings.Split(value, ",") {
+			if class = strings.TrimSpace(class); class != "" {
+				msg.Classes = append(msg.Classes, class)
+			}
+		}
+	}
+	var err error
+	if msg.AnnotatedImage, err = formImage(r, "annotated_image"); err != nil {
+		return msg, err
+	}
+	if msg.RawImage, err = formImage(r, "raw_image"); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+// returns the base64-encoded contents of the file in the field - an empty
+// string is returned if the form does not have the field
+func formImage(r *http.Request, field string) (string, error) {
+	f, _, err := r.FormFile(field)
+	if errors.Is(err, http.ErrMissingFile) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %w", field, err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %w", field, err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
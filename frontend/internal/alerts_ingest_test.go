@@ -0,0 +1,141 @@
+package internal_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kwkoo/threat-detection-frontend/internal"
+)
+
+const mockIngestToken = "s3cret"
+
+// Test that alerts submitted over HTTP are analyzed like alerts from MQTT
+func TestIngest(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+	m.controller.SetIngestToken(mockIngestToken)
+
+	tests := []struct {
+		name        string
+		token       string
+		contentType string
+		body        string
+		statusCode  int
+	}{
+		{"missing token", "", "application/json", `{"raw_image":"dummy"}`, http.StatusUnauthorized},
+		{"wrong token", "wrong", "application/json", `{"raw_image":"dummy"}`, http.StatusUnauthorized},
+		{"invalid json", mockIngestToken, "application/json", `{"raw_image":`, http.StatusBadRequest},
+		{"no images", mockIngestToken, "application/json", `{"camera":"gate"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if w := ingest(m.controller, test.token, test.contentType, test.body); w.Code != test.statusCode {
+			t.Errorf("%s: expected status %d but got %d", test.name, test.statusCode, w.Code)
+		}
+	}
+
+	w := ingest(m.controller, mockIngestToken, "application/json", `{"annotated_image":"dummyannotated","raw_image":"dummy","timestamp":1234,"camera":"gate"}`)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("expected status %d but got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+		return
+	}
+	var accepted struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&accepted); err != nil || accepted.ID == "" {
+		t.Errorf("expected response to contain the alert ID but got %v", err)
+		return
+	}
+	m.waitForOllamaRequest()
+	if images := m.ollamaRequest().Images; len(images) == 0 || images[0] != "dummy" {
+		t.Errorf("expected ollama to receive the raw image but got %v", images)
+	}
+	state, abort := waitForCameraAnalysis(t, m.controller, "gate")
+	if abort {
+		return
+	}
+	if state.AlertID != accepted.ID {
+		t.Errorf("expected latest alert of camera gate to be %s but got %s", accepted.ID, state.AlertID)
+	}
+}
+
+// Test that the images can be uploaded as files
+func TestIngestMultipart(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+	m.controller.SetIngestToken(mockIngestToken)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("camera", "lobby")
+	form.WriteField("timestamp", "1234")
+	form.WriteField("classes", "person, knife")
+	part, err := form.CreateFormFile("raw_image", "raw.jpg")
+	if err != nil {
+		t.Errorf("could not create form file: %v", err)
+		return
+	}
+	part.Write([]byte("rawbytes"))
+	form.Close()
+
+	w := ingest(m.controller, mockIngestToken, form.FormDataContentType(), body.String())
+	if w.Code != http.StatusAccepted {
+		t.Errorf("expected status %d but got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+		return
+	}
+	m.waitForOllamaRequest()
+	expected := base64.StdEncoding.EncodeToString([]byte("rawbytes"))
+	if images := m.ollamaRequest().Images; len(images) == 0 || images[0] != expected {
+		t.Errorf("expected ollama to receive %s but got %v", expected, images)
+	}
+	if _, abort := waitForCameraAnalysis(t, m.controller, "lobby"); abort {
+		return
+	}
+}
+
+// Test that 503 is returned once the LLM queue is full of alerts with a higher
+// priority
+func TestIngestLLMQueueFull(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+	m.controller.SetIngestToken(mockIngestToken)
+	m.controller.SetQueuePolicy(internal.QueuePolicy{Size: 3, HighRiskCameras: []string{"gate"}})
+	m.cancel() // stop the LLM channel processor so that the queue fills up
+
+	// alerts with the same priority make room by dropping the oldest alert
+	for i := 0; i < 6; i++ {
+		if w := ingest(m.controller, mockIngestToken, "application/json", `{"raw_image":"dummy","camera":"gate"}`); w.Code != http.StatusAccepted {
+			t.Errorf("expected status %d but got %d", http.StatusAccepted, w.Code)
+			return
+		}
+	}
+	if w := ingest(m.controller, mockIngestToken, "application/json", `{"raw_image":"dummy","camera":"lobby"}`); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d once the LLM queue is full of alerts with a higher priority but got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+// Test that the endpoint is disabled if the token is not set
+func TestIngestDisabled(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+
+	if w := ingest(m.controller, "", "application/json", `{"raw_image":"dummy"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d but got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func ingest(controller *internal.AlertsController, token, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/alerts/ingest", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	controller.IngestHandler(w, req)
+	return w
+}
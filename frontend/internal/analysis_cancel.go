@@ -0,0 +1,84 @@
+package internal
+
+// An analysis can take up to llmRequestTimeoutSeconds. An operator who picks
+// a new prompt should not have to wait for the analysis with the old prompt
+// to finish, so the analysis in progress is cancelled - operators can also
+// cancel an analysis that they are not interested in.
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Reasons that an analysis is cancelled
+const (
+	cancelPromptChanged = "prompt_changed" // the alert is analyzed again with the new prompt
+	cancelRequested     = "requested"      // cancelled with /api/cancel
+)
+
+// CancelHandler cancels the analysis in progress - set the camera query
+// parameter to only cancel the analysis of that camera
+func (controller *AlertsController) CancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := struct {
+		Cancelled []string `json:"cancelled"`
+	}{
+		Cancelled: controller.CancelAnalysis(r.URL.Query().Get("camera")),
+	}
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// CancelAnalysis cancels the analysis of every camera if camera is empty -
+// the cameras whose analysis was cancelled are returned
+func (controller *AlertsController) CancelAnalysis(camera string) []string {
+	states := controller.cameraStates()
+	if camera != "" {
+		states = nil
+		if state, ok := controller.findCamera(camera); ok {
+			states = append(states, state)
+		}
+	}
+	cancelled := []string{}
+	for _, state := range states {
+		if state.cancelAnalysis(0, cancelRequested) {
+			log.Printf("cancelling analysis of camera %s", state.name)
+			cancelled = append(cancelled, state.name)
+		}
+	}
+	return cancelled
+}
+
+// called by processAlert instead of saving the analysis - the camera is
+// paused according to its pause policy as if the analysis had finished
+// without a verdict, unless it is about to analyze the alert again
+func (controller *AlertsController) finishCancelledAnalysis(ctx context.Context, state *cameraState, policy PausePolicy, event alertEvent, reason string) {
+	log.Printf("analysis of alert %s from camera %s was cancelled (%s)", event.id, state.name, reason)
+	cancelled := struct {
+		Camera  string `json:"camera"`
+		AlertID string `json:"alert_id"`
+		Reason  string `json:"reason"`
+	}{
+		Camera:  state.name,
+		AlertID: event.id,
+		Reason:  reason,
+	}
+	marshaled, err := json.Marshal(&cancelled)
+	if err != nil {
+		log.Printf("error converting cancelled analysis to json: %v", err)
+		return
+	}
+	controller.sendToSSECh(SSEEvent{
+		EventType: "llm_request_cancelled",
+		Data:      marshaled,
+		Camera:    state.name,
+	})
+	if reason != cancelPromptChanged {
+		controller.applyPausePolicy(ctx, state, policy, nil)
+	}
+}
@@ -0,0 +1,115 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test that changing the prompt cancels the analysis with the old prompt
+// instead of waiting for it to finish
+func TestCancelOnPromptChange(t *testing.T) {
+	promptsFilename, err := createTempPromptFile(t, []string{"slow|slowprompt", "fast|fastprompt"})
+	if err != nil {
+		t.Errorf("error create prompts file: %v", err)
+		return
+	}
+	m := newMocks(t, promptsFilename)
+	defer m.close()
+	m.holdOllamaPrompt("slowprompt")
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1,"camera":"gate"}`))
+	if abort := waitForHeldRequest(t, m); abort {
+		return
+	}
+	if abort := setPrompt(t, m.controller, `{"id":1,"camera":"gate"}`, false); abort {
+		return
+	}
+	if !waitForSSEEvent(m, "llm_request_cancelled", `{"camera":"gate","alert_id":`) || !m.sseEventExists("llm_request_cancelled", `"reason":"prompt_changed"`) {
+		t.Error("expected llm_request_cancelled event because the prompt was changed")
+		return
+	}
+	state, abort := waitForCameraAnalysis(t, m.controller, "gate")
+	if abort {
+		return
+	}
+	if prompt := m.ollamaRequest().Prompt; state.ImageAnalysis != "dummy ollama response" || prompt != "fastprompt" {
+		t.Errorf(`expected alert to be analyzed with "fastprompt" but got "%s" with "%s"`, state.ImageAnalysis, prompt)
+	}
+}
+
+// Test that /api/cancel cancels the analysis and leaves the camera paused
+// without saving the analysis
+func TestCancelHandler(t *testing.T) {
+	promptsFilename, err := createTempPromptFile(t, []string{"slow|slowprompt"})
+	if err != nil {
+		t.Errorf("error create prompts file: %v", err)
+		return
+	}
+	m := newMocks(t, promptsFilename)
+	defer m.close()
+	m.holdOllamaPrompt("slowprompt")
+
+	w := httptest.NewRecorder()
+	m.controller.CancelHandler(w, httptest.NewRequest(http.MethodGet, "/api/cancel", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d but got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1,"camera":"gate"}`))
+	if abort := waitForHeldRequest(t, m); abort {
+		return
+	}
+	for _, expected := range [][]string{{"gate"}, {}} {
+		cancelled, abort := cancelAnalysis(t, m, "gate")
+		if abort {
+			return
+		}
+		if len(cancelled) != len(expected) || (len(expected) > 0 && cancelled[0] != expected[0]) {
+			t.Errorf("expected analysis of %v to be cancelled but got %v", expected, cancelled)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !waitForSSEEvent(m, "llm_request_cancelled", `"reason":"requested"`) {
+		t.Error("expected llm_request_cancelled event because the analysis was cancelled")
+		return
+	}
+	if !waitForSSEEvent(m, "pause_events", "") {
+		t.Error("expected pause_events event after the analysis was cancelled")
+	}
+	state, _ := getCameraState(t, m.controller, "gate")
+	if !state.EventsPaused {
+		t.Error("expected camera gate to stay paused after the analysis was cancelled")
+	}
+	record, err := m.history.Get(state.AlertID)
+	if err != nil || record.ImageAnalysis != "" {
+		t.Errorf("expected cancelled analysis not to be saved to the history but got %+v (%v)", record, err)
+	}
+}
+
+// returns true if subsequent tests should be aborted
+func waitForHeldRequest(t *testing.T, m *mocks) bool {
+	select {
+	case <-m.ollama.held:
+		return false
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for the ollama request to be held")
+		return true
+	}
+}
+
+// returns true if subsequent tests should be aborted
+func cancelAnalysis(t *testing.T, m *mocks, camera string) ([]string, bool) {
+	w := httptest.NewRecorder()
+	m.controller.CancelHandler(w, httptest.NewRequest(http.MethodPost, "/api/cancel?camera="+camera, nil))
+	var resp struct {
+		Cancelled []string `json:"cancelled"`
+	}
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&resp) != nil {
+		t.Errorf("error cancelling analysis - got status %d: %s", w.Code, w.Body.String())
+		return nil, true
+	}
+	return resp.Cancelled, false
+}
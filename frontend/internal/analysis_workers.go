@@ -0,0 +1,154 @@
+package internal
+
+// Alerts are analyzed by a pool of workers so that an alert from one camera
+// does not have to wait for the analysis of another camera's alert. A camera
+// is assigned to a worker while it has alerts waiting to be analyzed, so the
+// alerts from a camera are still analyzed one at a time in the order that
+// they leave the alert queue. The number of workers limits the number of
+// analyses that run at the same time, which should match the capacity of the
+// LLM backends.
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// alerts that are waiting for a worker - the rest wait in the alert queue so
+// that alerts with a higher priority can still go ahead of them
+const workerQueueSize = 1
+
+// SetLLMWorkers sets the number of alerts that can be analyzed at the same
+// time - this must be called before the LLMChannelProcessor is started
+func (controller *AlertsController) SetLLMWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	controller.llmWorkers.Store(int32(workers))
+}
+
+type analysisWorker struct {
+	id          int
+	queue       chan alertEvent
+	analyzing   AtomicString // camera of the alert that is being processed - empty if the worker is idle
+	outstanding int          // alerts assigned to the worker that have not been processed - protected by the pool's mutex
+}
+
+type workerPool struct {
+	workers []*analysisWorker
+
+	mux      sync.Mutex
+	assigned map[string]*cameraAssignment
+}
+
+type cameraAssignment struct {
+	worker      *analysisWorker
+	outstanding int // alerts from the camera that have not been processed
+}
+
+// the status of a worker in /api/alertsstatus
+type workerStatus struct {
+	Worker    int    `json:"worker"`
+	Queue     int    `json:"queue"`               // alerts waiting to be processed
+	Analyzing string `json:"analyzing,omitempty"` // camera of the alert that is being processed
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	pool := workerPool{
+		workers:  make([]*analysisWorker, size),
+		assigned: make(map[string]*cameraAssignment),
+	}
+	for i := range pool.workers {
+		pool.workers[i] = &analysisWorker{
+			id:    i,
+			queue: make(chan alertEvent, workerQueueSize),
+		}
+	}
+	log.Printf("analyzing alerts with %d workers", size)
+	return &pool
+}
+
+// pick returns the worker that the camera's next alert should be sent to, or
+// nil if that worker's queue is full - a camera that still has alerts waiting
+// is kept on the same worker, otherwise the worker with the fewest alerts
+// waiting is picked
+func (pool *workerPool) pick(camera string) *analysisWorker {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	if assignment, ok := pool.assigned[camera]; ok {
+		if len(assignment.worker.queue) < cap(assignment.worker.queue) {
+			return assignment.worker
+		}
+		return nil
+	}
+	var picked *analysisWorker
+	for _, worker := range pool.workers {
+		if len(worker.queue) < cap(worker.queue) && (picked == nil || worker.outstanding < picked.outstanding) {
+			picked = worker
+		}
+	}
+	return picked
+}
+
+// assign is called before the camera's alert is sent to the worker returned
+// by pick
+func (pool *workerPool) assign(camera string, worker *analysisWorker) {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	assignment, ok := pool.assigned[camera]
+	if !ok {
+		assignment = &cameraAssignment{worker: worker}
+		pool.assigned[camera] = assignment
+	}
+	assignment.outstanding++
+	assignment.worker.outstanding++
+}
+
+// release is called when a worker has processed one of the camera's alerts
+func (pool *workerPool) release(camera string) {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	assignment, ok := pool.assigned[camera]
+	if !ok {
+		return
+	}
+	assignment.outstanding--
+	assignment.worker.outstanding--
+	if assignment.outstanding <= 0 {
+		delete(pool.assigned, camera)
+	}
+}
+
+// returns an empty slice if the pool has not been started
+func (pool *workerPool) status() []workerStatus {
+	status := []workerStatus{}
+	if pool == nil {
+		return status
+	}
+	for _, worker := range pool.workers {
+		status = append(status, workerStatus{
+			Worker:    worker.id,
+			Queue:     len(worker.queue),
+			Analyzing: worker.analyzing.Load(),
+		})
+	}
+	return status
+}
+
+func (controller *AlertsController) runWorker(ctx context.Context, pool *workerPool, worker *analysisWorker) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-worker.queue:
+			controller.queue.wake() // the worker has room for another alert
+			worker.analyzing.Store(event.camera)
+			controller.processAlert(ctx, event)
+			worker.analyzing.Store("")
+			pool.release(event.camera)
+		}
+	}
+}
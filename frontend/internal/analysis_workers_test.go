@@ -0,0 +1,118 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type workerStatus struct {
+	Worker    int    `json:"worker"`
+	Queue     int    `json:"queue"`
+	Analyzing string `json:"analyzing"`
+}
+
+// Test that an alert from one camera is analyzed while the analysis of
+// another camera's alert is still running, and that the alerts from a camera
+// are kept on the same worker
+func TestLLMWorkers(t *testing.T) {
+	promptsFilename, err := createTempPromptFile(t, []string{"slow|slowprompt", "fast|fastprompt"})
+	if err != nil {
+		t.Errorf("error create prompts file: %v", err)
+		return
+	}
+	m := newMocks(t, promptsFilename)
+	defer m.close()
+
+	// restart the processor with more than one worker
+	m.cancel()
+	m.wg.Wait()
+	m.controller.SetLLMWorkers(2)
+	m.launchGoroutines()
+
+	m.holdOllamaPrompt("slowprompt")
+	if abort := setPrompt(t, m.controller, `{"id":1,"camera":"lobby"}`, true); abort {
+		return
+	}
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1,"camera":"gate"}`))
+	if abort := waitForHeldRequest(t, m); abort {
+		return
+	}
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":2,"camera":"gate"}`))
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":3,"camera":"lobby"}`))
+	if _, abort := waitForCameraAnalysis(t, m.controller, "lobby"); abort {
+		return
+	}
+
+	workers, abort := getWorkerStatus(t, m)
+	if abort {
+		return
+	}
+	if len(workers) != 2 {
+		t.Errorf("expected 2 workers but got %+v", workers)
+		return
+	}
+	var gate *workerStatus
+	for i := range workers {
+		if workers[i].Analyzing == "gate" {
+			gate = &workers[i]
+		}
+	}
+	if gate == nil || gate.Queue != 1 {
+		t.Errorf("expected one worker to be analyzing camera gate with the second alert from gate waiting but got %+v", workers)
+	}
+
+	m.controller.CancelAnalysis("gate")
+}
+
+// returns true if subsequent tests should be aborted
+func getWorkerStatus(t *testing.T, m *mocks) ([]workerStatus, bool) {
+	w := httptest.NewRecorder()
+	m.controller.StatusHandler(w, httptest.NewRequest(http.MethodGet, "/api/alertsstatus", nil))
+	var status struct {
+		LLMWorkers []workerStatus `json:"llm_workers"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Errorf("error decoding status: %v", err)
+		return nil, true
+	}
+	return status.LLMWorkers, false
+}
+
+// Test that alerts are analyzed one at a time by default
+func TestLLMWorkersDefault(t *testing.T) {
+	promptsFilename, err := createTempPromptFile(t, []string{"slow|slowprompt", "fast|fastprompt"})
+	if err != nil {
+		t.Errorf("error create prompts file: %v", err)
+		return
+	}
+	m := newMocks(t, promptsFilename)
+	defer m.close()
+	m.holdOllamaPrompt("slowprompt")
+	if abort := setPrompt(t, m.controller, `{"id":1,"camera":"lobby"}`, true); abort {
+		return
+	}
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1,"camera":"gate"}`))
+	if abort := waitForHeldRequest(t, m); abort {
+		return
+	}
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":2,"camera":"lobby"}`))
+	time.Sleep(500 * time.Millisecond)
+	workers, abort := getWorkerStatus(t, m)
+	if abort {
+		return
+	}
+	if len(workers) != 1 || workers[0].Analyzing != "gate" || workers[0].Queue != 1 {
+		t.Errorf("expected the alert from lobby to wait for the analysis of gate but got %+v", workers)
+	}
+
+	// the alert from lobby is analyzed once the analysis of gate is cancelled
+	m.controller.CancelAnalysis("gate")
+	if _, abort := waitForCameraAnalysis(t, m.controller, "lobby"); abort {
+		return
+	}
+}
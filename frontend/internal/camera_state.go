@@ -0,0 +1,313 @@
+package internal
+
+// Alerts can come from more than one camera. Each camera has its own latest
+// alert, pause state and prompt selection, so an alert from one camera does
+// not replace an alert from another camera that an operator is looking at.
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/prompts"
+)
+
+// Alerts that do not say which camera they came from are assigned to this
+// camera
+const defaultCamera = "default"
+
+type cameraState struct {
+	name string
+
+	mux             sync.RWMutex
+	latestAlert     alertEvent
+	eventsPaused    bool
+	promptID        prompts.ID // empty if the camera uses the prompt that is selected for every camera
+	imageAnalysis   string
+	threatAnalysis  string
+	threatVerdict   string             // JSON encoded verdict
+	pending         []alertEvent       // alerts that arrived while the camera was paused, oldest first
+	pendingDropped  uint64             // alerts that were discarded because the pending queue was full
+	resumeAt        time.Time          // zero if the camera is not counting down to being resumed
+	cancelCountdown context.CancelFunc // stops the countdown
+	cancelRunning   context.CancelFunc // cancels the analysis in progress - nil if the camera is not being analyzed
+	cancelReason    string
+	analyses        uint64 // number of the analysis in progress
+
+	// the following are only used by the analysis worker that the camera is
+	// assigned to
+	oldPromptID     prompts.ID
+	currentAlertID  string
+	previousVerdict string // verdict of the alert before currentAlertID
+	currentVerdict  string
+}
+
+// a snapshot of the camera's state for /api/currentstate
+type cameraView struct {
+	latestAlert    alertEvent
+	eventsPaused   bool
+	imageAnalysis  string
+	threatAnalysis string
+	threatVerdict  string
+	pending        []pendingAlert
+	pendingDropped uint64
+	resumeAt       time.Time
+}
+
+// a pending alert in /api/currentstate - the images are only available once
+// the alert has been analyzed
+type pendingAlert struct {
+	AlertID   string   `json:"alert_id"`
+	Timestamp int64    `json:"timestamp"`
+	Classes   []string `json:"classes,omitempty"`
+}
+
+func (state *cameraState) view() cameraView {
+	state.mux.RLock()
+	defer state.mux.RUnlock()
+	pending := make([]pendingAlert, 0, len(state.pending))
+	for _, alert := range state.pending {
+		pending = append(pending, pendingAlert{
+			AlertID:   alert.id,
+			Timestamp: alert.timestamp,
+			Classes:   alert.classes,
+		})
+	}
+	return cameraView{
+		latestAlert:    state.latestAlert,
+		eventsPaused:   state.eventsPaused,
+		imageAnalysis:  state.imageAnalysis,
+		threatAnalysis: state.threatAnalysis,
+		threatVerdict:  state.threatVerdict,
+		pending:        pending,
+		pendingDropped: state.pendingDropped,
+		resumeAt:       state.resumeAt,
+	}
+}
+
+func (state *cameraState) getLatestAlert() alertEvent {
+	state.mux.RLock()
+	defer state.mux.RUnlock()
+	return state.latestAlert
+}
+
+// startAlert makes the alert the camera's latest alert and clears the
+// analysis of the previous alert
+func (state *cameraState) startAlert(alert alertEvent) {
+	state.mux.Lock()
+	state.latestAlert = alert
+	state.imageAnalysis = ""
+	state.threatAnalysis = ""
+	state.threatVerdict = ""
+	state.mux.Unlock()
+}
+
+func (state *cameraState) paused() bool {
+	state.mux.RLock()
+	defer state.mux.RUnlock()
+	return state.eventsPaused
+}
+
+func (state *cameraState) setPaused(paused bool) {
+	state.mux.Lock()
+	state.eventsPaused = paused
+	state.mux.Unlock()
+}
+
+// queuePending adds the alert to the end of the pending queue - the oldest
+// alert is discarded if the queue already has limit alerts
+func (state *cameraState) queuePending(alert alertEvent, limit int) {
+	state.mux.Lock()
+	state.pending = append(state.pending, alert)
+	if len(state.pending) > limit {
+		state.pending[0] = alertEvent{} // release the images
+		state.pending = state.pending[1:]
+		state.pendingDropped++
+	}
+	state.mux.Unlock()
+}
+
+// nextPending removes the oldest alert from the pending queue - false is
+// returned if the queue is empty
+func (state *cameraState) nextPending() (alertEvent, bool) {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+	if len(state.pending) == 0 {
+		return alertEvent{}, false
+	}
+	alert := state.pending[0]
+	state.pending[0] = alertEvent{}
+	state.pending = state.pending[1:]
+	return alert, true
+}
+
+// requeuePending puts an alert that was taken with nextPending back at the
+// front of the queue
+func (state *cameraState) requeuePending(alert alertEvent) {
+	state.mux.Lock()
+	state.pending = append([]alertEvent{alert}, state.pending...)
+	state.mux.Unlock()
+}
+
+func (state *cameraState) pendingCount() (int, uint64) {
+	state.mux.RLock()
+	defer state.mux.RUnlock()
+	return len(state.pending), state.pendingDropped
+}
+
+// startCountdown replaces any countdown that the camera already has
+func (state *cameraState) startCountdown(cancel context.CancelFunc, resumeAt time.Time) {
+	state.mux.Lock()
+	if state.cancelCountdown != nil {
+		state.cancelCountdown()
+	}
+	state.cancelCountdown = cancel
+	state.resumeAt = resumeAt
+	state.mux.Unlock()
+}
+
+// stopCountdown returns false if the camera was not counting down
+func (state *cameraState) stopCountdown() bool {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+	if state.cancelCountdown == nil {
+		return false
+	}
+	state.cancelCountdown()
+	state.cancelCountdown = nil
+	state.resumeAt = time.Time{}
+	return true
+}
+
+// finishCountdown is called when the countdown with ctx runs out - false is
+// returned if the countdown was stopped in the meantime
+func (state *cameraState) finishCountdown(ctx context.Context) bool {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	state.cancelCountdown()
+	state.cancelCountdown = nil
+	state.resumeAt = time.Time{}
+	return true
+}
+
+// startAnalysis is called when the camera's latest alert starts being
+// analyzed
+func (state *cameraState) startAnalysis(cancel context.CancelFunc) {
+	state.mux.Lock()
+	state.cancelRunning = cancel
+	state.cancelReason = ""
+	state.analyses++
+	state.mux.Unlock()
+}
+
+// runningAnalysis returns the number of the analysis in progress - 0 if the
+// camera is not being analyzed
+func (state *cameraState) runningAnalysis() uint64 {
+	state.mux.RLock()
+	defer state.mux.RUnlock()
+	if state.cancelRunning == nil {
+		return 0
+	}
+	return state.analyses
+}
+
+// finishAnalysis returns the reason that the analysis was cancelled - empty if
+// it was not cancelled
+func (state *cameraState) finishAnalysis() string {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+	state.cancelRunning = nil
+	return state.cancelReason
+}
+
+// cancelAnalysis cancels the analysis with the number from runningAnalysis,
+// or the analysis in progress if number is 0 - false is returned if that
+// analysis is not in progress
+func (state *cameraState) cancelAnalysis(number uint64, reason string) bool {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+	if state.cancelRunning == nil || state.cancelReason != "" || (number != 0 && number != state.analyses) {
+		return false
+	}
+	state.cancelReason = reason
+	state.cancelRunning()
+	return true
+}
+
+func (state *cameraState) selectedPrompt() prompts.ID {
+	state.mux.RLock()
+	defer state.mux.RUnlock()
+	return state.promptID
+}
+
+func (state *cameraState) setSelectedPrompt(id prompts.ID) {
+	state.mux.Lock()
+	state.promptID = id
+	state.mux.Unlock()
+}
+
+func (state *cameraState) setImageAnalysis(analysis string) {
+	state.mux.Lock()
+	state.imageAnalysis = analysis
+	state.mux.Unlock()
+}
+
+func (state *cameraState) setThreatAnalysis(analysis string) {
+	state.mux.Lock()
+	state.threatAnalysis = analysis
+	state.mux.Unlock()
+}
+
+func (state *cameraState) setThreatVerdict(verdict string) {
+	state.mux.Lock()
+	state.threatVerdict = verdict
+	state.mux.Unlock()
+}
+
+// returns the state of the camera, creating it if this is the first time the
+// camera has been seen
+func (controller *AlertsController) camera(name string) *cameraState {
+	if name == "" {
+		name = defaultCamera
+	}
+	controller.camerasMux.RLock()
+	state, ok := controller.cameras[name]
+	controller.camerasMux.RUnlock()
+	if ok {
+		return state
+	}
+	controller.camerasMux.Lock()
+	defer controller.camerasMux.Unlock()
+	if state, ok := controller.cameras[name]; ok {
+		return state
+	}
+	state = &cameraState{name: name}
+	controller.cameras[name] = state
+	return state
+}
+
+// returns false if the camera has not been seen
+func (controller *AlertsController) findCamera(name string) (*cameraState, bool) {
+	controller.camerasMux.RLock()
+	defer controller.camerasMux.RUnlock()
+	state, ok := controller.cameras[name]
+	return state, ok
+}
+
+// returns every camera that has been seen in alphabetical order
+func (controller *AlertsController) cameraStates() []*cameraState {
+	controller.camerasMux.RLock()
+	states := make([]*cameraState, 0, len(controller.cameras))
+	for _, state := range controller.cameras {
+		states = append(states, state)
+	}
+	controller.camerasMux.RUnlock()
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].name < states[j].name
+	})
+	return states
+}
@@ -0,0 +1,38 @@
+package internal
+
+// The DeadLetterPublisher republishes rejected alerts to an MQTT topic so
+// that problems with the image-acquirer can be debugged without turning on
+// debug logging in the frontend.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+type DeadLetterPublisher struct {
+	client MQTTPublisher
+	topic  string
+}
+
+func NewDeadLetterPublisher(client MQTTPublisher, topic string) (*DeadLetterPublisher, error) {
+	if topic == "" {
+		return nil, errors.New("dead-letter topic is not set")
+	}
+	return &DeadLetterPublisher{
+		client: client,
+		topic:  topic,
+	}, nil
+}
+
+// Publish does not wait for the broker - errors are logged when the publish
+// completes
+func (p *DeadLetterPublisher) Publish(letter DeadLetter) error {
+	payload, err := json.Marshal(&letter)
+	if err != nil {
+		return fmt.Errorf("error converting rejected alert to json: %w", err)
+	}
+	token := p.client.Publish(p.topic, 1, false, payload)
+	go logPublishErrors(token, "rejected alert", p.topic)
+	return nil
+}
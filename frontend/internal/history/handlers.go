@@ -0,0 +1,126 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPageSize = 20
+const maxPageSize = 100
+
+// ListHandler returns a page of alert summaries. Supported query parameters
+// are cursor, since, until (unix seconds or RFC3339), threat_level (comma
+// separated) and limit.
+func (s *Store) ListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	summaries, nextCursor, err := s.List(q)
+	if err != nil {
+		log.Printf("error listing alert history: %v", err)
+		http.Error(w, "error listing alert history", http.StatusInternalServerError)
+		return
+	}
+	resp := struct {
+		Alerts     []Summary `json:"alerts"`
+		NextCursor string    `json:"next_cursor,omitempty"`
+	}{
+		Alerts:     summaries,
+		NextCursor: nextCursor,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// RecordHandler returns the full record including both images. It expects
+// the URL path to be stripped down to the alert ID, or to
+// {id}/images/{raw|annotated} to retrieve one of the images.
+func (s *Store) RecordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	id := parts[0]
+	if id == "" {
+		http.Error(w, "alert ID missing", http.StatusNotFound)
+		return
+	}
+	if len(parts) == 3 && parts[1] == "images" {
+		s.serveImage(w, r, id, parts[2])
+		return
+	}
+	if len(parts) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	record, err := s.Get(id)
+	if err == ErrNotFound {
+		http.Error(w, fmt.Sprintf("alert %s not found", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error getting alert %s: %v", id, err)
+		http.Error(w, fmt.Sprintf("error getting alert %s", id), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
+
+func parseQuery(r *http.Request) (Query, error) {
+	values := r.URL.Query()
+	q := Query{
+		Cursor: values.Get("cursor"),
+		Limit:  defaultPageSize,
+	}
+	var err error
+	if q.Since, err = parseTime(values.Get("since")); err != nil {
+		return Query{}, fmt.Errorf("invalid since parameter: %w", err)
+	}
+	if q.Until, err = parseTime(values.Get("until")); err != nil {
+		return Query{}, fmt.Errorf("invalid until parameter: %w", err)
+	}
+	if levels := values.Get("threat_level"); levels != "" {
+		for _, level := range strings.Split(levels, ",") {
+			if level = strings.TrimSpace(level); level != "" {
+				q.ThreatLevels = append(q.ThreatLevels, level)
+			}
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 1 {
+			return Query{}, fmt.Errorf("invalid limit parameter %s", limit)
+		}
+		if q.Limit > maxPageSize {
+			q.Limit = maxPageSize
+		}
+	}
+	return q, nil
+}
+
+// accepts unix timestamps in seconds or RFC3339 strings
+func parseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
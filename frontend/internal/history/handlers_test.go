@@ -0,0 +1,225 @@
+package history_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/history"
+)
+
+type listResponse struct {
+	Alerts     []history.Summary `json:"alerts"`
+	NextCursor string            `json:"next_cursor"`
+}
+
+// Test that all records can be retrieved a page at a time
+func TestListPagination(t *testing.T) {
+	store := newPopulatedStore(t, 5)
+	if store == nil {
+		return
+	}
+
+	var ids []string
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		resp, abort := listAlerts(t, store, "?limit=2&cursor="+cursor)
+		if abort {
+			return
+		}
+		for _, alert := range resp.Alerts {
+			ids = append(ids, alert.ID)
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+	if len(ids) != 5 {
+		t.Errorf("expected to retrieve 5 alerts but got %d", len(ids))
+		return
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] >= ids[i-1] {
+			t.Errorf("expected alerts to be listed newest first but got %v", ids)
+			return
+		}
+	}
+}
+
+func TestListFilters(t *testing.T) {
+	store := newPopulatedStore(t, 6)
+	if store == nil {
+		return
+	}
+
+	resp, abort := listAlerts(t, store, "?threat_level=high")
+	if abort {
+		return
+	}
+	if len(resp.Alerts) != 2 {
+		t.Errorf("expected 2 high threat alerts but got %d", len(resp.Alerts))
+	}
+	for _, alert := range resp.Alerts {
+		if alert.ThreatLevel != "high" {
+			t.Errorf(`expected threat level "high" but got "%s"`, alert.ThreatLevel)
+		}
+	}
+
+	resp, abort = listAlerts(t, store, "?since=1001&until=1003")
+	if abort {
+		return
+	}
+	if len(resp.Alerts) != 3 {
+		t.Errorf("expected 3 alerts between 1001 and 1003 but got %d", len(resp.Alerts))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/alerts?since=yesterday", nil)
+	w := httptest.NewRecorder()
+	store.ListHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d for invalid since parameter but got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestRecordHandler(t *testing.T) {
+	store, err := history.NewStore("", 0, 0)
+	if err != nil {
+		t.Errorf("could not create store: %v", err)
+		return
+	}
+	r := history.Record{
+		ID:             history.NewID(),
+		ReceivedAt:     time.Now().Unix(),
+		AnnotatedImage: "annotated",
+		RawImage:       "raw",
+		ImageAnalysis:  "image analysis",
+		ThreatAnalysis: "threat analysis",
+	}
+	store.Put(r)
+
+	req := httptest.NewRequest(http.MethodGet, "/"+r.ID, nil)
+	w := httptest.NewRecorder()
+	store.RecordHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d but got %d", http.StatusOK, w.Code)
+		return
+	}
+	var got history.Record
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Errorf("could not decode record: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(got, r) {
+		t.Errorf("expected record %v but got %v", r, got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/does-not-exist", nil)
+	w = httptest.NewRecorder()
+	store.RecordHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status code %d but got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestImageHandler(t *testing.T) {
+	store, err := history.NewStore("", 0, 0)
+	if err != nil {
+		t.Errorf("could not create store: %v", err)
+		return
+	}
+	png := []byte("\x89PNG\r\n\x1a\n dummy png")
+	r := history.Record{
+		ID:             history.NewID(),
+		Timestamp:      1000,
+		AnnotatedImage: base64.StdEncoding.EncodeToString(png),
+	}
+	store.Put(r)
+
+	req := httptest.NewRequest(http.MethodGet, "/"+r.ID+"/images/annotated", nil)
+	w := httptest.NewRecorder()
+	store.RecordHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d but got %d", http.StatusOK, w.Code)
+		return
+	}
+	if !bytes.Equal(w.Body.Bytes(), png) {
+		t.Errorf("expected image %q but got %q", png, w.Body.Bytes())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "image/png" {
+		t.Errorf(`expected content type "image/png" but got "%s"`, contentType)
+	}
+	if w.Header().Get("Cache-Control") == "" {
+		t.Error("expected Cache-Control header to be set")
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Error("expected ETag header to be set")
+		return
+	}
+
+	// the browser's cached copy is still valid
+	req = httptest.NewRequest(http.MethodGet, "/"+r.ID+"/images/annotated", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	store.RecordHandler(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected status code %d with matching ETag but got %d", http.StatusNotModified, w.Code)
+	}
+
+	// the record does not have a raw image
+	for _, path := range []string{"/" + r.ID + "/images/raw", "/" + r.ID + "/images/other", "/does-not-exist/images/raw"} {
+		req = httptest.NewRequest(http.MethodGet, path, nil)
+		w = httptest.NewRecorder()
+		store.RecordHandler(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d for %s but got %d", http.StatusNotFound, path, w.Code)
+		}
+	}
+}
+
+// creates records with timestamps starting at 1000 and cycles through the
+// low, medium and high threat levels
+func newPopulatedStore(t *testing.T, count int) *history.Store {
+	store, err := history.NewStore("", 0, 0)
+	if err != nil {
+		t.Errorf("could not create store: %v", err)
+		return nil
+	}
+	levels := []string{"low", "medium", "high"}
+	for i := 0; i < count; i++ {
+		r := history.Record{
+			ID:          history.NewID(),
+			Timestamp:   int64(1000 + i),
+			ThreatLevel: levels[i%len(levels)],
+		}
+		if err := store.Put(r); err != nil {
+			t.Errorf("could not put record: %v", err)
+			return nil
+		}
+	}
+	return store
+}
+
+// returns true if subsequent tests should be aborted
+func listAlerts(t *testing.T, store *history.Store, query string) (listResponse, bool) {
+	req := httptest.NewRequest(http.MethodGet, "/api/alerts"+query, nil)
+	w := httptest.NewRecorder()
+	store.ListHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status code %d listing alerts with query %s: %s", w.Code, query, w.Body.String())
+		return listResponse{}, true
+	}
+	var resp listResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Errorf("could not decode list response: %v", err)
+		return listResponse{}, true
+	}
+	t.Logf("%s returned %d alerts", query, len(resp.Alerts))
+	return resp, false
+}
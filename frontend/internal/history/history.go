@@ -0,0 +1,461 @@
+package history
+
+// The Store keeps a history of every alert that went through the
+// AlertsController. Each record is written as a JSON file to a directory so
+// that the history survives a pod restart. If no directory is configured,
+// records are only kept in memory. Old records are pruned according to the
+// retention policy whenever a record is added - the age of a record is based
+// on the time it was received, because the timestamp of an alert comes from
+// the camera's clock.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/prompts"
+	"github.com/kwkoo/threat-detection-frontend/internal/verdict"
+)
+
+const recordSuffix = ".json"
+
+// temporary files are only left behind if the frontend crashed while writing
+// a record
+const tempSuffix = ".tmp"
+
+var ErrNotFound = errors.New("alert not found")
+
+var lastID int64
+
+type Record struct {
+	ID             string             `json:"id"`
+	Timestamp      int64              `json:"timestamp"`
+	ReceivedAt     int64              `json:"received_at,omitempty"` // set by Put if it is not set
+	Camera         string             `json:"camera,omitempty"`
+	Prompt         prompts.PromptItem `json:"prompt"`
+	AnnotatedImage string             `json:"annotated_image"`
+	RawImage       string             `json:"raw_image"`
+	ImageAnalysis  string             `json:"image_analysis"`
+	ThreatAnalysis string             `json:"threat_analysis"`
+	ThreatLevel    string             `json:"threat_level"`
+	Verdict        *verdict.Verdict   `json:"verdict,omitempty"`
+	Stages         map[string]string  `json:"stages,omitempty"` // outputs of every pipeline stage
+	AcknowledgedAt int64              `json:"acknowledged_at,omitempty"`
+}
+
+// Summary is a Record without the images
+type Summary struct {
+	ID             string             `json:"id"`
+	Timestamp      int64              `json:"timestamp"`
+	ReceivedAt     int64              `json:"received_at,omitempty"`
+	Camera         string             `json:"camera,omitempty"`
+	Prompt         prompts.PromptItem `json:"prompt"`
+	ImageAnalysis  string             `json:"image_analysis"`
+	ThreatAnalysis string             `json:"threat_analysis"`
+	ThreatLevel    string             `json:"threat_level"`
+	Verdict        *verdict.Verdict   `json:"verdict,omitempty"`
+	Stages         map[string]string  `json:"stages,omitempty"`
+	AcknowledgedAt int64              `json:"acknowledged_at,omitempty"`
+}
+
+func (r Record) Summary() Summary {
+	return Summary{
+		ID:             r.ID,
+		Timestamp:      r.Timestamp,
+		ReceivedAt:     r.ReceivedAt,
+		Camera:         r.Camera,
+		Prompt:         r.Prompt,
+		ImageAnalysis:  r.ImageAnalysis,
+		ThreatAnalysis: r.ThreatAnalysis,
+		ThreatLevel:    r.ThreatLevel,
+		Verdict:        r.Verdict,
+		Stages:         r.Stages,
+		AcknowledgedAt: r.AcknowledgedAt,
+	}
+}
+
+// Query selects records to be listed - zero values are ignored
+type Query struct {
+	Cursor       string   // only return records older than the record with this ID
+	Since        int64    // only return records with timestamps >= Since
+	Until        int64    // only return records with timestamps <= Until
+	ThreatLevels []string // only return records with one of these threat levels
+	Limit        int      // maximum number of records to return
+}
+
+type indexEntry struct {
+	id          string
+	timestamp   int64
+	receivedAt  int64 // records are pruned by age on this
+	size        int64
+	threatLevel string
+}
+
+// the fields of a Record that are needed for the index - decoding only these
+// skips the images when the index is loaded
+type indexFields struct {
+	Timestamp   int64  `json:"timestamp"`
+	ReceivedAt  int64  `json:"received_at"`
+	ThreatLevel string `json:"threat_level"`
+}
+
+type Store struct {
+	dir        string
+	maxAge     time.Duration
+	maxBytes   int64
+	mux        sync.RWMutex
+	index      []indexEntry // sorted by ID in ascending order
+	totalBytes int64
+	memory     map[string][]byte // encoded records - only used if dir is not set
+}
+
+// NewID returns a unique ID for a new alert. IDs are derived from the
+// current time and sort in the order they were created.
+func NewID() string {
+	now := time.Now().UnixNano()
+	for {
+		last := atomic.LoadInt64(&lastID)
+		id := now
+		if id <= last {
+			id = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastID, last, id) {
+			return fmt.Sprintf("%019d", id)
+		}
+	}
+}
+
+// Records will be kept in memory if dir is empty. Records older than maxAge
+// are pruned, and the oldest records are pruned when the total size of all
+// records exceeds maxBytes. Set maxAge or maxBytes to 0 to disable that part
+// of the retention policy.
+func NewStore(dir string, maxAge time.Duration, maxBytes int64) (*Store, error) {
+	s := Store{
+		dir:      dir,
+		maxAge:   maxAge,
+		maxBytes: maxBytes,
+	}
+	if dir == "" {
+		log.Print("no history directory provided - alert history will only be kept in memory")
+		s.memory = make(map[string][]byte)
+		return &s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating history directory %s: %w", dir, err)
+	}
+	if err := s.loadIndex(); err != nil {
+		return nil, err
+	}
+	s.prune(time.Now())
+	log.Printf("loaded %d records from history directory %s", len(s.index), dir)
+	return &s, nil
+}
+
+// Put adds the record to the store, replacing any existing record with the
+// same ID. ReceivedAt is set to the current time if it is not set.
+func (s *Store) Put(r Record) error {
+	if r.ID == "" {
+		return errors.New("record does not have an ID")
+	}
+	if r.ReceivedAt == 0 {
+		r.ReceivedAt = time.Now().Unix()
+	}
+	b, err := json.Marshal(&r)
+	if err != nil {
+		return fmt.Errorf("error encoding record %s: %w", r.ID, err)
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := s.write(r.ID, b); err != nil {
+		return err
+	}
+	s.addToIndex(indexEntry{
+		id:          r.ID,
+		timestamp:   r.Timestamp,
+		receivedAt:  r.ReceivedAt,
+		size:        int64(len(b)),
+		threatLevel: r.ThreatLevel,
+	})
+	s.prune(time.Now())
+	return nil
+}
+
+// Update applies fn to the record with the given ID and saves the result
+func (s *Store) Update(id string, fn func(*Record)) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	i, ok := s.find(id)
+	if !ok {
+		return ErrNotFound
+	}
+	receivedAt := s.index[i].receivedAt
+	r, err := s.read(id)
+	if err != nil {
+		return err
+	}
+	fn(r)
+	r.ID = id
+	if r.ReceivedAt == 0 {
+		r.ReceivedAt = receivedAt
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("error encoding record %s: %w", id, err)
+	}
+	if err := s.write(id, b); err != nil {
+		return err
+	}
+	s.addToIndex(indexEntry{
+		id:          id,
+		timestamp:   r.Timestamp,
+		receivedAt:  r.ReceivedAt,
+		size:        int64(len(b)),
+		threatLevel: r.ThreatLevel,
+	})
+	s.prune(time.Now())
+	return nil
+}
+
+func (s *Store) Get(id string) (*Record, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if _, ok := s.find(id); !ok {
+		return nil, ErrNotFound
+	}
+	return s.read(id)
+}
+
+// List returns the summaries of records matching the query, newest first.
+// The returned cursor should be passed in the next query to retrieve the next
+// page - it will be empty if there are no more records.
+func (s *Store) List(q Query) ([]Summary, string, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	start := len(s.index)
+	if q.Cursor != "" {
+		start, _ = s.find(q.Cursor)
+	}
+	summaries := []Summary{}
+	for i := start - 1; i >= 0; i-- {
+		entry := s.index[i]
+		if !q.matches(entry) {
+			continue
+		}
+		if q.Limit > 0 && len(summaries) >= q.Limit {
+			return summaries, summaries[len(summaries)-1].ID, nil
+		}
+		r, err := s.read(entry.id)
+		if err != nil {
+			return nil, "", err
+		}
+		summaries = append(summaries, r.Summary())
+	}
+	return summaries, "", nil
+}
+
+func (q Query) matches(entry indexEntry) bool {
+	if q.Since != 0 && entry.timestamp < q.Since {
+		return false
+	}
+	if q.Until != 0 && entry.timestamp > q.Until {
+		return false
+	}
+	if len(q.ThreatLevels) == 0 {
+		return true
+	}
+	for _, level := range q.ThreatLevels {
+		if strings.EqualFold(level, entry.threatLevel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of records in the store
+func (s *Store) Len() int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return len(s.index)
+}
+
+// Size returns the total size of all records in bytes
+func (s *Store) Size() int64 {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.totalBytes
+}
+
+// returns the position of the record in the index
+func (s *Store) find(id string) (int, bool) {
+	i := sort.Search(len(s.index), func(i int) bool { return s.index[i].id >= id })
+	return i, i < len(s.index) && s.index[i].id == id
+}
+
+func (s *Store) addToIndex(entry indexEntry) {
+	i, ok := s.find(entry.id)
+	if ok {
+		s.totalBytes += entry.size - s.index[i].size
+		s.index[i] = entry
+		return
+	}
+	s.index = append(s.index, indexEntry{})
+	copy(s.index[i+1:], s.index[i:])
+	s.index[i] = entry
+	s.totalBytes += entry.size
+}
+
+// removes expired records and the oldest records if the store is over its
+// size limit - the newest record is never removed because of the size limit
+// - the caller must hold the write lock
+func (s *Store) prune(now time.Time) {
+	var keep []indexEntry
+	var cutoff int64
+	if s.maxAge > 0 {
+		cutoff = now.Add(-s.maxAge).Unix()
+	}
+	totalBytes := s.totalBytes
+	for i, entry := range s.index {
+		expired := s.maxAge > 0 && entry.receivedAt < cutoff
+		overLimit := s.maxBytes > 0 && totalBytes > s.maxBytes && i < len(s.index)-1
+		if !expired && !overLimit {
+			keep = append(keep, entry)
+			continue
+		}
+		if err := s.remove(entry.id); err != nil {
+			log.Printf("error removing record %s from history: %v", entry.id, err)
+			keep = append(keep, entry)
+			continue
+		}
+		totalBytes -= entry.size
+	}
+	s.index = keep
+	s.totalBytes = totalBytes
+}
+
+func (s *Store) loadIndex() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("error reading history directory %s: %w", s.dir, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasSuffix(name, tempSuffix) {
+			if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+				log.Printf("error removing temporary file %s from history directory: %v", name, err)
+			}
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, recordSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(name, recordSuffix)
+		fields, err := s.readIndexFields(id)
+		if err != nil {
+			log.Printf("skipping history record: %v", err)
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			log.Printf("skipping history record %s: %v", id, err)
+			continue
+		}
+		// records that were saved before received_at was added were last
+		// written shortly after they were received
+		receivedAt := fields.ReceivedAt
+		if receivedAt == 0 {
+			receivedAt = info.ModTime().Unix()
+		}
+		s.addToIndex(indexEntry{
+			id:          id,
+			timestamp:   fields.Timestamp,
+			receivedAt:  receivedAt,
+			size:        info.Size(),
+			threatLevel: fields.ThreatLevel,
+		})
+	}
+	return nil
+}
+
+func (s *Store) readIndexFields(id string) (*indexFields, error) {
+	f, err := os.Open(s.filename(id))
+	if err != nil {
+		return nil, fmt.Errorf("error reading record %s: %w", id, err)
+	}
+	defer f.Close()
+	var fields indexFields
+	if err := json.NewDecoder(f).Decode(&fields); err != nil {
+		return nil, fmt.Errorf("error decoding record %s: %w", id, err)
+	}
+	return &fields, nil
+}
+
+func (s *Store) read(id string) (*Record, error) {
+	var b []byte
+	if s.memory != nil {
+		b = s.memory[id]
+	} else {
+		var err error
+		b, err = os.ReadFile(s.filename(id))
+		if err != nil {
+			return nil, fmt.Errorf("error reading record %s: %w", id, err)
+		}
+	}
+	var r Record
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("error decoding record %s: %w", id, err)
+	}
+	return &r, nil
+}
+
+// writes to a temporary file first so that a crash never leaves a partially
+// written record behind
+func (s *Store) write(id string, b []byte) error {
+	if s.memory != nil {
+		s.memory[id] = b
+		return nil
+	}
+	f, err := os.CreateTemp(s.dir, id+".*"+tempSuffix)
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for record %s: %w", id, err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("error writing record %s: %w", id, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error closing record %s: %w", id, err)
+	}
+	if err := os.Rename(f.Name(), s.filename(id)); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error renaming record %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *Store) remove(id string) error {
+	if s.memory != nil {
+		delete(s.memory, id)
+		return nil
+	}
+	if err := os.Remove(s.filename(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) filename(id string) string {
+	return filepath.Join(s.dir, id+recordSuffix)
+}
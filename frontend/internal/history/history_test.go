@@ -0,0 +1,151 @@
+package history_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/history"
+	"github.com/kwkoo/threat-detection-frontend/internal/prompts"
+)
+
+// Test that records survive the store being reopened
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	store, err := history.NewStore(dir, 0, 0)
+	if err != nil {
+		t.Errorf("could not create store: %v", err)
+		return
+	}
+
+	r := history.Record{
+		ID:             history.NewID(),
+		Timestamp:      time.Now().Unix(),
+		ReceivedAt:     time.Now().Unix(),
+		Prompt:         prompts.PromptItem{ID: "1", Short: "short", Descriptive: "descriptive"},
+		AnnotatedImage: "annotated",
+		RawImage:       "raw",
+		ImageAnalysis:  "a person holding a knife",
+		ThreatAnalysis: "high",
+	}
+	if err := store.Put(r); err != nil {
+		t.Errorf("could not put record: %v", err)
+		return
+	}
+	// left behind by a crash while a record was written
+	tmp := filepath.Join(dir, r.ID+".123.tmp")
+	if err := os.WriteFile(tmp, []byte(`{"id":`), 0644); err != nil {
+		t.Errorf("could not create temporary file: %v", err)
+		return
+	}
+
+	reopened, err := history.NewStore(dir, 0, 0)
+	if err != nil {
+		t.Errorf("could not reopen store: %v", err)
+		return
+	}
+	if reopened.Len() != 1 {
+		t.Errorf("expected 1 record after reopening store but got %d", reopened.Len())
+		return
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("expected temporary file to be removed when the store is reopened but got %v", err)
+	}
+	got, err := reopened.Get(r.ID)
+	if err != nil {
+		t.Errorf("could not get record %s: %v", r.ID, err)
+		return
+	}
+	if !reflect.DeepEqual(*got, r) {
+		t.Errorf("expected record %v but got %v", r, *got)
+	}
+
+	if _, err := reopened.Get("does-not-exist"); err != history.ErrNotFound {
+		t.Errorf("expected ErrNotFound but got %v", err)
+	}
+}
+
+// Test that putting a record with an existing ID replaces it
+func TestReplace(t *testing.T) {
+	store, err := history.NewStore("", 0, 0)
+	if err != nil {
+		t.Errorf("could not create store: %v", err)
+		return
+	}
+	id := history.NewID()
+	store.Put(history.Record{ID: id, ThreatAnalysis: "low"})
+	store.Put(history.Record{ID: id, ThreatAnalysis: "high"})
+	if store.Len() != 1 {
+		t.Errorf("expected 1 record but got %d", store.Len())
+	}
+	r, err := store.Get(id)
+	if err != nil {
+		t.Errorf("could not get record: %v", err)
+		return
+	}
+	if r.ThreatAnalysis != "high" {
+		t.Errorf(`expected threat analysis to be "high" but got "%s"`, r.ThreatAnalysis)
+	}
+}
+
+func TestRetentionByAge(t *testing.T) {
+	store, err := history.NewStore(t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Errorf("could not create store: %v", err)
+		return
+	}
+	old := history.Record{ID: history.NewID(), Timestamp: time.Now().Add(-2 * time.Hour).Unix(), ReceivedAt: time.Now().Add(-2 * time.Hour).Unix()}
+	recent := history.Record{ID: history.NewID(), Timestamp: time.Now().Unix()}
+	// the age is based on the time the alert was received, not on the
+	// camera's clock
+	noTimestamp := history.Record{ID: history.NewID()}
+	skewed := history.Record{ID: history.NewID(), Timestamp: time.Now().Add(-2 * time.Hour).Unix()}
+	for _, r := range []history.Record{old, recent, noTimestamp, skewed} {
+		store.Put(r)
+	}
+
+	if _, err := store.Get(old.ID); err != history.ErrNotFound {
+		t.Errorf("expected old record to be pruned but got %v", err)
+	}
+	for _, r := range []history.Record{recent, noTimestamp, skewed} {
+		if _, err := store.Get(r.ID); err != nil {
+			t.Errorf("expected record with timestamp %d that was just received to be kept but got %v", r.Timestamp, err)
+		}
+	}
+}
+
+func TestRetentionBySize(t *testing.T) {
+	store, err := history.NewStore(t.TempDir(), 0, 2500)
+	if err != nil {
+		t.Errorf("could not create store: %v", err)
+		return
+	}
+	var ids []string
+	for i := 0; i < 5; i++ {
+		r := history.Record{
+			ID:        history.NewID(),
+			Timestamp: time.Now().Unix(),
+			RawImage:  strings.Repeat("x", 1000),
+		}
+		if err := store.Put(r); err != nil {
+			t.Errorf("could not put record: %v", err)
+			return
+		}
+		ids = append(ids, r.ID)
+	}
+
+	if store.Size() > 2500 {
+		t.Errorf("expected store size to be under 2500 bytes but got %d", store.Size())
+	}
+	if store.Len() != 2 {
+		t.Errorf("expected 2 records to be kept but got %d", store.Len())
+	}
+	for _, id := range ids[:3] {
+		if _, err := store.Get(id); err != history.ErrNotFound {
+			t.Errorf("expected record %s to be pruned but got %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package history
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const ImageRaw = "raw"
+const ImageAnnotated = "annotated"
+
+// images never change once an alert has been received
+const imageCacheControl = "private, max-age=86400, immutable"
+
+// ImageInfo describes an alert image without including its contents
+type ImageInfo struct {
+	AlertID     string `json:"alert_id"`
+	URL         string `json:"url,omitempty"` // empty if the alert does not have this image
+	ContentType string `json:"content_type,omitempty"`
+	Size        int    `json:"size,omitempty"`
+}
+
+// ImageURL returns the path that the image is served from by RecordHandler
+func ImageURL(id, kind string) string {
+	return fmt.Sprintf("/api/alerts/%s/images/%s", id, kind)
+}
+
+// Image returns the base64-encoded image of the given kind
+func (r Record) Image(kind string) (string, bool) {
+	switch kind {
+	case ImageRaw:
+		return r.RawImage, true
+	case ImageAnnotated:
+		return r.AnnotatedImage, true
+	default:
+		return "", false
+	}
+}
+
+func (r Record) ImageInfo(kind string) ImageInfo {
+	info := ImageInfo{AlertID: r.ID}
+	encoded, ok := r.Image(kind)
+	if !ok || encoded == "" {
+		return info
+	}
+	info.URL = ImageURL(r.ID, kind)
+	if b, err := decodeImage(encoded); err == nil {
+		info.ContentType = http.DetectContentType(b)
+		info.Size = len(b)
+	}
+	return info
+}
+
+// serves /api/alerts/{id}/images/{raw|annotated} - the path should already
+// be stripped down to the alert ID and image kind
+func (s *Store) serveImage(w http.ResponseWriter, r *http.Request, id, kind string) {
+	record, err := s.Get(id)
+	if err == ErrNotFound {
+		http.Error(w, fmt.Sprintf("alert %s not found", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error getting alert %s: %v", id, err)
+		http.Error(w, fmt.Sprintf("error getting alert %s", id), http.StatusInternalServerError)
+		return
+	}
+	encoded, ok := record.Image(kind)
+	if !ok {
+		http.Error(w, fmt.Sprintf("invalid image type %s", kind), http.StatusNotFound)
+		return
+	}
+	if encoded == "" {
+		http.Error(w, fmt.Sprintf("alert %s does not have a %s image", id, kind), http.StatusNotFound)
+		return
+	}
+	b, err := decodeImage(encoded)
+	if err != nil {
+		log.Printf("error decoding %s image of alert %s: %v", kind, id, err)
+		http.Error(w, fmt.Sprintf("%s image of alert %s could not be decoded", kind, id), http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(b)
+	w.Header().Set("Content-Type", http.DetectContentType(b))
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", imageCacheControl)
+
+	// ServeContent takes care of If-None-Match and range requests
+	http.ServeContent(w, r, "", time.Unix(record.Timestamp, 0), bytes.NewReader(b))
+}
+
+func decodeImage(encoded string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(encoded)
+}
@@ -0,0 +1,76 @@
+package llm
+
+// Backends that the AlertsController uses to analyze images and to classify
+// the resulting image analysis. Every backend streams the model's response
+// token by token so that it can be relayed to the browsers as it arrives.
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// TokenFunc is invoked for every token streamed back by the model
+type TokenFunc func(token string)
+
+// Options override the backend's settings for a single request - zero
+// values are ignored
+type Options struct {
+	System      string // system prompt
+	Model       string // used instead of the model in the backend's Config
+	Temperature *float64
+	TopP        *float64
+	TopK        *int // ollama only
+	MaxTokens   *int // maximum number of tokens to generate
+	Seed        *int
+}
+
+type VisionAnalyzer interface {
+	// AnalyzeImage sends the prompt and the base64-encoded image to the model
+	// and returns the complete response
+	AnalyzeImage(ctx context.Context, prompt, image string, opts Options, onToken TokenFunc) (string, error)
+}
+
+type TextClassifier interface {
+	// Classify sends the prompt followed by the text to the model and
+	// returns the complete response
+	Classify(ctx context.Context, prompt, text string, opts Options, onToken TokenFunc) (string, error)
+}
+
+type Backend interface {
+	VisionAnalyzer
+	TextClassifier
+	Name() string
+}
+
+type Config struct {
+	Type      string    // ollama, openai or mock
+	URL       string    // full URL of the generate endpoint for ollama, base URL for openai
+	Model     string    // model name sent in each request
+	KeepAlive string    // ollama only - the duration that the model is kept in memory
+	Recorder  io.Writer // raw model responses are written here one line per Write if this is set - must be safe for concurrent use
+}
+
+func NewBackend(config Config) (Backend, error) {
+	switch config.Type {
+	case "ollama":
+		return newOllamaBackend(config), nil
+	case "openai":
+		return newOpenAIBackend(config), nil
+	case "mock":
+		return newMockBackend(config), nil
+	default:
+		return nil, fmt.Errorf(`unknown LLM backend type "%s" - valid types are ollama, openai and mock`, config.Type)
+	}
+}
+
+func (opts Options) model(defaultModel string) string {
+	if opts.Model != "" {
+		return opts.Model
+	}
+	return defaultModel
+}
+
+func classifierPrompt(prompt, text string) string {
+	return prompt + "\n\n" + text
+}
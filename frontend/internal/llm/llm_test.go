@@ -0,0 +1,142 @@
+package llm_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/llm"
+)
+
+func TestOllamaBackend(t *testing.T) {
+	var req struct {
+		Model   string   `json:"model"`
+		System  string   `json:"system"`
+		Prompt  string   `json:"prompt"`
+		Images  []string `json:"images"`
+		Options struct {
+			Temperature *float64 `json:"temperature"`
+			NumPredict  *int     `json:"num_predict"`
+		} `json:"options"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		req.Images = nil
+		req.System = ""
+		req.Options.Temperature = nil
+		req.Options.NumPredict = nil
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("could not decode ollama request: %v", err)
+		}
+		w.Write([]byte("{\"response\":\"a person\"}\n{\"response\":\" with a knife\"}\n{\"response\":\"\",\"done\":true}\n"))
+	}))
+	defer server.Close()
+
+	backend, err := llm.NewBackend(llm.Config{Type: "ollama", URL: server.URL, Model: "llava"})
+	if err != nil {
+		t.Errorf("could not create backend: %v", err)
+		return
+	}
+
+	var tokens []string
+	response, err := backend.AnalyzeImage(context.Background(), "describe", "image", llm.Options{}, func(token string) { tokens = append(tokens, token) })
+	if err != nil {
+		t.Errorf("unexpected error analyzing image: %v", err)
+		return
+	}
+	if response != "a person with a knife" {
+		t.Errorf(`expected response "a person with a knife" but got "%s"`, response)
+	}
+	if len(tokens) != 3 {
+		t.Errorf("expected 3 tokens but got %d", len(tokens))
+	}
+	if req.Model != "llava" || req.Prompt != "describe" || len(req.Images) != 1 || req.Images[0] != "image" {
+		t.Errorf("ollama received an unexpected request: %v", req)
+	}
+	if req.Options.Temperature != nil {
+		t.Errorf("expected sampling options to be omitted but got temperature %v", *req.Options.Temperature)
+	}
+
+	temperature := 0.2
+	maxTokens := 100
+	opts := llm.Options{System: "system prompt", Model: "llava:13b", Temperature: &temperature, MaxTokens: &maxTokens}
+	if _, err := backend.Classify(context.Background(), "classify", "text", opts, func(string) {}); err != nil {
+		t.Errorf("unexpected error classifying text: %v", err)
+		return
+	}
+	if req.Prompt != "classify\n\ntext" || len(req.Images) != 0 {
+		t.Errorf("ollama received an unexpected classify request: %v", req)
+	}
+	if req.Model != "llava:13b" || req.System != "system prompt" {
+		t.Errorf("expected the model and system prompt to be overridden but got %v", req)
+	}
+	if req.Options.Temperature == nil || *req.Options.Temperature != temperature || req.Options.NumPredict == nil || *req.Options.NumPredict != maxTokens {
+		t.Errorf("expected the sampling options to be sent but got %v", req.Options)
+	}
+}
+
+func TestOpenAIBackend(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.Write([]byte("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"High\"}}]}\n\n"))
+		w.Write([]byte("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\" threat\"},\"finish_reason\":\"stop\"}]}\n\n"))
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer server.Close()
+
+	backend, err := llm.NewBackend(llm.Config{Type: "openai", URL: server.URL, Model: "/mnt/models"})
+	if err != nil {
+		t.Errorf("could not create backend: %v", err)
+		return
+	}
+
+	response, err := backend.Classify(context.Background(), "classify", "text", llm.Options{System: "system prompt"}, func(string) {})
+	if err != nil {
+		t.Errorf("unexpected error classifying text: %v", err)
+		return
+	}
+	if response != "High threat" {
+		t.Errorf(`expected response "High threat" but got "%s"`, response)
+	}
+	if !strings.Contains(body, `{"role":"system","content":"system prompt"}`) {
+		t.Errorf("expected a system message but request body was %s", body)
+	}
+
+	if _, err := backend.AnalyzeImage(context.Background(), "describe", "aW1hZ2U=", llm.Options{}, func(string) {}); err != nil {
+		t.Errorf("unexpected error analyzing image: %v", err)
+		return
+	}
+	if !strings.Contains(body, "data:image/jpeg;base64,aW1hZ2U=") {
+		t.Errorf("expected image to be sent as a data URL but request body was %s", body)
+	}
+}
+
+func TestMockBackend(t *testing.T) {
+	backend, err := llm.NewBackend(llm.Config{Type: "mock"})
+	if err != nil {
+		t.Errorf("could not create backend: %v", err)
+		return
+	}
+	var streamed strings.Builder
+	response, err := backend.Classify(context.Background(), "classify", "text", llm.Options{}, func(token string) { streamed.WriteString(token) })
+	if err != nil {
+		t.Errorf("unexpected error classifying text: %v", err)
+		return
+	}
+	if response == "" || response != streamed.String() {
+		t.Errorf(`expected streamed tokens "%s" to match response "%s"`, streamed.String(), response)
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	if _, err := llm.NewBackend(llm.Config{Type: "dummy"}); err == nil {
+		t.Error("expected an error for an unknown backend type")
+	}
+}
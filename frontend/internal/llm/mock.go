@@ -0,0 +1,51 @@
+package llm
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+const mockTokenInterval = 50 * time.Millisecond
+
+const mockImageAnalysis = "The image shows a person standing in the frame. This is a mock response - no model was called."
+const mockClassification = "Low threat (mock response)"
+
+// Streams a canned response word by word - useful for running the demo
+// without a GPU
+type mockBackend struct {
+	config Config
+}
+
+func newMockBackend(config Config) *mockBackend {
+	return &mockBackend{config: config}
+}
+
+func (b *mockBackend) Name() string {
+	return "mock"
+}
+
+func (b *mockBackend) AnalyzeImage(ctx context.Context, prompt, image string, opts Options, onToken TokenFunc) (string, error) {
+	return b.stream(ctx, mockImageAnalysis, onToken)
+}
+
+func (b *mockBackend) Classify(ctx context.Context, prompt, text string, opts Options, onToken TokenFunc) (string, error) {
+	return b.stream(ctx, mockClassification, onToken)
+}
+
+func (b *mockBackend) stream(ctx context.Context, response string, onToken TokenFunc) (string, error) {
+	var streamed strings.Builder
+	for i, word := range strings.Fields(response) {
+		if i > 0 {
+			word = " " + word
+		}
+		select {
+		case <-ctx.Done():
+			return streamed.String(), ctx.Err()
+		case <-time.After(mockTokenInterval):
+		}
+		streamed.WriteString(word)
+		onToken(word)
+	}
+	return streamed.String(), nil
+}
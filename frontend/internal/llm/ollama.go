@@ -0,0 +1,130 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+type ollamaBackend struct {
+	config Config
+}
+
+func newOllamaBackend(config Config) *ollamaBackend {
+	return &ollamaBackend{config: config}
+}
+
+func (b *ollamaBackend) Name() string {
+	return "ollama"
+}
+
+func (b *ollamaBackend) AnalyzeImage(ctx context.Context, prompt, image string, opts Options, onToken TokenFunc) (string, error) {
+	var images []string
+	if image != "" {
+		images = []string{image}
+	}
+	return b.generate(ctx, prompt, images, opts, onToken)
+}
+
+func (b *ollamaBackend) Classify(ctx context.Context, prompt, text string, opts Options, onToken TokenFunc) (string, error) {
+	return b.generate(ctx, classifierPrompt(prompt, text), nil, opts, onToken)
+}
+
+// ollama's names for the sampling parameters
+type ollamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty"`
+	NumPredict  *int     `json:"num_predict,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+}
+
+func (b *ollamaBackend) generate(ctx context.Context, prompt string, images []string, opts Options, onToken TokenFunc) (string, error) {
+	ollamaReq := struct {
+		Model     string         `json:"model"`
+		KeepAlive string         `json:"keep_alive"`
+		Stream    bool           `json:"stream"`
+		System    string         `json:"system,omitempty"`
+		Prompt    string         `json:"prompt"`
+		Images    []string       `json:"images,omitempty"`
+		Options   *ollamaOptions `json:"options,omitempty"`
+	}{
+		Model:     opts.model(b.config.Model),
+		KeepAlive: b.config.KeepAlive,
+		Stream:    true,
+		System:    opts.System,
+		Prompt:    prompt,
+		Images:    images,
+	}
+	if opts.Temperature != nil || opts.TopP != nil || opts.TopK != nil || opts.MaxTokens != nil || opts.Seed != nil {
+		ollamaReq.Options = &ollamaOptions{
+			Temperature: opts.Temperature,
+			TopP:        opts.TopP,
+			TopK:        opts.TopK,
+			NumPredict:  opts.MaxTokens,
+			Seed:        opts.Seed,
+		}
+	}
+	payload, err := json.Marshal(ollamaReq)
+	if err != nil {
+		return "", fmt.Errorf("error trying to marshal JSON for ollama request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("error creating request to %s: %w", b.config.URL, err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error making request to %s: %w", b.config.URL, err)
+	}
+	defer res.Body.Close()
+	log.Printf("ollama response status code %d", res.StatusCode)
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d from %s", res.StatusCode, b.config.URL)
+	}
+
+	var llmResponse bytes.Buffer
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		text := scanner.Text()
+		if b.config.Recorder != nil {
+			// a single write so that lines from concurrent analyses are
+			// not mixed up
+			b.config.Recorder.Write([]byte(text + "\n"))
+		}
+		token, err := decodeOllamaResponse(text)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		llmResponse.WriteString(token)
+		onToken(token)
+	}
+	if err := scanner.Err(); err != nil {
+		return llmResponse.String(), fmt.Errorf("error reading response from %s: %w", b.config.URL, err)
+	}
+	return llmResponse.String(), nil
+}
+
+// extracts response field from JSON
+func decodeOllamaResponse(j string) (string, error) {
+	if j == "" {
+		return "", errors.New("unexpected response from ollama - did not contain JSON")
+	}
+
+	// parse res.Body as JSON - grab response field
+	ollamaResponse := struct {
+		Response string `json:"response"`
+	}{}
+	if err := json.Unmarshal([]byte(j), &ollamaResponse); err != nil {
+		return "", fmt.Errorf("error trying to decode ollama response: %v", err)
+	}
+	return ollamaResponse.Response, nil
+}
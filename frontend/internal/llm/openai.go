@@ -0,0 +1,117 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Works with any server that implements the OpenAI chat completions API,
+// such as vLLM
+type openAIBackend struct {
+	config Config
+	client *openai.Client
+}
+
+func newOpenAIBackend(config Config) *openAIBackend {
+	clientConfig := openai.DefaultConfig("dummy")
+	clientConfig.BaseURL = config.URL
+	return &openAIBackend{
+		config: config,
+		client: openai.NewClientWithConfig(clientConfig),
+	}
+}
+
+func (b *openAIBackend) Name() string {
+	return "openai"
+}
+
+func (b *openAIBackend) AnalyzeImage(ctx context.Context, prompt, image string, opts Options, onToken TokenFunc) (string, error) {
+	message := openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleUser,
+		MultiContent: []openai.ChatMessagePart{
+			{
+				Type: openai.ChatMessagePartTypeText,
+				Text: prompt,
+			},
+		},
+	}
+	if image != "" {
+		message.MultiContent = append(message.MultiContent, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{
+				URL: imageDataURL(image),
+			},
+		})
+	}
+	return b.chat(ctx, message, opts, onToken)
+}
+
+func (b *openAIBackend) Classify(ctx context.Context, prompt, text string, opts Options, onToken TokenFunc) (string, error) {
+	return b.chat(ctx, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: classifierPrompt(prompt, text),
+	}, opts, onToken)
+}
+
+func (b *openAIBackend) chat(ctx context.Context, message openai.ChatCompletionMessage, opts Options, onToken TokenFunc) (string, error) {
+	req := openai.ChatCompletionRequest{
+		Model:       opts.model(b.config.Model),
+		Temperature: 0,
+		N:           1,
+		Messages:    []openai.ChatCompletionMessage{message},
+		Seed:        opts.Seed,
+	}
+	if opts.System != "" {
+		req.Messages = append([]openai.ChatCompletionMessage{{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: opts.System,
+		}}, req.Messages...)
+	}
+	if opts.Temperature != nil {
+		req.Temperature = float32(*opts.Temperature)
+	}
+	if opts.TopP != nil {
+		req.TopP = float32(*opts.TopP)
+	}
+	if opts.MaxTokens != nil {
+		req.MaxTokens = *opts.MaxTokens
+	}
+
+	stream, err := b.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("error creating openai chat completion stream: %w", err)
+	}
+	defer stream.Close()
+
+	var llmResponse strings.Builder
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return llmResponse.String(), nil
+		}
+		if err != nil {
+			return llmResponse.String(), fmt.Errorf("error receiving openai stream response: %w", err)
+		}
+		if b.config.Recorder != nil {
+			json.NewEncoder(b.config.Recorder).Encode(resp)
+		}
+		for _, choice := range resp.Choices {
+			llmResponse.WriteString(choice.Delta.Content)
+			onToken(choice.Delta.Content)
+		}
+	}
+}
+
+// the image-acquirer sends JPEG images
+func imageDataURL(image string) string {
+	if strings.HasPrefix(image, "data:") {
+		return image
+	}
+	return "data:image/jpeg;base64," + image
+}
@@ -12,6 +12,8 @@ import (
 	"time"
 
 	"github.com/kwkoo/threat-detection-frontend/internal"
+	"github.com/kwkoo/threat-detection-frontend/internal/history"
+	"github.com/kwkoo/threat-detection-frontend/internal/pipeline"
 )
 
 type mockOllamaReq struct {
@@ -30,17 +32,22 @@ type mocks struct {
 	wg         sync.WaitGroup     // for goroutines
 	ctx        context.Context    // for goroutines
 	cancel     context.CancelFunc // for goroutines
+	mux        sync.Mutex         // guards the ollama and sseClient state that is shared with the handlers
 	controller *internal.AlertsController
+	history    *history.Store
 	ollama     struct {
 		httpServer      *httptest.Server
 		req             mockOllamaReq
 		requestReceived chan struct{} // channel is closed when a request is received
+		holdPrompt      string        // requests with this prompt are held until they are cancelled
+		held            chan string   // receives the prompt of every request that is held
 	}
 	openai struct {
 		httpServer *httptest.Server
 	}
 	sseClient struct {
 		ch     chan internal.SSEEvent
+		done   chan struct{} // closed when every event has been consumed
 		prompt string
 		events []internal.SSEEvent
 	}
@@ -53,30 +60,78 @@ func newMocks(t *testing.T, promptsFile string) *mocks {
 			httpServer      *httptest.Server
 			req             mockOllamaReq
 			requestReceived chan struct{} // channel is closed when a request is received
-		}{},
+			holdPrompt      string        // requests with this prompt are held until they are cancelled
+			held            chan string   // receives the prompt of every request that is held
+		}{
+			held: make(chan string, 10),
+		},
 		openai: struct{ httpServer *httptest.Server }{},
 		sseClient: struct {
 			ch     chan internal.SSEEvent
+			done   chan struct{} // closed when every event has been consumed
 			prompt string
 			events []internal.SSEEvent
 		}{
 			ch:     make(chan internal.SSEEvent, 100),
+			done:   make(chan struct{}),
 			events: []internal.SSEEvent{},
 		},
 	}
 	m.ollama.httpServer = httptest.NewServer(http.HandlerFunc(m.ollamaHandler))
 	m.openai.httpServer = httptest.NewServer(http.HandlerFunc(m.openaiHandler))
+	historyStore, err := history.NewStore(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("could not create history store: %v", err)
+	}
+	m.history = historyStore
+	analysisPipeline := pipeline.Pipeline{
+		Backends: map[string]pipeline.BackendConfig{
+			"ollama": {
+				Type:      "ollama",
+				URL:       m.ollama.httpServer.URL,
+				Model:     "dummy-model",
+				KeepAlive: "-1s",
+			},
+			"openai": {
+				Type:  "openai",
+				URL:   m.openai.httpServer.URL,
+				Model: "/mnt/models",
+			},
+		},
+		Stages: []*pipeline.Stage{
+			{
+				Name:    pipeline.ImageAnalysisStage,
+				Backend: "ollama",
+				Events:  pipeline.Events{Token: "ollama_response"},
+			},
+			{
+				Name:    pipeline.ThreatAnalysisStage,
+				Backend: "openai",
+				Input:   pipeline.ImageAnalysisStage,
+				Prompt:  "dummy prompt",
+				Events:  pipeline.Events{Token: "openai_response"},
+			},
+		},
+	}
+	if err := analysisPipeline.Init(nil); err != nil {
+		t.Fatalf("could not initialize pipeline: %v", err)
+	}
 	m.controller = internal.NewAlertsController(
 		m.sseClient.ch,
-		m.ollama.httpServer.URL,
-		"dummy-model",
-		"-1s", // keepalive
 		promptsFile,
-		"/mnt/models",
-		"dummy prompt",
-		m.openai.httpServer.URL,
+		&analysisPipeline,
+		m.history,
+		"alerts",
+		time.UTC,
 	)
 	m.resetOllamaRequestReceivedChannel()
+
+	// this goroutine simulates an SSE browser client
+	go func() {
+		m.consumeSSEEvents()
+		close(m.sseClient.done)
+	}()
+
 	m.launchGoroutines()
 	return &m
 }
@@ -91,27 +146,24 @@ func (m *mocks) launchGoroutines() {
 		m.controller.LLMChannelProcessor(m.ctx)
 		m.wg.Done()
 	}()
-
-	// this goroutine simulates an SSE browser client
-	m.wg.Add(1)
-	go func() {
-		m.consumeSSEEvents(m.ctx)
-		m.wg.Done()
-	}()
 }
 
-// stops goroutines
+// stops goroutines - the SSEEvent channel is only closed once the controller
+// has stopped sending to it
 func (m *mocks) close() {
 	time.Sleep(time.Second) // sleep to allow LLM HTTP client requests to complete
 	m.cancel()
+	m.wg.Wait()
 	m.ollama.httpServer.Close()
 	m.openai.httpServer.Close()
 	close(m.sseClient.ch)
-	m.wg.Wait()
+	<-m.sseClient.done
 }
 
 func (m *mocks) ollamaHandler(w http.ResponseWriter, r *http.Request) {
 	defer func() {
+		m.mux.Lock()
+		defer m.mux.Unlock()
 		if m.ollama.requestReceived == nil {
 			return
 		}
@@ -124,7 +176,15 @@ func (m *mocks) ollamaHandler(w http.ResponseWriter, r *http.Request) {
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		m.t.Errorf("could not decode incoming mockOllamaReq: %v", err)
 	}
+	m.mux.Lock()
 	m.ollama.req = req
+	holdPrompt := m.ollama.holdPrompt
+	m.mux.Unlock()
+	if holdPrompt != "" && req.Prompt == holdPrompt {
+		m.ollama.held <- req.Prompt
+		<-r.Context().Done()
+		return
+	}
 
 	w.Write([]byte(`{"response":"dummy ollama response"}`))
 }
@@ -145,49 +205,71 @@ func (m *mocks) openaiHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *mocks) waitForOllamaRequest() {
-	if m.ollama.requestReceived == nil {
+	m.mux.Lock()
+	requestReceived := m.ollama.requestReceived
+	m.mux.Unlock()
+	if requestReceived == nil {
 		m.t.Error("ollama requestReceived channel is nil")
 		return
 	}
 	m.t.Log("waiting for request to be received by ollama...")
-	<-m.ollama.requestReceived
+	<-requestReceived
 	m.t.Log("ollama request received")
 }
 
 func (m *mocks) resetOllamaRequestReceivedChannel() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 	if m.ollama.requestReceived != nil {
 		close(m.ollama.requestReceived)
 	}
 	m.ollama.requestReceived = make(chan struct{})
 }
 
-func (m *mocks) consumeSSEEvents(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case event := <-m.sseClient.ch:
-			m.sseClient.events = append(m.sseClient.events, event)
-			if event.EventType == "prompt" {
-				m.sseClient.prompt = string(event.Data)
-			}
+// returns the last request received by ollama
+func (m *mocks) ollamaRequest() mockOllamaReq {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.ollama.req
+}
+
+// requests with this prompt are held until they are cancelled
+func (m *mocks) holdOllamaPrompt(prompt string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.ollama.holdPrompt = prompt
+}
+
+// consumes events until the SSEEvent channel is closed
+func (m *mocks) consumeSSEEvents() {
+	for event := range m.sseClient.ch {
+		m.mux.Lock()
+		m.sseClient.events = append(m.sseClient.events, event)
+		if event.EventType == "prompt" {
+			m.sseClient.prompt = string(event.Data)
 		}
+		m.mux.Unlock()
 	}
 }
 
-/*
+// returns a copy of the events received so far
+func (m *mocks) sseEvents() []internal.SSEEvent {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]internal.SSEEvent(nil), m.sseClient.events...)
+}
+
 func (m *mocks) sseEventExists(eventType string, substring string) bool {
-	for _, event := range m.sseClient.events {
+	for _, event := range m.sseEvents() {
 		if event.EventType == eventType && strings.Contains(string(event.Data), substring) {
 			return true
 		}
 	}
 	return false
 }
-*/
 
 func (m *mocks) sseEventsExist(eventType string) bool {
-	for _, event := range m.sseClient.events {
+	for _, event := range m.sseEvents() {
 		if event.EventType == eventType {
 			return true
 		}
@@ -195,9 +277,27 @@ func (m *mocks) sseEventsExist(eventType string) bool {
 	return false
 }
 
+// returns nil if the image event was not received
+func (m *mocks) getSSEClientImageInfo(eventType string) *history.ImageInfo {
+	for _, event := range m.sseEvents() {
+		if event.EventType != eventType {
+			continue
+		}
+		var info history.ImageInfo
+		if err := json.Unmarshal(event.Data, &info); err != nil {
+			m.t.Errorf("error unmarshalling %s event: %v", eventType, err)
+			return nil
+		}
+		return &info
+	}
+	return nil
+}
+
 func (m *mocks) unmarshalSSEClientPrompt() (mockShortPrompt, error) {
 	var sp mockShortPrompt
+	m.mux.Lock()
 	r := strings.NewReader(m.sseClient.prompt)
+	m.mux.Unlock()
 	if err := json.NewDecoder(r).Decode(&sp); err != nil {
 		return mockShortPrompt{}, err
 	}
@@ -215,10 +315,11 @@ func writeSSEEvent(w io.Writer, data string) {
  */
 type mockMQTTMessage struct {
 	payload []byte
+	topic   string
 }
 
 func newMockMQTTMessage(s string) mockMQTTMessage {
-	return mockMQTTMessage{[]byte(s)}
+	return mockMQTTMessage{payload: []byte(s), topic: "alerts"}
 }
 
 func (m mockMQTTMessage) Payload() []byte {
@@ -238,7 +339,7 @@ func (m mockMQTTMessage) Retained() bool {
 }
 
 func (m mockMQTTMessage) Topic() string {
-	return ""
+	return m.topic
 }
 
 func (m mockMQTTMessage) MessageID() uint16 {
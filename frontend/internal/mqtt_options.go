@@ -0,0 +1,180 @@
+package internal
+
+// Builds the MQTT client options from the settings so that the frontend can
+// connect to brokers that require TLS and credentials. Errors name the
+// environment variable of the setting that is wrong so that a misconfigured
+// deployment can be fixed without turning on MQTT debug logging.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// MQTTSettings holds the settings of the connection to the MQTT broker
+type MQTTSettings struct {
+	Broker       string
+	CACert       string // path to PEM bundle of CAs that the broker's certificate is verified against - the system CAs are used if this is not set
+	Cert         string // path to PEM client certificate
+	Key          string // path to PEM client key
+	Username     string
+	Password     string
+	PasswordFile string // path to file containing the password, e.g. a mounted Kubernetes secret
+	ClientID     string
+	CleanSession bool
+	KeepAlive    time.Duration
+}
+
+// URL schemes that paho connects to with TLS
+var mqttTLSSchemes = map[string]bool{
+	"ssl":      true,
+	"tls":      true,
+	"mqtts":    true,
+	"mqtt+ssl": true,
+	"tcps":     true,
+	"wss":      true,
+}
+
+// NewMQTTClientOptions validates the settings and reads the certificates and
+// password file
+func NewMQTTClientOptions(settings MQTTSettings) (*MQTT.ClientOptions, error) {
+	broker, err := url.Parse(settings.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("MQTTBROKER: could not parse %s: %w", settings.Broker, err)
+	}
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(settings.Broker)
+	opts.SetClientID(settings.ClientID)
+	opts.SetCleanSession(settings.CleanSession)
+	if settings.KeepAlive > 0 {
+		opts.SetKeepAlive(settings.KeepAlive)
+	}
+
+	password, err := settings.password()
+	if err != nil {
+		return nil, err
+	}
+	if password != "" && settings.Username == "" {
+		return nil, errors.New("MQTTUSERNAME must be set if the MQTT password is set")
+	}
+	opts.SetUsername(settings.Username)
+	opts.SetPassword(password)
+
+	tlsConfig, err := settings.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if !mqttTLSSchemes[broker.Scheme] {
+			return nil, fmt.Errorf("MQTTBROKER: %s does not use TLS but MQTTCACERT or MQTTCERT is set - use ssl:// or wss://", settings.Broker)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return opts, nil
+}
+
+func (settings MQTTSettings) password() (string, error) {
+	if settings.PasswordFile == "" {
+		return settings.Password, nil
+	}
+	if settings.Password != "" {
+		return "", errors.New("MQTTPASSWORD and MQTTPASSWORDFILE cannot both be set")
+	}
+	b, err := os.ReadFile(settings.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("MQTTPASSWORDFILE: could not read password: %w", err)
+	}
+	// secrets are often created with a trailing newline
+	return strings.TrimSpace(string(b)), nil
+}
+
+// returns nil if the connection should use paho's default TLS config
+func (settings MQTTSettings) tlsConfig() (*tls.Config, error) {
+	if settings.CACert == "" && settings.Cert == "" && settings.Key == "" {
+		return nil, nil
+	}
+	config := tls.Config{MinVersion: tls.VersionTLS12}
+	if settings.CACert != "" {
+		pem, err := os.ReadFile(settings.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("MQTTCACERT: could not read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("MQTTCACERT: %s does not contain any PEM certificates", settings.CACert)
+		}
+		config.RootCAs = pool
+	}
+	if settings.Cert != "" || settings.Key != "" {
+		if settings.Cert == "" || settings.Key == "" {
+			return nil, errors.New("MQTTCERT and MQTTKEY must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(settings.Cert, settings.Key)
+		if err != nil {
+			return nil, fmt.Errorf("MQTTCERT, MQTTKEY: could not load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &config, nil
+}
+
+// TopicMatches returns true if a message published to topic is received by a
+// subscription to filter - filter can contain the + and # wildcards
+func TopicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// DiagnoseMQTTConnectError adds the settings that are most likely to be
+// wrong to an error returned when connecting to the broker. paho formats
+// network errors as strings, so TLS errors are matched on their text.
+func DiagnoseMQTTConnectError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var hint string
+	switch msg := err.Error(); {
+	case errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword):
+		hint = "check MQTTUSERNAME and MQTTPASSWORD or MQTTPASSWORDFILE"
+	case errors.Is(err, packets.ErrorRefusedNotAuthorised):
+		hint = "the broker did not authorize MQTTUSERNAME or the client certificate in MQTTCERT"
+	case errors.Is(err, packets.ErrorRefusedIDRejected):
+		hint = "the broker rejected MQTTCLIENTID - it may be in use by another client or MQTTCLEANSESSION may need to be true for an empty client ID"
+	case errors.Is(err, packets.ErrorRefusedBadProtocolVersion):
+		hint = "the broker does not support MQTT 3.1.1 - check MQTTBROKER"
+	case strings.Contains(msg, "certificate signed by unknown authority"):
+		hint = "the broker's certificate is not signed by a CA in MQTTCACERT"
+	case strings.Contains(msg, "certificate is valid for"), strings.Contains(msg, "doesn't contain any IP SANs"):
+		hint = "the host name in MQTTBROKER does not match the broker's certificate"
+	case strings.Contains(msg, "certificate has expired"), strings.Contains(msg, "not yet valid"):
+		hint = "the broker's certificate has expired or is not yet valid"
+	case strings.Contains(msg, "tls: bad certificate"), strings.Contains(msg, "tls: certificate required"), strings.Contains(msg, "tls: unknown certificate authority"):
+		hint = "the broker rejected the client certificate - check MQTTCERT and MQTTKEY"
+	case strings.Contains(msg, "first record does not look like a TLS handshake"):
+		hint = "the broker is not using TLS - check the scheme of MQTTBROKER"
+	case strings.Contains(msg, "connection refused"), strings.Contains(msg, "no such host"), strings.Contains(msg, "i/o timeout"):
+		hint = "could not reach the broker - check MQTTBROKER"
+	case strings.Contains(msg, "EOF"), strings.Contains(msg, "connection reset"):
+		hint = "the broker closed the connection - check that MQTTBROKER uses the right scheme and port, and MQTTCERT if the broker requires client certificates"
+	default:
+		return err
+	}
+	return fmt.Errorf("%s: %w", hint, err)
+}
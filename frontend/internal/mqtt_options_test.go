@@ -0,0 +1,223 @@
+package internal_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/kwkoo/threat-detection-frontend/internal"
+)
+
+func TestMQTTClientOptions(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, abort := writeSelfSignedCert(t, dir)
+	if abort {
+		return
+	}
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Errorf("could not write password file: %v", err)
+		return
+	}
+
+	opts, err := internal.NewMQTTClientOptions(internal.MQTTSettings{
+		Broker:       "ssl://localhost:8883",
+		CACert:       certFile,
+		Cert:         certFile,
+		Key:          keyFile,
+		Username:     "frontend",
+		PasswordFile: passwordFile,
+		ClientID:     "frontend-1",
+		CleanSession: false,
+		KeepAlive:    time.Minute,
+	})
+	if err != nil {
+		t.Errorf("could not create MQTT client options: %v", err)
+		return
+	}
+	if opts.Username != "frontend" || opts.Password != "secret" {
+		t.Errorf(`expected username "frontend" and password "secret" but got "%s" and "%s"`, opts.Username, opts.Password)
+	}
+	if opts.ClientID != "frontend-1" || opts.CleanSession || opts.KeepAlive != 60 {
+		t.Errorf("expected client ID frontend-1, no clean session and keepalive 60 but got %s, %t and %d", opts.ClientID, opts.CleanSession, opts.KeepAlive)
+	}
+	if opts.TLSConfig == nil || opts.TLSConfig.RootCAs == nil || len(opts.TLSConfig.Certificates) != 1 {
+		t.Errorf("expected TLS config with CAs and a client certificate but got %v", opts.TLSConfig)
+	}
+
+	tests := []struct {
+		name     string
+		settings internal.MQTTSettings
+		setting  string
+	}{
+		{"password and password file", internal.MQTTSettings{Broker: "tcp://localhost:1883", Username: "frontend", Password: "secret", PasswordFile: passwordFile}, "MQTTPASSWORDFILE"},
+		{"missing password file", internal.MQTTSettings{Broker: "tcp://localhost:1883", Username: "frontend", PasswordFile: filepath.Join(dir, "missing")}, "MQTTPASSWORDFILE"},
+		{"password without username", internal.MQTTSettings{Broker: "tcp://localhost:1883", Password: "secret"}, "MQTTUSERNAME"},
+		{"CA bundle without certificates", internal.MQTTSettings{Broker: "ssl://localhost:8883", CACert: passwordFile}, "MQTTCACERT"},
+		{"certificate without key", internal.MQTTSettings{Broker: "ssl://localhost:8883", Cert: certFile}, "MQTTKEY"},
+		{"key that does not match", internal.MQTTSettings{Broker: "ssl://localhost:8883", Cert: certFile, Key: passwordFile}, "MQTTKEY"},
+		{"TLS without TLS scheme", internal.MQTTSettings{Broker: "tcp://localhost:1883", CACert: certFile}, "MQTTBROKER"},
+	}
+	for _, test := range tests {
+		_, err := internal.NewMQTTClientOptions(test.settings)
+		if err == nil {
+			t.Errorf("%s: expected an error but did not get one", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.setting) {
+			t.Errorf(`%s: expected error to name %s but got "%v"`, test.name, test.setting, err)
+		}
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter  string
+		topic   string
+		matches bool
+	}{
+		{"alerts", "alerts", true},
+		{"alerts", "alerts/rejected", false},
+		{"alerts/+", "alerts/rejected", true},
+		{"alerts/+", "alerts", false},
+		{"alerts/+", "alerts/gate/rejected", false},
+		{"alerts/#", "alerts", true},
+		{"alerts/#", "alerts/gate/rejected", true},
+		{"+/rejected", "alerts/rejected", true},
+		{"alerts/+", "results", false},
+	}
+	for _, test := range tests {
+		if matches := internal.TopicMatches(test.filter, test.topic); matches != test.matches {
+			t.Errorf("expected TopicMatches(%s, %s) to be %v but got %v", test.filter, test.topic, test.matches, matches)
+		}
+	}
+}
+
+func TestDiagnoseMQTTConnectError(t *testing.T) {
+	tests := []struct {
+		err     error
+		setting string
+	}{
+		{packets.ErrorRefusedBadUsernameOrPassword, "MQTTPASSWORD"},
+		{packets.ErrorRefusedIDRejected, "MQTTCLIENTID"},
+		{errors.New("network Error : dial tcp 127.0.0.1:1883: connect: connection refused"), "MQTTBROKER"},
+		{errors.New("network Error : remote error: tls: certificate required"), "MQTTCERT"},
+	}
+	for _, test := range tests {
+		err := internal.DiagnoseMQTTConnectError(test.err)
+		if !errors.Is(err, test.err) {
+			t.Errorf(`expected "%v" to wrap "%v"`, err, test.err)
+		}
+		if !strings.Contains(err.Error(), test.setting) {
+			t.Errorf(`expected diagnosis of "%v" to name %s but got "%v"`, test.err, test.setting, err)
+		}
+	}
+}
+
+// Test that connecting to a broker with a certificate that is not signed by
+// a trusted CA names MQTTCACERT
+func TestDiagnoseUnknownAuthority(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, abort := writeSelfSignedCert(t, dir)
+	if abort {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Errorf("could not load certificate: %v", err)
+		return
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Errorf("could not listen: %v", err)
+		return
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	// the system CAs do not include the self-signed certificate
+	opts, err := internal.NewMQTTClientOptions(internal.MQTTSettings{
+		Broker: "ssl://" + listener.Addr().String(),
+		Cert:   certFile,
+		Key:    keyFile,
+	})
+	if err != nil {
+		t.Errorf("could not create MQTT client options: %v", err)
+		return
+	}
+	opts.SetConnectTimeout(5 * time.Second)
+	token := MQTT.NewClient(opts).Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		t.Error("timed out connecting to broker")
+		return
+	}
+	err = internal.DiagnoseMQTTConnectError(token.Error())
+	if err == nil || !strings.Contains(err.Error(), "MQTTCACERT") {
+		t.Errorf(`expected connection error to name MQTTCACERT but got "%v"`, err)
+	}
+}
+
+// returns true if subsequent tests should be aborted
+func writeSelfSignedCert(t *testing.T, dir string) (string, string, bool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Errorf("could not generate key: %v", err)
+		return "", "", true
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Errorf("could not create certificate: %v", err)
+		return "", "", true
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Errorf("could not marshal key: %v", err)
+		return "", "", true
+	}
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Errorf("could not write certificate: %v", err)
+		return "", "", true
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Errorf("could not write key: %v", err)
+		return "", "", true
+	}
+	return certFile, keyFile, false
+}
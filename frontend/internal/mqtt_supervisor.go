@@ -0,0 +1,281 @@
+package internal
+
+// The MQTTSupervisor connects to the broker and subscribes to the alerts
+// topics, retrying with exponential backoff until it succeeds. A broker that
+// is down, restarting or refusing the subscription no longer takes the
+// frontend (and every browser connected to it) down with it - the state of
+// the connection is reported instead.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const mqttDisconnectQuiesce = 5000 // milliseconds
+
+type MQTTState string
+
+const (
+	MQTTConnecting   MQTTState = "connecting"
+	MQTTSubscribing  MQTTState = "subscribing"
+	MQTTConnected    MQTTState = "connected" // connected and subscribed to every topic
+	MQTTDisconnected MQTTState = "disconnected"
+	MQTTStopped      MQTTState = "stopped"
+)
+
+// MQTTStatus is reported by /healthz and /readyz, and broadcast to the
+// browsers as an mqtt_status event
+type MQTTStatus struct {
+	State     MQTTState `json:"state"`
+	Broker    string    `json:"broker"`
+	Since     int64     `json:"since"`                // unix time that the state was entered
+	Error     string    `json:"error,omitempty"`      // reason for the last failure
+	Failures  int       `json:"failures,omitempty"`   // consecutive failed attempts to connect and subscribe
+	NextRetry int64     `json:"next_retry,omitempty"` // unix time of the next attempt if disconnected
+}
+
+type MQTTSupervisor struct {
+	client        MQTT.Client
+	broker        string
+	subscriptions map[string]byte
+	handler       MQTT.MessageHandler
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	onStatus      func(MQTTStatus)
+	lost          chan error
+
+	statusMux sync.RWMutex
+	status    MQTTStatus
+}
+
+// The client is created from opts with its own reconnect logic turned off.
+// The backoff starts at minBackoff and doubles after every failed attempt up
+// to maxBackoff. onStatus is called whenever the state changes - it can be
+// nil.
+func NewMQTTSupervisor(opts *MQTT.ClientOptions, subscriptions map[string]byte, handler MQTT.MessageHandler, minBackoff, maxBackoff time.Duration, onStatus func(MQTTStatus)) *MQTTSupervisor {
+	if minBackoff <= 0 {
+		minBackoff = time.Second
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	var broker string
+	if len(opts.Servers) > 0 {
+		broker = opts.Servers[0].Redacted()
+	}
+	s := MQTTSupervisor{
+		broker:        broker,
+		subscriptions: subscriptions,
+		handler:       handler,
+		minBackoff:    minBackoff,
+		maxBackoff:    maxBackoff,
+		onStatus:      onStatus,
+		lost:          make(chan error, 1),
+		status: MQTTStatus{
+			State:  MQTTDisconnected,
+			Broker: broker,
+			Since:  time.Now().Unix(),
+		},
+	}
+	opts.SetAutoReconnect(false)
+	opts.SetConnectRetry(false)
+	opts.SetConnectionLostHandler(func(_ MQTT.Client, err error) {
+		select {
+		case s.lost <- err:
+		default:
+		}
+	})
+	s.client = MQTT.NewClient(opts)
+	return &s
+}
+
+// Client can be used to publish messages - publishing fails while the
+// supervisor is not connected
+func (s *MQTTSupervisor) Client() MQTT.Client {
+	return s.client
+}
+
+func (s *MQTTSupervisor) Status() MQTTStatus {
+	s.statusMux.RLock()
+	defer s.statusMux.RUnlock()
+	return s.status
+}
+
+// Run keeps the client connected and subscribed until ctx is cancelled, and
+// then disconnects
+func (s *MQTTSupervisor) Run(ctx context.Context) {
+	defer s.stop()
+	backoff := s.minBackoff
+	failures := 0
+	for {
+		err := s.connectAndSubscribe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			failures = 0
+			backoff = s.minBackoff
+			log.Printf("successfully connected to MQTT broker %s", s.broker)
+			s.setStatus(MQTTStatus{State: MQTTConnected})
+
+			select {
+			case <-ctx.Done():
+			case err = <-s.lost:
+				log.Printf("lost connection to MQTT broker %s: %v", s.broker, err)
+				err = fmt.Errorf("connection lost: %w", err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			// reconnect straight away the first time - a broker that has
+			// restarted is usually back by now
+			s.setStatus(MQTTStatus{State: MQTTDisconnected, Error: err.Error()})
+			continue
+		}
+
+		failures++
+		log.Printf("error connecting to MQTT broker %s (attempt %d) - retrying in %v: %v", s.broker, failures, backoff, err)
+		s.setStatus(MQTTStatus{
+			State:     MQTTDisconnected,
+			Error:     err.Error(),
+			Failures:  failures,
+			NextRetry: time.Now().Add(backoff).Unix(),
+		})
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+func (s *MQTTSupervisor) stop() {
+	log.Print("shutting down MQTT client...")
+	s.client.Disconnect(mqttDisconnectQuiesce)
+	log.Print("MQTT client successfully shutdown")
+	s.statusMux.Lock()
+	s.status = MQTTStatus{State: MQTTStopped, Broker: s.broker, Since: time.Now().Unix()}
+	s.statusMux.Unlock()
+}
+
+func (s *MQTTSupervisor) connectAndSubscribe(ctx context.Context) error {
+	// a connection that was lost before the last attempt failed is no longer
+	// relevant
+	select {
+	case <-s.lost:
+	default:
+	}
+
+	s.setStatus(MQTTStatus{State: MQTTConnecting})
+	token := s.client.Connect()
+	if err := waitForToken(ctx, token); err != nil {
+		return DiagnoseMQTTConnectError(err)
+	}
+
+	s.setStatus(MQTTStatus{State: MQTTSubscribing})
+	token = s.client.SubscribeMultiple(s.subscriptions, s.handler)
+	err := waitForToken(ctx, token)
+	if err == nil {
+		err = refusedSubscriptions(token.(*MQTT.SubscribeToken))
+	}
+	if err != nil {
+		s.client.Disconnect(0)
+		return fmt.Errorf("could not subscribe to %s: %w", strings.Join(s.topics(), ", "), err)
+	}
+	return nil
+}
+
+// brokers return 0x80 for each topic that the client is not allowed to
+// subscribe to instead of failing the subscription
+func refusedSubscriptions(token *MQTT.SubscribeToken) error {
+	var refused []string
+	for topic, qos := range token.Result() {
+		if qos == 0x80 {
+			refused = append(refused, topic)
+		}
+	}
+	if len(refused) == 0 {
+		return nil
+	}
+	sort.Strings(refused)
+	return fmt.Errorf("broker refused subscription to %s - check that MQTTUSERNAME is allowed to read the topics", strings.Join(refused, ", "))
+}
+
+func (s *MQTTSupervisor) topics() []string {
+	topics := make([]string, 0, len(s.subscriptions))
+	for topic := range s.subscriptions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// returns the context's error if ctx is cancelled before the token completes
+func waitForToken(ctx context.Context, token MQTT.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *MQTTSupervisor) setStatus(status MQTTStatus) {
+	status.Broker = s.broker
+	status.Since = time.Now().Unix()
+	s.statusMux.Lock()
+	s.status = status
+	s.statusMux.Unlock()
+	if s.onStatus != nil {
+		s.onStatus(status)
+	}
+}
+
+// HealthHandler always succeeds so that a broker outage does not get the
+// frontend restarted - the MQTT status is included for information
+func (s *MQTTSupervisor) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeStatus(w, http.StatusOK)
+}
+
+// ReadyHandler fails unless the frontend is connected to the broker and
+// subscribed to the alerts topics - this is for monitoring, and is not used as
+// the readiness probe because the frontend is still useful to operators
+// while the broker is down
+func (s *MQTTSupervisor) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusOK
+	if s.Status().State != MQTTConnected {
+		code = http.StatusServiceUnavailable
+	}
+	s.writeStatus(w, code)
+}
+
+func (s *MQTTSupervisor) writeStatus(w http.ResponseWriter, code int) {
+	status := struct {
+		Status string     `json:"status"`
+		MQTT   MQTTStatus `json:"mqtt"`
+	}{
+		Status: "ok",
+		MQTT:   s.Status(),
+	}
+	if code != http.StatusOK {
+		status.Status = "unavailable"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&status)
+}
@@ -0,0 +1,220 @@
+package internal_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/kwkoo/threat-detection-frontend/internal"
+)
+
+// Test that the supervisor keeps retrying until the broker is up, and that
+// it reconnects and subscribes again after a refused subscription and a lost
+// connection
+func TestMQTTSupervisor(t *testing.T) {
+	// reserve a port for the broker, which is only started after the first
+	// attempts to connect have failed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("could not listen: %v", err)
+		return
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	var statesMux sync.Mutex
+	var states []internal.MQTTState
+	opts, err := internal.NewMQTTClientOptions(internal.MQTTSettings{Broker: "tcp://" + addr, CleanSession: true})
+	if err != nil {
+		t.Errorf("could not create MQTT client options: %v", err)
+		return
+	}
+	opts.SetConnectTimeout(time.Second)
+	topics := map[string]byte{"alerts": 1, "alerts/+": 1}
+	supervisor := internal.NewMQTTSupervisor(opts, topics, func(MQTT.Client, MQTT.Message) {}, 50*time.Millisecond, 200*time.Millisecond, func(status internal.MQTTStatus) {
+		statesMux.Lock()
+		states = append(states, status.State)
+		statesMux.Unlock()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		supervisor.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if waitForMQTTStatus(t, supervisor, func(status internal.MQTTStatus) bool { return status.Failures >= 2 }) {
+		return
+	}
+	if code := readiness(supervisor); code != http.StatusServiceUnavailable {
+		t.Errorf("expected readiness to be %d while the broker is down but got %d", http.StatusServiceUnavailable, code)
+	}
+	rec := httptest.NewRecorder()
+	supervisor.HealthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"state":"disconnected"`) {
+		t.Errorf("expected health to be %d and report the disconnected state but got %d %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	broker, err := newFakeBroker(addr)
+	if err != nil {
+		t.Errorf("could not start fake broker: %v", err)
+		return
+	}
+	defer broker.close()
+	broker.refuseSubscriptions.Store(1)
+
+	if waitForMQTTStatus(t, supervisor, func(status internal.MQTTStatus) bool { return status.State == internal.MQTTConnected }) {
+		return
+	}
+	if code := readiness(supervisor); code != http.StatusOK {
+		t.Errorf("expected readiness to be %d once connected but got %d", http.StatusOK, code)
+	}
+	if n := broker.subscriptions.Load(); n != 2 {
+		t.Errorf("expected the refused subscription to be retried but got %d subscriptions", n)
+	}
+	statesMux.Lock()
+	joined := strings.Join(mqttStateStrings(states), " ")
+	statesMux.Unlock()
+	if !strings.Contains(joined, "connecting subscribing disconnected") || !strings.HasSuffix(joined, "connecting subscribing connected") {
+		t.Errorf("expected the refused subscription to be reported before connecting but got %s", joined)
+	}
+
+	broker.dropConnections()
+	if waitForMQTTStatus(t, supervisor, func(status internal.MQTTStatus) bool {
+		return status.State == internal.MQTTConnected && broker.subscriptions.Load() == 3
+	}) {
+		return
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Error("supervisor did not stop")
+		return
+	}
+	if state := supervisor.Status().State; state != internal.MQTTStopped {
+		t.Errorf("expected supervisor to be stopped but got %s", state)
+	}
+}
+
+// returns true if subsequent tests should be aborted
+func waitForMQTTStatus(t *testing.T, supervisor *internal.MQTTSupervisor, condition func(internal.MQTTStatus) bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition(supervisor.Status()) {
+			return false
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("timed out waiting for MQTT status - last status was %+v", supervisor.Status())
+	return true
+}
+
+func readiness(supervisor *internal.MQTTSupervisor) int {
+	rec := httptest.NewRecorder()
+	supervisor.ReadyHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return rec.Code
+}
+
+func mqttStateStrings(states []internal.MQTTState) []string {
+	s := make([]string, 0, len(states))
+	for _, state := range states {
+		s = append(s, string(state))
+	}
+	return s
+}
+
+// fakeBroker accepts every connection, and refuses the first
+// refuseSubscriptions subscriptions
+type fakeBroker struct {
+	listener            net.Listener
+	refuseSubscriptions atomic.Int32
+	subscriptions       atomic.Int32
+	connsMux            sync.Mutex
+	conns               []net.Conn
+}
+
+func newFakeBroker(addr string) (*fakeBroker, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	broker := fakeBroker{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			broker.connsMux.Lock()
+			broker.conns = append(broker.conns, conn)
+			broker.connsMux.Unlock()
+			go broker.handle(conn)
+		}
+	}()
+	return &broker, nil
+}
+
+func (broker *fakeBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.SubscribePacket:
+			broker.subscriptions.Add(1)
+			refuse := broker.refuseSubscriptions.Add(-1) >= 0
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			for _, qos := range p.Qoss {
+				if refuse {
+					qos = 0x80
+				}
+				suback.ReturnCodes = append(suback.ReturnCodes, qos)
+			}
+			reply = suback
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		default:
+			continue
+		}
+		if err := reply.Write(conn); err != nil {
+			return
+		}
+	}
+}
+
+// emulates a broker restart
+func (broker *fakeBroker) dropConnections() {
+	broker.connsMux.Lock()
+	defer broker.connsMux.Unlock()
+	for _, conn := range broker.conns {
+		conn.Close()
+	}
+	broker.conns = nil
+}
+
+func (broker *fakeBroker) close() {
+	broker.listener.Close()
+	broker.dropConnections()
+}
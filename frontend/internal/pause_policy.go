@@ -0,0 +1,203 @@
+package internal
+
+// A camera's events are paused once an alert has been analyzed so that an
+// operator can look at it. The pause policy decides whether and when the
+// camera is resumed without an operator - unattended sites can resume after
+// a delay, resume only when the threat level is low, or never pause.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/verdict"
+)
+
+const defaultResumeDelay = 30 * time.Second
+
+type PauseMode string
+
+const (
+	PauseManual  PauseMode = "manual"  // stay paused until the camera is resumed
+	PauseNever   PauseMode = "never"   // never pause
+	PauseTimeout PauseMode = "timeout" // resume after the delay
+	PauseLow     PauseMode = "low"     // resume after the delay if the threat level is low - stay paused otherwise
+)
+
+type PausePolicy struct {
+	Mode  PauseMode
+	Delay time.Duration // only used by PauseTimeout and PauseLow
+}
+
+func (policy PausePolicy) String() string {
+	if policy.Mode == PauseTimeout || policy.Mode == PauseLow {
+		return fmt.Sprintf("%s:%v", policy.Mode, policy.Delay)
+	}
+	return string(policy.Mode)
+}
+
+// ParsePausePolicy parses manual, never, timeout[:delay] or low[:delay] -
+// the delay defaults to 30s
+func ParsePausePolicy(s string) (PausePolicy, error) {
+	mode, delay, hasDelay := strings.Cut(strings.TrimSpace(s), ":")
+	policy := PausePolicy{Mode: PauseMode(strings.ToLower(mode))}
+	switch policy.Mode {
+	case PauseManual, PauseNever:
+		if hasDelay {
+			return PausePolicy{}, fmt.Errorf("pause policy %s does not take a delay", policy.Mode)
+		}
+		return policy, nil
+	case PauseTimeout, PauseLow:
+		policy.Delay = defaultResumeDelay
+		if hasDelay {
+			d, err := time.ParseDuration(delay)
+			if err != nil {
+				return PausePolicy{}, fmt.Errorf("invalid delay in pause policy %s: %w", s, err)
+			}
+			if d < 0 {
+				return PausePolicy{}, fmt.Errorf("delay in pause policy %s cannot be negative", s)
+			}
+			policy.Delay = d
+		}
+		return policy, nil
+	default:
+		return PausePolicy{}, fmt.Errorf("invalid pause policy %s - must be manual, never, timeout[:delay] or low[:delay]", s)
+	}
+}
+
+// ParseCameraPausePolicies parses a comma-separated list of
+// <camera>=<policy>, e.g. gate=never,lobby=timeout:10s
+func ParseCameraPausePolicies(s string) (map[string]PausePolicy, error) {
+	policies := make(map[string]PausePolicy)
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		camera, spec, ok := strings.Cut(item, "=")
+		camera = strings.TrimSpace(camera)
+		if !ok || camera == "" {
+			return nil, fmt.Errorf("invalid camera pause policy %s - must be <camera>=<policy>", item)
+		}
+		policy, err := ParsePausePolicy(spec)
+		if err != nil {
+			return nil, fmt.Errorf("camera %s: %w", camera, err)
+		}
+		policies[camera] = policy
+	}
+	return policies, nil
+}
+
+type pausePolicies struct {
+	global  PausePolicy
+	cameras map[string]PausePolicy
+}
+
+// SetPausePolicies sets the policy for every camera, and the policies of the
+// cameras that do not use the global policy
+func (controller *AlertsController) SetPausePolicies(global PausePolicy, cameras map[string]PausePolicy) {
+	controller.pausePolicies.Store(&pausePolicies{global: global, cameras: cameras})
+	names := make([]string, 0, len(cameras))
+	for camera, policy := range cameras {
+		names = append(names, fmt.Sprintf("%s=%s", camera, policy))
+	}
+	sort.Strings(names)
+	log.Printf("pause policy set to %s %v", global, names)
+}
+
+func (controller *AlertsController) pausePolicy(camera string) PausePolicy {
+	policies := controller.pausePolicies.Load()
+	if policies == nil {
+		return PausePolicy{Mode: PauseManual}
+	}
+	if policy, ok := policies.cameras[camera]; ok {
+		return policy
+	}
+	return policies.global
+}
+
+// applyPausePolicy is called by processAlert once an alert has been analyzed
+// - the browsers are told that the camera is paused, and a countdown is
+// started if the camera should be resumed without an operator. This must only
+// be called by an analysis worker - the SSEEvent channel is not closed until
+// the workers have finished.
+func (controller *AlertsController) applyPausePolicy(ctx context.Context, state *cameraState, policy PausePolicy, threatVerdict *verdict.Verdict) {
+	if policy.Mode == PauseNever {
+		return
+	}
+	controller.sseCh <- SSEEvent{
+		EventType: "pause_events",
+		Data:      nil,
+		Camera:    state.name,
+	}
+	switch {
+	case policy.Mode == PauseTimeout:
+	case policy.Mode == PauseLow && threatVerdict != nil && threatVerdict.Level == verdict.LevelLow:
+	default:
+		return
+	}
+	controller.startResumeCountdown(ctx, state, policy.Delay)
+}
+
+// startResumeCountdown resumes the camera after delay unless the camera is
+// resumed or starts analyzing another alert first - the countdown is
+// cancelled when ctx is cancelled, and the LLMChannelProcessor waits for it
+// to finish before it returns
+func (controller *AlertsController) startResumeCountdown(ctx context.Context, state *cameraState, delay time.Duration) {
+	countdownCtx, cancel := context.WithCancel(ctx)
+	resumeAt := time.Now().Add(delay)
+	state.startCountdown(cancel, resumeAt)
+	controller.broadcastCountdown(state.name, delay, resumeAt)
+	log.Printf("camera %s will be resumed in %v", state.name, delay)
+	controller.countdowns.Add(1)
+	go func() {
+		defer controller.countdowns.Done()
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-countdownCtx.Done():
+			return
+		case <-timer.C:
+		}
+		if !state.finishCountdown(countdownCtx) {
+			return
+		}
+		log.Printf("resuming camera %s because its countdown has finished", state.name)
+		controller.ResumeEvents(state.name)
+	}()
+}
+
+// stopResumeCountdown lets the browsers know if a countdown was cancelled
+func (controller *AlertsController) stopResumeCountdown(state *cameraState) {
+	if state.stopCountdown() {
+		controller.broadcastCountdown(state.name, 0, time.Time{})
+	}
+}
+
+// a countdown that has been cancelled has 0 seconds remaining
+func (controller *AlertsController) broadcastCountdown(camera string, remaining time.Duration, resumeAt time.Time) {
+	countdown := struct {
+		Camera    string `json:"camera"`
+		Remaining int64  `json:"remaining"` // seconds
+		ResumeAt  int64  `json:"resume_at,omitempty"`
+	}{
+		Camera:    camera,
+		Remaining: int64(remaining.Round(time.Second) / time.Second),
+	}
+	if !resumeAt.IsZero() {
+		countdown.ResumeAt = resumeAt.Unix()
+	}
+	marshaled, err := json.Marshal(&countdown)
+	if err != nil {
+		log.Printf("error converting resume countdown to json: %v", err)
+		return
+	}
+	controller.sendToSSECh(SSEEvent{
+		EventType: "resume_countdown",
+		Data:      marshaled,
+		Camera:    camera,
+	})
+}
@@ -0,0 +1,108 @@
+package internal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kwkoo/threat-detection-frontend/internal"
+)
+
+func TestParsePausePolicy(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected string // empty if the policy is not valid
+	}{
+		{"manual", "manual"},
+		{"Never", "never"},
+		{"timeout", "timeout:30s"},
+		{"timeout:10s", "timeout:10s"},
+		{"low:1m", "low:1m0s"},
+		{"manual:10s", ""},
+		{"timeout:soon", ""},
+		{"timeout:-1s", ""},
+		{"sometimes", ""},
+	}
+	for _, test := range tests {
+		policy, err := internal.ParsePausePolicy(test.spec)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("expected pause policy %s to be invalid but got %s", test.spec, policy)
+			}
+			continue
+		}
+		if err != nil || policy.String() != test.expected {
+			t.Errorf("expected pause policy %s to be %s but got %s (%v)", test.spec, test.expected, policy, err)
+		}
+	}
+
+	policies, err := internal.ParseCameraPausePolicies(" gate=never, lobby=timeout:10s,")
+	if err != nil || len(policies) != 2 || policies["gate"].Mode != internal.PauseNever || policies["lobby"].Delay != 10*time.Second {
+		t.Errorf("unexpected camera pause policies %v (%v)", policies, err)
+	}
+	if _, err := internal.ParseCameraPausePolicies("gate"); err == nil {
+		t.Error("expected camera pause policy without a policy to be invalid")
+	}
+}
+
+// Test that the camera is resumed once the countdown runs out
+func TestPausePolicyTimeout(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+	m.controller.SetPausePolicies(internal.PausePolicy{Mode: internal.PauseManual}, map[string]internal.PausePolicy{
+		"gate": {Mode: internal.PauseTimeout, Delay: time.Second},
+	})
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1,"camera":"gate"}`))
+	if !waitForSSEEvent(m, "resume_countdown", `{"camera":"gate","remaining":1,`) {
+		t.Error("expected resume_countdown event for camera gate")
+		return
+	}
+	if _, abort := waitForPendingState(t, m.controller, "gate", func(state pendingState) bool { return !state.EventsPaused }); abort {
+		return
+	}
+	if !waitForSSEEvent(m, "resume_events", "") {
+		t.Error("expected resume_events event when the countdown ran out")
+	}
+}
+
+// Test that the camera stays paused if the threat level is not low
+func TestPausePolicyLow(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+	m.controller.SetPausePolicies(internal.PausePolicy{Mode: internal.PauseLow, Delay: 100 * time.Millisecond}, nil)
+
+	// the mock LLM returns a medium threat
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1,"camera":"gate"}`))
+	if _, abort := waitForCameraAnalysis(t, m.controller, "gate"); abort {
+		return
+	}
+	time.Sleep(500 * time.Millisecond)
+	state, abort := waitForPendingState(t, m.controller, "gate", func(pendingState) bool { return true })
+	if abort {
+		return
+	}
+	if !state.EventsPaused || m.sseEventsExist("resume_countdown") {
+		t.Errorf("expected camera gate to stay paused after a medium threat but got %+v", state)
+	}
+}
+
+// Test that the next alert is analyzed right away if the camera is never
+// paused
+func TestPausePolicyNever(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+	m.controller.SetPausePolicies(internal.PausePolicy{Mode: internal.PauseNever}, nil)
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1,"camera":"gate"}`))
+	if _, abort := waitForPendingState(t, m.controller, "gate", func(state pendingState) bool { return state.Timestamp == 1 }); abort {
+		return
+	}
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":2,"camera":"gate"}`))
+	state, abort := waitForPendingState(t, m.controller, "gate", func(state pendingState) bool { return state.Timestamp == 2 })
+	if abort {
+		return
+	}
+	if state.EventsPaused || m.sseEventsExist("pause_events") {
+		t.Errorf("expected camera gate not to be paused but got %+v", state)
+	}
+}
@@ -0,0 +1,59 @@
+package internal
+
+// Alerts that arrive while a camera is paused are kept in a bounded queue
+// for each camera instead of being discarded, so that operators can see
+// every alert that was raised while they were looking at an earlier one.
+// The next pending alert is analyzed when the camera is resumed.
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// SetMaxPendingAlerts sets the number of alerts that are kept for each
+// camera while the camera is paused - the oldest alert is discarded when the
+// queue is full. Alerts are discarded while paused if size is 0.
+func (controller *AlertsController) SetMaxPendingAlerts(size int) {
+	controller.maxPending.Store(int32(size))
+}
+
+// analyzeNextPending sends the camera's oldest pending alert to the LLM with
+// the camera's current prompt
+func (controller *AlertsController) analyzeNextPending(state *cameraState) {
+	alert, ok := state.nextPending()
+	if !ok {
+		return
+	}
+	if prompt, err := controller.promptFor(state); err == nil && prompt != nil {
+		alert.prompt = *prompt
+	}
+	if err := controller.queueAlert(alert); err != nil {
+		log.Printf("%v - pending alert %s from camera %s will be analyzed when the camera is resumed again", err, alert.id, state.name)
+		state.requeuePending(alert)
+	} else {
+		log.Printf("analyzing pending alert %s from camera %s", alert.id, state.name)
+	}
+	controller.broadcastPendingCount(state)
+}
+
+func (controller *AlertsController) broadcastPendingCount(state *cameraState) {
+	count, dropped := state.pendingCount()
+	marshaled, err := json.Marshal(struct {
+		Camera  string `json:"camera"`
+		Count   int    `json:"count"`
+		Dropped uint64 `json:"dropped"`
+	}{
+		Camera:  state.name,
+		Count:   count,
+		Dropped: dropped,
+	})
+	if err != nil {
+		log.Printf("error converting pending count to json: %v", err)
+		return
+	}
+	controller.sendToSSECh(SSEEvent{
+		EventType: "pending_count",
+		Data:      marshaled,
+		Camera:    state.name,
+	})
+}
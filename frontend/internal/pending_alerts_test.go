@@ -0,0 +1,123 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kwkoo/threat-detection-frontend/internal"
+)
+
+type pendingState struct {
+	Timestamp      int64 `json:"timestamp"`
+	EventsPaused   bool  `json:"events_paused"`
+	PendingCount   int   `json:"pending_count"`
+	PendingDropped int   `json:"pending_dropped"`
+	PendingAlerts  []struct {
+		Timestamp int64 `json:"timestamp"`
+	} `json:"pending_alerts"`
+}
+
+// Test that alerts that arrive while a camera is paused are queued, and that
+// the next pending alert is analyzed when the camera is resumed
+func TestPendingAlerts(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+	m.controller.SetMaxPendingAlerts(2)
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1,"camera":"gate"}`))
+	if _, abort := waitForCameraAnalysis(t, m.controller, "gate"); abort {
+		return
+	}
+
+	// the oldest alert is discarded when the queue is full
+	for timestamp := 2; timestamp <= 4; timestamp++ {
+		m.controller.MQTTHandler(nil, newMockMQTTMessage(fmt.Sprintf(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":%d,"camera":"gate"}`, timestamp)))
+	}
+	state, abort := waitForPendingState(t, m.controller, "gate", func(state pendingState) bool { return state.PendingCount == 2 })
+	if abort {
+		return
+	}
+	if state.Timestamp != 1 || !state.EventsPaused {
+		t.Errorf("expected camera gate to be paused on the alert at 1 but got %d (paused %t)", state.Timestamp, state.EventsPaused)
+	}
+	if state.PendingDropped != 1 || len(state.PendingAlerts) != 2 || state.PendingAlerts[0].Timestamp != 3 || state.PendingAlerts[1].Timestamp != 4 {
+		t.Errorf("expected alerts at 3 and 4 to be pending with 1 dropped but got %+v", state)
+	}
+	if !waitForSSEEvent(m, "pending_count", `{"camera":"gate","count":2,"dropped":1}`) {
+		t.Error("expected pending_count event with 2 alerts")
+	}
+
+	m.controller.ResumeEvents("gate")
+	state, abort = waitForPendingState(t, m.controller, "gate", func(state pendingState) bool {
+		return state.Timestamp == 3 && state.EventsPaused && state.PendingCount == 1
+	})
+	if abort {
+		return
+	}
+	if state.PendingAlerts[0].Timestamp != 4 {
+		t.Errorf("expected alert at 4 to be pending but got %d", state.PendingAlerts[0].Timestamp)
+	}
+	if !waitForSSEEvent(m, "pending_count", `{"camera":"gate","count":1,"dropped":1}`) {
+		t.Error("expected pending_count event with 1 alert")
+	}
+}
+
+// Test that alerts are discarded while paused if the queue is disabled
+func TestPendingAlertsDisabled(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+	m.controller.SetMaxPendingAlerts(0)
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1,"camera":"gate"}`))
+	if _, abort := waitForCameraAnalysis(t, m.controller, "gate"); abort {
+		return
+	}
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":2,"camera":"gate"}`))
+	time.Sleep(500 * time.Millisecond)
+	state, abort := waitForPendingState(t, m.controller, "gate", func(pendingState) bool { return true })
+	if abort {
+		return
+	}
+	if state.PendingCount != 0 || state.Timestamp != 1 {
+		t.Errorf("expected alert at 2 to be discarded but got %+v", state)
+	}
+}
+
+// returns true if subsequent tests should be aborted
+func waitForPendingState(t *testing.T, controller *internal.AlertsController, camera string, condition func(pendingState) bool) (pendingState, bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	var state pendingState
+	for time.Now().Before(deadline) {
+		req := httptest.NewRequest(http.MethodGet, "/api/currentstate?camera="+camera, nil)
+		w := httptest.NewRecorder()
+		controller.CurrentStateHandler(w, req)
+		if w.Code == http.StatusOK {
+			state = pendingState{}
+			if err := json.NewDecoder(w.Body).Decode(&state); err != nil {
+				t.Errorf("error decoding current state: %v", err)
+				return state, true
+			}
+			if condition(state) {
+				return state, false
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("timed out waiting for the pending alerts of camera %s - last state was %+v", camera, state)
+	return state, true
+}
+
+func waitForSSEEvent(m *mocks, eventType, substring string) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if m.sseEventExists(eventType, substring) {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
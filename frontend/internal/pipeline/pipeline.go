@@ -0,0 +1,206 @@
+package pipeline
+
+// A Pipeline is the chain of LLM requests that is made for every alert. Each
+// stage sends a prompt to a backend together with either the alert's image
+// or the output of a previous stage. Pipelines can be defined in a YAML or
+// JSON file:
+//
+//	backends:
+//	  llava:
+//	    type: ollama
+//	    url: http://localhost:11434/api/generate
+//	    model: llava
+//	stages:
+//	- name: image_analysis
+//	  backend: llava
+//	  input: image
+//	  prompt: "{{.Prompt}}"
+//	- name: threat_analysis
+//	  backend: llava
+//	  input: image_analysis
+//	  prompt: Reply with the level of threat, either low, medium or high.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/llm"
+	"gopkg.in/yaml.v3"
+)
+
+// Use this as a stage's input to send the alert's image to the backend
+const InputImage = "image"
+
+// The outputs of the stages with these names are displayed in the web UI as
+// the image analysis and the threat analysis
+const ImageAnalysisStage = "image_analysis"
+const ThreatAnalysisStage = "threat_analysis"
+
+const defaultImagePrompt = "{{.Prompt}}"
+
+type Pipeline struct {
+	Backends map[string]BackendConfig `yaml:"backends"`
+	Stages   []*Stage                 `yaml:"stages"`
+}
+
+type BackendConfig struct {
+	Type      string `yaml:"type"`
+	URL       string `yaml:"url"`
+	Model     string `yaml:"model"`
+	KeepAlive string `yaml:"keep_alive"`
+}
+
+type Stage struct {
+	Name    string `yaml:"name"`
+	Backend string `yaml:"backend"`
+	Input   string `yaml:"input"`  // image, or the name of a previous stage
+	Prompt  string `yaml:"prompt"` // text/template that is executed with TemplateData
+	Events  Events `yaml:"events"`
+
+	template *template.Template
+	backend  llm.Backend
+}
+
+// Names of the SSE events sent when the stage's response starts streaming,
+// for each token, and when the response is complete
+type Events struct {
+	Start string `yaml:"start"`
+	Token string `yaml:"token"`
+	Stop  string `yaml:"stop"`
+}
+
+type TemplateData struct {
+	Prompt  string            // the descriptive prompt selected by the user
+	Input   string            // output of the input stage - empty for image stages
+	Outputs map[string]string // outputs of the previous stages keyed by stage name
+}
+
+// RecorderFunc returns the io.Writer that raw responses from backends of the
+// given type should be saved to - it may return nil
+type RecorderFunc func(backendType string) io.Writer
+
+func Load(filename string, recorder RecorderFunc) (*Pipeline, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error trying to open pipeline file %s: %w", filename, err)
+	}
+	defer f.Close()
+	return Parse(f, recorder)
+}
+
+// Parse accepts YAML or JSON
+func Parse(r io.Reader, recorder RecorderFunc) (*Pipeline, error) {
+	var p Pipeline
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("error decoding pipeline: %w", err)
+	}
+	if err := p.Init(recorder); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Init validates the pipeline, parses the prompt templates and creates the
+// backends - this must be called before the pipeline is used if the Pipeline
+// was not created by Load or Parse
+func (p *Pipeline) Init(recorder RecorderFunc) error {
+	if len(p.Stages) == 0 {
+		return errors.New("pipeline does not have any stages")
+	}
+	backends := make(map[string]llm.Backend)
+	for name, config := range p.Backends {
+		llmConfig := llm.Config{
+			Type:      config.Type,
+			URL:       config.URL,
+			Model:     config.Model,
+			KeepAlive: config.KeepAlive,
+		}
+		if recorder != nil {
+			llmConfig.Recorder = recorder(config.Type)
+		}
+		backend, err := llm.NewBackend(llmConfig)
+		if err != nil {
+			return fmt.Errorf("error creating backend %s: %w", name, err)
+		}
+		backends[name] = backend
+	}
+
+	seen := make(map[string]bool)
+	for i, stage := range p.Stages {
+		if stage.Name == "" {
+			return fmt.Errorf("stage %d does not have a name", i)
+		}
+		if seen[stage.Name] {
+			return fmt.Errorf("stage name %s is used more than once", stage.Name)
+		}
+		if stage.Name == InputImage {
+			return fmt.Errorf("stage name cannot be %s", InputImage)
+		}
+		backend, ok := backends[stage.Backend]
+		if !ok {
+			return fmt.Errorf("stage %s refers to backend %s which does not exist", stage.Name, stage.Backend)
+		}
+		stage.backend = backend
+		if stage.Input == "" {
+			stage.Input = InputImage
+		}
+		if stage.Input != InputImage && !seen[stage.Input] {
+			return fmt.Errorf("input of stage %s must be %s or the name of a previous stage - got %s", stage.Name, InputImage, stage.Input)
+		}
+		if stage.Prompt == "" {
+			if stage.Input != InputImage {
+				return fmt.Errorf("stage %s does not have a prompt", stage.Name)
+			}
+			stage.Prompt = defaultImagePrompt
+		}
+		tmpl, err := template.New(stage.Name).Option("missingkey=error").Parse(stage.Prompt)
+		if err != nil {
+			return fmt.Errorf("error parsing prompt template for stage %s: %w", stage.Name, err)
+		}
+		stage.template = tmpl
+		stage.Events.setDefaults(stage.Name)
+		seen[stage.Name] = true
+	}
+	return nil
+}
+
+// Execute renders the prompt and sends it to the backend. outputs contains
+// the outputs of the previous stages.
+// opts are the overrides that come with the selected prompt - they only apply
+// to stages that analyze the image.
+func (stage *Stage) Execute(ctx context.Context, image, prompt string, opts llm.Options, outputs map[string]string, onToken llm.TokenFunc) (string, error) {
+	data := TemplateData{
+		Prompt:  prompt,
+		Outputs: outputs,
+	}
+	if stage.Input != InputImage {
+		data.Input = outputs[stage.Input]
+	}
+	var rendered strings.Builder
+	if err := stage.template.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("error rendering prompt for stage %s: %w", stage.Name, err)
+	}
+	if stage.Input == InputImage {
+		return stage.backend.AnalyzeImage(ctx, rendered.String(), image, opts, onToken)
+	}
+	return stage.backend.Classify(ctx, rendered.String(), data.Input, llm.Options{}, onToken)
+}
+
+func (events *Events) setDefaults(stageName string) {
+	if events.Token == "" {
+		events.Token = stageName + "_response"
+	}
+	if events.Start == "" {
+		events.Start = events.Token + "_start"
+	}
+	if events.Stop == "" {
+		events.Stop = events.Token + "_stop"
+	}
+}
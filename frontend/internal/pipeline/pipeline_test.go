@@ -0,0 +1,162 @@
+package pipeline_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/llm"
+	"github.com/kwkoo/threat-detection-frontend/internal/pipeline"
+)
+
+const threeStagePipeline = `
+backends:
+  mock:
+    type: mock
+stages:
+- name: image_analysis
+  backend: mock
+- name: threat_analysis
+  backend: mock
+  input: image_analysis
+  prompt: Reply with the level of threat
+  events:
+    token: openai_response
+- name: recommended_action
+  backend: mock
+  input: threat_analysis
+  prompt: "The image was described as: {{.Outputs.image_analysis}}. Recommend an action"
+`
+
+func TestParse(t *testing.T) {
+	p, err := pipeline.Parse(strings.NewReader(threeStagePipeline), nil)
+	if err != nil {
+		t.Errorf("could not parse pipeline: %v", err)
+		return
+	}
+	if len(p.Stages) != 3 {
+		t.Errorf("expected 3 stages but got %d", len(p.Stages))
+		return
+	}
+
+	// default events
+	if events := p.Stages[0].Events; events.Start != "image_analysis_response_start" || events.Token != "image_analysis_response" || events.Stop != "image_analysis_response_stop" {
+		t.Errorf("unexpected default events %v", events)
+	}
+	if events := p.Stages[1].Events; events.Start != "openai_response_start" || events.Token != "openai_response" || events.Stop != "openai_response_stop" {
+		t.Errorf("unexpected events %v", events)
+	}
+	if p.Stages[0].Input != pipeline.InputImage {
+		t.Errorf("expected input of first stage to default to %s but got %s", pipeline.InputImage, p.Stages[0].Input)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	const input = `{"backends":{"mock":{"type":"mock"}},"stages":[{"name":"image_analysis","backend":"mock","input":"image"}]}`
+	if _, err := pipeline.Parse(strings.NewReader(input), nil); err != nil {
+		t.Errorf("could not parse JSON pipeline: %v", err)
+	}
+}
+
+func TestInvalidPipelines(t *testing.T) {
+	tests := map[string]string{
+		"no stages": `
+backends:
+  mock:
+    type: mock`,
+		"unknown backend": `
+stages:
+- name: image_analysis
+  backend: dummy`,
+		"unknown backend type": `
+backends:
+  dummy:
+    type: dummy
+stages:
+- name: image_analysis
+  backend: dummy`,
+		"input from later stage": `
+backends:
+  mock:
+    type: mock
+stages:
+- name: threat_analysis
+  backend: mock
+  input: image_analysis
+  prompt: classify
+- name: image_analysis
+  backend: mock`,
+		"missing prompt": `
+backends:
+  mock:
+    type: mock
+stages:
+- name: image_analysis
+  backend: mock
+- name: threat_analysis
+  backend: mock
+  input: image_analysis`,
+		"invalid template": `
+backends:
+  mock:
+    type: mock
+stages:
+- name: image_analysis
+  backend: mock
+  prompt: "{{.Prompt"`,
+		"unknown field": `
+backends:
+  mock:
+    type: mock
+stages:
+- name: image_analysis
+  backend: mock
+  dummy: true`,
+	}
+	for name, input := range tests {
+		if _, err := pipeline.Parse(strings.NewReader(input), nil); err == nil {
+			t.Errorf("%s: expected an error but did not get one", name)
+		} else {
+			t.Logf("%s: got an expected error: %v", name, err)
+		}
+	}
+}
+
+// Test that each stage gets the output of its input stage
+func TestExecute(t *testing.T) {
+	p, err := pipeline.Parse(strings.NewReader(threeStagePipeline), nil)
+	if err != nil {
+		t.Errorf("could not parse pipeline: %v", err)
+		return
+	}
+	outputs := make(map[string]string)
+	for _, stage := range p.Stages {
+		output, err := stage.Execute(context.Background(), "image", "describe the image", llm.Options{}, outputs, func(string) {})
+		if err != nil {
+			t.Errorf("error executing stage %s: %v", stage.Name, err)
+			return
+		}
+		if output == "" {
+			t.Errorf("stage %s did not return any output", stage.Name)
+		}
+		outputs[stage.Name] = output
+	}
+
+	// the prompt refers to an output that does not exist
+	const missingOutput = `
+backends:
+  mock:
+    type: mock
+stages:
+- name: image_analysis
+  backend: mock
+  prompt: "{{.Outputs.dummy}}"`
+	p, err = pipeline.Parse(strings.NewReader(missingOutput), nil)
+	if err != nil {
+		t.Errorf("could not parse pipeline: %v", err)
+		return
+	}
+	if _, err := p.Stages[0].Execute(context.Background(), "image", "prompt", llm.Options{}, map[string]string{}, func(string) {}); err == nil {
+		t.Error("expected an error when the prompt template refers to a missing output")
+	}
+}
@@ -0,0 +1,97 @@
+package prompts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ListHandler returns every prompt with all of its fields
+func (prompts *PromptsContainer) ListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prompts.ListPromptItems())
+}
+
+// ItemHandler gets, creates (POST), replaces (PUT) or deletes a single
+// prompt. It expects the URL path to be stripped down to the prompt ID.
+func (prompts *PromptsContainer) ItemHandler(w http.ResponseWriter, r *http.Request) {
+	id := ID(strings.Trim(r.URL.Path, "/"))
+	if id == "" {
+		http.Error(w, "prompt ID missing", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		item, err := prompts.GetPromptItem(id)
+		if err != nil {
+			writeError(w, id, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(item)
+
+	case http.MethodPost, http.MethodPut:
+		var item PromptItem
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&item); err != nil {
+			http.Error(w, fmt.Sprintf("error decoding prompt: %v", err), http.StatusBadRequest)
+			return
+		}
+		if item.ID != "" && item.ID != id {
+			http.Error(w, fmt.Sprintf("prompt ID %s in the request body does not match %s in the URL", item.ID, id), http.StatusBadRequest)
+			return
+		}
+		item.ID = id
+		var saved *PromptItem
+		var err error
+		status := http.StatusOK
+		if r.Method == http.MethodPost {
+			saved, err = prompts.AddPrompt(item)
+			status = http.StatusCreated
+		} else {
+			saved, err = prompts.UpdatePrompt(item)
+		}
+		if err != nil {
+			writeError(w, id, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(saved)
+
+	case http.MethodDelete:
+		if err := prompts.DeletePrompt(id); err != nil {
+			writeError(w, id, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeError(w http.ResponseWriter, id ID, err error) {
+	switch {
+	case errors.Is(err, ErrPromptNotFound):
+		http.Error(w, fmt.Sprintf("prompt %s not found", id), http.StatusNotFound)
+	case errors.Is(err, ErrPromptExists):
+		http.Error(w, fmt.Sprintf("prompt %s already exists", id), http.StatusConflict)
+	case errors.Is(err, ErrPromptSelected):
+		http.Error(w, fmt.Sprintf("prompt %s cannot be deleted because it is currently selected", id), http.StatusConflict)
+	case errors.Is(err, ErrInvalidPrompt):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("error changing prompt %s: %v", id, err)
+		http.Error(w, fmt.Sprintf("error changing prompt %s: %v", id, err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,120 @@
+package prompts_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/prompts"
+)
+
+// Test that prompts can be added, changed and deleted, and that the changes
+// are saved to the prompts file
+func TestPromptsCRUD(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "prompts.txt")
+	if err := os.WriteFile(filename, []byte("line0|the\nline1\n"), 0644); err != nil {
+		t.Errorf("could not create prompts file: %v", err)
+		return
+	}
+	container, err := prompts.NewPromptsContainerFromFile(filename)
+	if err != nil {
+		t.Errorf("could not instantiate PromptsContainer: %v", err)
+		return
+	}
+
+	tests := []struct {
+		method         string
+		id             string
+		body           string
+		expectedStatus int
+	}{
+		{http.MethodPost, "weapons", `{"short":"Weapons","descriptive":"Is anyone holding a weapon?","tags":["people"]}`, http.StatusCreated},
+		{http.MethodPost, "weapons", `{"short":"Weapons"}`, http.StatusConflict},
+		{http.MethodPost, "empty", `{"short":" "}`, http.StatusBadRequest},
+		{http.MethodPost, "mismatch", `{"id":"other","short":"Other"}`, http.StatusBadRequest},
+		{http.MethodPost, "unknown", `{"short":"Unknown","colour":"red"}`, http.StatusBadRequest},
+		{http.MethodPut, "1", `{"short":"line1 changed","default":true}`, http.StatusOK},
+		{http.MethodPut, "99", `{"short":"does not exist"}`, http.StatusNotFound},
+		{http.MethodGet, "weapons", ``, http.StatusOK},
+		{http.MethodDelete, "0", ``, http.StatusConflict}, // currently selected
+		{http.MethodDelete, "99", ``, http.StatusNotFound},
+		{http.MethodPatch, "1", ``, http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/"+test.id, strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		container.ItemHandler(w, req)
+		if w.Code != test.expectedStatus {
+			t.Errorf("expected status code %d for %s %s but got %d: %s", test.expectedStatus, test.method, test.id, w.Code, w.Body.String())
+		}
+	}
+
+	if abort := setPromptAndCheckError(t, container, "weapons", false); abort {
+		return
+	}
+	req := httptest.NewRequest(http.MethodDelete, "/0", nil)
+	w := httptest.NewRecorder()
+	container.ItemHandler(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status code %d after deleting prompt 0 but got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	// the IDs of the legacy prompts are kept when the file is converted
+	reloaded, err := prompts.NewPromptsContainerFromFile(filename)
+	if err != nil {
+		t.Errorf("could not reload prompts file: %v", err)
+		return
+	}
+	list := reloaded.ListPromptItems()
+	if len(list) != 2 {
+		t.Errorf("expected 2 prompts after reloading but got %d", len(list))
+		return
+	}
+	if list[0].ID != "1" || list[0].Short != "line1 changed" || !list[0].Default {
+		t.Errorf("unexpected first prompt after reloading: %v", list[0])
+	}
+	if list[1].ID != "weapons" || list[1].Descriptive != "Is anyone holding a weapon?" || len(list[1].Tags) != 1 {
+		t.Errorf("unexpected second prompt after reloading: %v", list[1])
+	}
+	// the default prompt is selected after reloading
+	checkSelectedPromptItem(t, reloaded, "1", "line1 changed", "line1 changed")
+
+	req = httptest.NewRequest(http.MethodGet, "/api/prompts", nil)
+	w = httptest.NewRecorder()
+	reloaded.ListHandler(w, req)
+	var listed []prompts.PromptItem
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Errorf("error decoding prompts list: %v", err)
+		return
+	}
+	if len(listed) != 2 {
+		t.Errorf("expected 2 prompts to be listed but got %d", len(listed))
+	}
+}
+
+// Test that nothing is changed if the prompts file cannot be written
+func TestPromptsSaveFailure(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "prompts.yaml")
+	if err := os.WriteFile(filename, []byte("prompts:\n- id: a\n  short: first\n"), 0644); err != nil {
+		t.Errorf("could not create prompts file: %v", err)
+		return
+	}
+	container, err := prompts.NewPromptsContainerFromFile(filename)
+	if err != nil {
+		t.Errorf("could not instantiate PromptsContainer: %v", err)
+		return
+	}
+	os.RemoveAll(dir)
+
+	if _, err := container.AddPrompt(prompts.PromptItem{ID: "b", Short: "second"}); err == nil {
+		t.Error("expected an error adding a prompt when the prompts file cannot be written")
+	}
+	if _, err := container.GetPromptItem("b"); err != prompts.ErrPromptNotFound {
+		t.Errorf("expected prompt not to be added but got %v", err)
+	}
+}
@@ -1,35 +1,111 @@
 package prompts
 
+// Prompts can be loaded from a YAML or JSON file with explicit IDs (see
+// promptsFile), or from the legacy format with one short|descriptive prompt
+// per line. Prompts in the legacy format are numbered in the order they
+// appear in the file.
+
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"text/template"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/llm"
+	"gopkg.in/yaml.v3"
 )
 
+var ErrPromptNotFound = errors.New("prompt not found")
+var ErrPromptExists = errors.New("prompt already exists")
+var ErrPromptSelected = errors.New("prompt is currently selected")
+var ErrInvalidPrompt = errors.New("invalid prompt")
+
 type PromptsContainer struct {
 	mux            sync.RWMutex
-	selectedPrompt int
-	promptsMap     map[int]PromptItem
+	selectedPrompt ID
+	promptsMap     map[ID]PromptItem
 	promptsList    []PromptItem
+	file           string            // changes are saved to this file - changes are only kept in memory if this is empty
+	checksum       [sha256.Size]byte // checksum of the file contents that were last loaded or saved
+}
+
+// ID identifies a prompt. IDs can be strings or integers in the prompts file
+// and in API requests - IDs that are integers are encoded as JSON numbers so
+// that clients that expect numeric IDs keep working.
+type ID string
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	if n, err := strconv.Atoi(string(id)); err == nil && strconv.Itoa(n) == string(id) {
+		return []byte(string(id)), nil
+	}
+	return json.Marshal(string(id))
+}
+
+func (id *ID) UnmarshalJSON(b []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err == nil {
+		*id = ID(n.String())
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("prompt ID must be a string or a number: %s", b)
+	}
+	*id = ID(s)
+	return nil
+}
+
+func (id *ID) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: prompt ID must be a string or a number", value.Line)
+	}
+	*id = ID(value.Value)
+	return nil
 }
 
 type PromptItem struct {
-	ID          int    `json:"id"`
-	Short       string `json:"short"`
-	Descriptive string `json:"descriptive"`
+	ID          ID               `json:"id" yaml:"id"`
+	Short       string           `json:"short" yaml:"short"`
+	Descriptive string           `json:"descriptive" yaml:"descriptive"`
+	Tags        []string         `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Default     bool             `json:"default,omitempty" yaml:"default,omitempty"` // selected when the frontend starts
+	System      string           `json:"system,omitempty" yaml:"system,omitempty"`   // system prompt sent with the image analysis
+	Model       string           `json:"model,omitempty" yaml:"model,omitempty"`     // overrides the model used for the image analysis
+	Options     *SamplingOptions `json:"options,omitempty" yaml:"options,omitempty"`
+
+	template *template.Template // parsed from Descriptive
+	legacy   bool               // read from a line in the legacy format
+}
+
+// Sampling parameters for the image analysis - parameters that are not set
+// are left to the backend
+type SamplingOptions struct {
+	Temperature *float64 `json:"temperature,omitempty" yaml:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty" yaml:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty" yaml:"top_k,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty" yaml:"max_tokens,omitempty"`
+	Seed        *int     `json:"seed,omitempty" yaml:"seed,omitempty"`
+}
+
+// structure of the YAML or JSON prompts file
+type promptsFile struct {
+	Prompts []PromptItem `json:"prompts" yaml:"prompts"`
 }
 
 func (item PromptItem) GetJSONBytes() []byte {
 	var b bytes.Buffer
 	event := struct {
-		ID     int    `json:"id"`
+		ID     ID     `json:"id"`
 		Prompt string `json:"prompt"`
 	}{
 		ID:     item.ID,
@@ -39,64 +115,102 @@ func (item PromptItem) GetJSONBytes() []byte {
 	return b.Bytes()
 }
 
+// LLMOptions returns the overrides that should be sent with the image
+// analysis
+func (item PromptItem) LLMOptions() llm.Options {
+	opts := llm.Options{
+		System: item.System,
+		Model:  item.Model,
+	}
+	if item.Options != nil {
+		opts.Temperature = item.Options.Temperature
+		opts.TopP = item.Options.TopP
+		opts.TopK = item.Options.TopK
+		opts.MaxTokens = item.Options.MaxTokens
+		opts.Seed = item.Options.Seed
+	}
+	return opts
+}
+
 func NewPromptsContainerFromFile(promptsFile string) (*PromptsContainer, error) {
 	if promptsFile == "" {
 		log.Print("no prompts file provided - will use hardcoded prompts")
 		prompts := PromptsContainer{
-			promptsMap: make(map[int]PromptItem),
+			promptsMap: make(map[ID]PromptItem),
 		}
 		prompts.addPromptFromLine("Please describe this image")
 		prompts.addPromptFromLine("Is this person a threat?")
+		prompts.selectedPrompt = prompts.promptsList[0].ID
 		return &prompts, nil
 	}
 
-	f, err := os.Open(promptsFile)
+	b, err := os.ReadFile(promptsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error trying to read prompts file %s: %w", promptsFile, err)
+	}
+	prompts, err := NewPromptsContainer(bytes.NewReader(b))
 	if err != nil {
-		return nil, fmt.Errorf("error trying to open prompts file %s: %w", promptsFile, err)
+		return nil, err
 	}
-	defer f.Close()
-	return NewPromptsContainer(f)
+	prompts.file = promptsFile
+	prompts.checksum = sha256.Sum256(b)
+	return prompts, nil
 }
 
+// NewPromptsContainer reads prompts in the YAML or JSON format if the input
+// is a document with a top-level prompts key, or in the legacy format
+// otherwise.
 func NewPromptsContainer(r io.Reader) (*PromptsContainer, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading prompts from stream: %w", err)
+	}
 	prompts := PromptsContainer{
-		promptsMap: make(map[int]PromptItem),
+		promptsMap: make(map[ID]PromptItem),
+	}
+	if isPromptsFile(b) {
+		err = prompts.addPromptsFromFile(b)
+	} else {
+		err = prompts.addPromptsFromLines(b)
 	}
-	lines, err := readLinesFromStream(r)
 	if err != nil {
 		return nil, err
 	}
-	for _, line := range lines {
-		if err := prompts.addPromptFromLine(line); err != nil {
-			return nil, err
-		}
-	}
 	if len(prompts.promptsMap) == 0 {
 		return nil, errors.New("did not add any prompts")
 	}
+	prompts.selectedPrompt = prompts.promptsList[0].ID
+	for _, item := range prompts.promptsList {
+		if item.Default {
+			prompts.selectedPrompt = item.ID
+		}
+	}
 	return &prompts, nil
 }
 
 func (prompts *PromptsContainer) StreamShortPrompts(w io.Writer) error {
 	type shortPrompt struct {
-		ID     int    `json:"id"`
-		Prompt string `json:"prompt"`
+		ID     ID       `json:"id"`
+		Prompt string   `json:"prompt"`
+		Tags   []string `json:"tags,omitempty"`
 	}
+	prompts.mux.RLock()
 	shortList := make([]shortPrompt, len(prompts.promptsList))
 	for i, item := range prompts.promptsList {
-		shortList[i] = shortPrompt{ID: item.ID, Prompt: item.Short}
+		shortList[i] = shortPrompt{ID: item.ID, Prompt: item.Short, Tags: item.Tags}
 	}
+	prompts.mux.RUnlock()
 	if err := json.NewEncoder(w).Encode(shortList); err != nil {
 		return fmt.Errorf("error streaming short prompts: %w", err)
 	}
 	return nil
 }
 
-func (prompts *PromptsContainer) SetSelectedPrompt(id int) error {
+func (prompts *PromptsContainer) SetSelectedPrompt(id ID) error {
 	prompts.mux.Lock()
 	defer prompts.mux.Unlock()
 	if _, ok := prompts.promptsMap[id]; !ok {
-		return fmt.Errorf("selected prompt ID %d does not exist", id)
+		return fmt.Errorf("selected prompt ID %s does not exist", id)
 	}
 	prompts.selectedPrompt = id
 	return nil
@@ -107,11 +221,63 @@ func (prompts *PromptsContainer) GetSelectedPromptItem() (*PromptItem, error) {
 	defer prompts.mux.RUnlock()
 	p, ok := prompts.promptsMap[prompts.selectedPrompt]
 	if !ok {
-		return nil, fmt.Errorf("currently selected prompt ID is %d - but it does not exist in allPrompts", prompts.selectedPrompt)
+		return nil, fmt.Errorf("currently selected prompt ID is %s - but it does not exist in allPrompts", prompts.selectedPrompt)
 	}
 	return &p, nil
 }
 
+// a document is in the YAML or JSON format if it is a mapping with a prompts
+// key - anything else is treated as the legacy format
+func isPromptsFile(b []byte) bool {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return false
+	}
+	_, ok := doc["prompts"]
+	return ok
+}
+
+func (prompts *PromptsContainer) addPromptsFromFile(b []byte) error {
+	var file promptsFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return fmt.Errorf("error decoding prompts: %w", err)
+	}
+	defaultID := ID("")
+	for i, item := range file.Prompts {
+		p, err := newPromptItem(item)
+		if err != nil {
+			return fmt.Errorf("prompt %d: %w", i, err)
+		}
+		if _, ok := prompts.promptsMap[p.ID]; ok {
+			return fmt.Errorf("prompt %d: duplicate prompt ID %s", i, p.ID)
+		}
+		if p.Default {
+			if defaultID != "" {
+				return fmt.Errorf("prompt %d: prompts %s and %s are both set as the default", i, defaultID, p.ID)
+			}
+			defaultID = p.ID
+		}
+		prompts.promptsMap[p.ID] = *p
+		prompts.promptsList = append(prompts.promptsList, *p)
+	}
+	return nil
+}
+
+func (prompts *PromptsContainer) addPromptsFromLines(b []byte) error {
+	lines, err := readLinesFromStream(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if err := prompts.addPromptFromLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (prompts *PromptsContainer) addPromptFromLine(line string) error {
 	line = strings.TrimSpace(line)
 	if line == "" {
@@ -127,7 +293,12 @@ func (prompts *PromptsContainer) addPromptFromLine(line string) error {
 	if len(parts) > 1 {
 		descriptive = parts[1]
 	}
-	p, err := newPromptItem(len(prompts.promptsMap), parts[0], descriptive)
+	p, err := newPromptItem(PromptItem{
+		ID:          ID(strconv.Itoa(len(prompts.promptsMap))),
+		Short:       parts[0],
+		Descriptive: descriptive,
+		legacy:      true,
+	})
 	if err != nil {
 		return err
 	}
@@ -136,16 +307,53 @@ func (prompts *PromptsContainer) addPromptFromLine(line string) error {
 	return nil
 }
 
-func newPromptItem(id int, short, descriptive string) (*PromptItem, error) {
-	short = strings.TrimSpace(short)
-	descriptive = strings.TrimSpace(descriptive)
-	if short == "" {
+// validates the prompt and fills in the defaults
+func newPromptItem(item PromptItem) (*PromptItem, error) {
+	item.ID = ID(strings.TrimSpace(string(item.ID)))
+	item.Short = strings.TrimSpace(item.Short)
+	item.Descriptive = strings.TrimSpace(item.Descriptive)
+	item.System = strings.TrimSpace(item.System)
+	item.Model = strings.TrimSpace(item.Model)
+	if item.ID == "" {
+		return nil, errors.New("prompt ID is not set")
+	}
+	if item.Short == "" {
 		return nil, errors.New("short prompt is not set")
 	}
-	if descriptive == "" {
-		descriptive = short
+	if item.Descriptive == "" {
+		item.Descriptive = item.Short
+	}
+	// legacy prompts were written before templates were supported and may
+	// contain a literal {{
+	if !item.legacy || hasTemplateActions(item.Descriptive) {
+		tmpl, err := parsePromptTemplate(item.ID, item.Descriptive)
+		if err != nil {
+			return nil, err
+		}
+		item.template = tmpl
+	}
+	var tags []string
+	for _, tag := range item.Tags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
 	}
-	return &PromptItem{ID: id, Short: short, Descriptive: descriptive}, nil
+	item.Tags = tags
+	if opts := item.Options; opts != nil {
+		if opts.Temperature != nil && *opts.Temperature < 0 {
+			return nil, fmt.Errorf("temperature of prompt %s cannot be negative", item.ID)
+		}
+		if opts.TopP != nil && (*opts.TopP <= 0 || *opts.TopP > 1) {
+			return nil, fmt.Errorf("top_p of prompt %s must be greater than 0 and at most 1", item.ID)
+		}
+		if opts.TopK != nil && *opts.TopK < 1 {
+			return nil, fmt.Errorf("top_k of prompt %s must be at least 1", item.ID)
+		}
+		if opts.MaxTokens != nil && *opts.MaxTokens < 1 {
+			return nil, fmt.Errorf("max_tokens of prompt %s must be at least 1", item.ID)
+		}
+	}
+	return &item, nil
 }
 
 func readLinesFromStream(r io.Reader) ([]string, error) {
@@ -159,3 +367,171 @@ func readLinesFromStream(r io.Reader) ([]string, error) {
 	}
 	return lines, nil
 }
+
+// GetPromptItem returns ErrPromptNotFound if the prompt does not exist
+func (prompts *PromptsContainer) GetPromptItem(id ID) (*PromptItem, error) {
+	prompts.mux.RLock()
+	defer prompts.mux.RUnlock()
+	p, ok := prompts.promptsMap[id]
+	if !ok {
+		return nil, ErrPromptNotFound
+	}
+	return &p, nil
+}
+
+// ListPromptItems returns every prompt in the order they appear in the
+// prompts file
+func (prompts *PromptsContainer) ListPromptItems() []PromptItem {
+	prompts.mux.RLock()
+	defer prompts.mux.RUnlock()
+	list := make([]PromptItem, len(prompts.promptsList))
+	copy(list, prompts.promptsList)
+	return list
+}
+
+// AddPrompt validates the prompt and appends it to the list of prompts.
+// ErrPromptExists is returned if a prompt with the same ID exists.
+func (prompts *PromptsContainer) AddPrompt(item PromptItem) (*PromptItem, error) {
+	p, err := newPromptItem(item)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPrompt, err)
+	}
+	prompts.mux.Lock()
+	defer prompts.mux.Unlock()
+	if _, ok := prompts.promptsMap[p.ID]; ok {
+		return nil, ErrPromptExists
+	}
+	list := append(prompts.copyList(p.Default), *p)
+	if err := prompts.replaceList(list); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// UpdatePrompt replaces the prompt with the same ID.
+func (prompts *PromptsContainer) UpdatePrompt(item PromptItem) (*PromptItem, error) {
+	p, err := newPromptItem(item)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPrompt, err)
+	}
+	prompts.mux.Lock()
+	defer prompts.mux.Unlock()
+	if _, ok := prompts.promptsMap[p.ID]; !ok {
+		return nil, ErrPromptNotFound
+	}
+	list := prompts.copyList(p.Default)
+	for i := range list {
+		if list[i].ID == p.ID {
+			list[i] = *p
+		}
+	}
+	if err := prompts.replaceList(list); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DeletePrompt refuses to delete the prompt that is currently selected
+// (ErrPromptSelected).
+func (prompts *PromptsContainer) DeletePrompt(id ID) error {
+	prompts.mux.Lock()
+	defer prompts.mux.Unlock()
+	if _, ok := prompts.promptsMap[id]; !ok {
+		return ErrPromptNotFound
+	}
+	if id == prompts.selectedPrompt {
+		return ErrPromptSelected
+	}
+	var list []PromptItem
+	for _, item := range prompts.promptsList {
+		if item.ID != id {
+			list = append(list, item)
+		}
+	}
+	return prompts.replaceList(list)
+}
+
+// returns a copy of the list of prompts - the default flag is cleared from
+// every prompt if clearDefault is set because only one prompt can be the
+// default
+// the caller must hold the lock
+func (prompts *PromptsContainer) copyList(clearDefault bool) []PromptItem {
+	list := make([]PromptItem, len(prompts.promptsList), len(prompts.promptsList)+1)
+	copy(list, prompts.promptsList)
+	if clearDefault {
+		for i := range list {
+			list[i].Default = false
+		}
+	}
+	return list
+}
+
+// saves the list of prompts to the prompts file and replaces the prompts in
+// memory - nothing is changed if the file cannot be saved
+// the caller must hold the write lock
+func (prompts *PromptsContainer) replaceList(list []PromptItem) error {
+	if err := prompts.save(list); err != nil {
+		return err
+	}
+	m := make(map[ID]PromptItem)
+	for _, item := range list {
+		m[item.ID] = item
+	}
+	prompts.promptsList = list
+	prompts.promptsMap = m
+	return nil
+}
+
+// Prompts are always saved in the YAML format (or JSON if the file has a
+// .json extension), so a prompts file in the legacy format is converted when
+// it is first changed - a literal {{ in a legacy prompt is escaped so that
+// the prompt is still valid once it is read back as a template. The file is
+// written to a temporary file first so that a crash never leaves a partially
+// written prompts file behind.
+func (prompts *PromptsContainer) save(list []PromptItem) error {
+	if prompts.file == "" {
+		return nil
+	}
+	saved := make([]PromptItem, len(list))
+	for i, item := range list {
+		if item.legacy && item.template == nil {
+			item.Descriptive = strings.ReplaceAll(item.Descriptive, "{{", `{{"{{"}}`)
+		}
+		saved[i] = item
+	}
+	var b []byte
+	var err error
+	if strings.EqualFold(filepath.Ext(prompts.file), ".json") {
+		b, err = json.MarshalIndent(promptsFile{Prompts: saved}, "", "  ")
+	} else {
+		b, err = yaml.Marshal(promptsFile{Prompts: saved})
+	}
+	if err != nil {
+		return fmt.Errorf("error encoding prompts: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(prompts.file), "."+filepath.Base(prompts.file)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for prompts file %s: %w", prompts.file, err)
+	}
+	// CreateTemp creates files that are only readable by the owner
+	if info, err := os.Stat(prompts.file); err == nil {
+		f.Chmod(info.Mode().Perm())
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("error writing prompts file %s: %w", prompts.file, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error closing prompts file %s: %w", prompts.file, err)
+	}
+	if err := os.Rename(f.Name(), prompts.file); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error renaming prompts file %s: %w", prompts.file, err)
+	}
+	prompts.checksum = sha256.Sum256(b)
+	log.Printf("saved %d prompts to %s", len(list), prompts.file)
+	return nil
+}
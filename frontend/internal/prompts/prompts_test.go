@@ -43,21 +43,21 @@ line3`
 	}
 
 	// the first item should currently be selected
-	if abort := checkSelectedPromptItem(t, container, 0, "line0 dummy", "line0 dummy"); abort {
+	if abort := checkSelectedPromptItem(t, container, "0", "line0 dummy", "line0 dummy"); abort {
 		return
 	}
 
 	// set prompt to non-existent ID - we should get an error
-	if abort := setPromptAndCheckError(t, container, 99, true); abort {
+	if abort := setPromptAndCheckError(t, container, "99", true); abort {
 		return
 	}
 
 	// set prompt to 2 - we should not get an error
-	if abort := setPromptAndCheckError(t, container, 2, false); abort {
+	if abort := setPromptAndCheckError(t, container, "2", false); abort {
 		return
 	}
 
-	checkSelectedPromptItem(t, container, 2, "line2 dummy dummy", "line2 dummy dummy")
+	checkSelectedPromptItem(t, container, "2", "line2 dummy dummy", "line2 dummy dummy")
 }
 
 // some prompts have a different descriptive field
@@ -97,38 +97,38 @@ line5|fox`
 	}
 
 	// the first item should currently be selected
-	if abort := checkSelectedPromptItem(t, container, 0, "line0", "the"); abort {
+	if abort := checkSelectedPromptItem(t, container, "0", "line0", "the"); abort {
 		return
 	}
 
 	// set prompt to 1 - we should not get an error
-	if abort := setPromptAndCheckError(t, container, 1, false); abort {
+	if abort := setPromptAndCheckError(t, container, "1", false); abort {
 		return
 	}
 
-	if abort := checkSelectedPromptItem(t, container, 1, "line1", "line1"); abort {
+	if abort := checkSelectedPromptItem(t, container, "1", "line1", "line1"); abort {
 		return
 	}
 
 	// set prompt to 2 - we should not get an error
-	if abort := setPromptAndCheckError(t, container, 2, false); abort {
+	if abort := setPromptAndCheckError(t, container, "2", false); abort {
 		return
 	}
 
-	if abort := checkSelectedPromptItem(t, container, 2, "line2", "quick brown"); abort {
+	if abort := checkSelectedPromptItem(t, container, "2", "line2", "quick brown"); abort {
 		return
 	}
 
 	// set prompt to 4 - we should not get an error
-	if abort := setPromptAndCheckError(t, container, 4, false); abort {
+	if abort := setPromptAndCheckError(t, container, "4", false); abort {
 		return
 	}
 
-	checkSelectedPromptItem(t, container, 4, "line4", "line4")
+	checkSelectedPromptItem(t, container, "4", "line4", "line4")
 }
 
 // returns true if subsequent tests should be aborted
-func checkSelectedPromptItem(t *testing.T, container *prompts.PromptsContainer, expectedID int, expectedShort, expectedDescriptive string) bool {
+func checkSelectedPromptItem(t *testing.T, container *prompts.PromptsContainer, expectedID prompts.ID, expectedShort, expectedDescriptive string) bool {
 	selectedPrompt, err := container.GetSelectedPromptItem()
 	if err != nil {
 		t.Errorf("unexpected error when trying to get selected item: %v", err)
@@ -139,7 +139,7 @@ func checkSelectedPromptItem(t *testing.T, container *prompts.PromptsContainer,
 		return true
 	}
 	if selectedPrompt.ID != expectedID {
-		t.Errorf("expected ID to be %d, instead it was %d", expectedID, selectedPrompt.ID)
+		t.Errorf("expected ID to be %s, instead it was %s", expectedID, selectedPrompt.ID)
 	}
 	if selectedPrompt.Short != expectedShort {
 		t.Errorf(`expected Short to be "%s", instead it was "%s"`, expectedShort, selectedPrompt.Short)
@@ -169,15 +169,126 @@ line5|fox`
 }
 
 // returns true if subsequent tests should be aborted
-func setPromptAndCheckError(t *testing.T, container *prompts.PromptsContainer, id int, errorExpected bool) bool {
+func setPromptAndCheckError(t *testing.T, container *prompts.PromptsContainer, id prompts.ID, errorExpected bool) bool {
 	err := container.SetSelectedPrompt(id)
 	if err != nil && !errorExpected {
-		t.Errorf("got an unexpected error when we tried to set the selected prompt to %d: %v", id, err)
+		t.Errorf("got an unexpected error when we tried to set the selected prompt to %s: %v", id, err)
 		return true
 	}
 	if err == nil && errorExpected {
-		t.Errorf("expected an error when setting selected prompt to %d but did not get any", id)
+		t.Errorf("expected an error when setting selected prompt to %s but did not get any", id)
 		return true
 	}
 	return false
 }
+
+const yamlPrompts = `
+prompts:
+- id: describe
+  short: Describe
+  descriptive: Describe the image in detail
+  tags: [general]
+- id: 7
+  short: Weapons
+  descriptive: Is the person holding a weapon?
+  tags: [people, weapons]
+  default: true
+  system: You are a security guard
+  model: llava:13b
+  options:
+    temperature: 0.2
+    max_tokens: 200
+`
+
+// IDs come from the file so they do not change when prompts are reordered
+func TestYAMLPrompts(t *testing.T) {
+	container, err := prompts.NewPromptsContainer(strings.NewReader(yamlPrompts))
+	if err != nil {
+		t.Errorf("could not instantiate PromptsContainer: %v", err)
+		return
+	}
+
+	// the default prompt should be selected
+	if abort := checkSelectedPromptItem(t, container, "7", "Weapons", "Is the person holding a weapon?"); abort {
+		return
+	}
+	selected, _ := container.GetSelectedPromptItem()
+	opts := selected.LLMOptions()
+	if opts.System != "You are a security guard" || opts.Model != "llava:13b" {
+		t.Errorf("unexpected system prompt or model override: %v", opts)
+	}
+	if opts.Temperature == nil || *opts.Temperature != 0.2 || opts.MaxTokens == nil || *opts.MaxTokens != 200 || opts.TopP != nil {
+		t.Errorf("unexpected sampling options: %v", opts)
+	}
+
+	if abort := setPromptAndCheckError(t, container, "describe", false); abort {
+		return
+	}
+	checkSelectedPromptItem(t, container, "describe", "Describe", "Describe the image in detail")
+
+	// numeric IDs are encoded as numbers and other IDs as strings
+	var buf bytes.Buffer
+	if err := container.StreamShortPrompts(&buf); err != nil {
+		t.Errorf("error streaming short prompts: %v", err)
+		return
+	}
+	expected := `[{"id":"describe","prompt":"Describe","tags":["general"]},{"id":7,"prompt":"Weapons","tags":["people","weapons"]}]`
+	if strings.TrimSpace(buf.String()) != expected {
+		t.Errorf("expected short prompts %s but got %s", expected, buf.String())
+	}
+}
+
+func TestJSONPrompts(t *testing.T) {
+	const input = `{"prompts":[{"id":"a","short":"first"},{"id":2,"short":"second","descriptive":"the second prompt"}]}`
+	container, err := prompts.NewPromptsContainer(strings.NewReader(input))
+	if err != nil {
+		t.Errorf("could not instantiate PromptsContainer: %v", err)
+		return
+	}
+	if abort := checkSelectedPromptItem(t, container, "a", "first", "first"); abort {
+		return
+	}
+	if abort := setPromptAndCheckError(t, container, "2", false); abort {
+		return
+	}
+	checkSelectedPromptItem(t, container, "2", "second", "the second prompt")
+}
+
+func TestInvalidPromptsFile(t *testing.T) {
+	tests := map[string]string{
+		"missing ID":       "prompts:\n- short: first\n",
+		"duplicate ID":     "prompts:\n- id: 1\n  short: first\n- id: 1\n  short: second\n",
+		"two defaults":     "prompts:\n- id: 1\n  short: first\n  default: true\n- id: 2\n  short: second\n  default: true\n",
+		"unknown field":    "prompts:\n- id: 1\n  short: first\n  colour: red\n",
+		"invalid top_p":    "prompts:\n- id: 1\n  short: first\n  options:\n    top_p: 2\n",
+		"no prompts":       "prompts: []\n",
+		"ID is not scalar": "prompts:\n- id: [1]\n  short: first\n",
+	}
+	for name, input := range tests {
+		if _, err := prompts.NewPromptsContainer(strings.NewReader(input)); err == nil {
+			t.Errorf("%s: expected an error but did not get one", name)
+		} else {
+			t.Logf("%s: got an expected error: %v", name, err)
+		}
+	}
+}
+
+func TestPromptIDJSON(t *testing.T) {
+	var decoded struct {
+		IDs []prompts.ID `json:"ids"`
+	}
+	if err := json.Unmarshal([]byte(`{"ids":[1,"2","abc"]}`), &decoded); err != nil {
+		t.Errorf("error decoding prompt IDs: %v", err)
+		return
+	}
+	expected := []prompts.ID{"1", "2", "abc"}
+	for i, id := range decoded.IDs {
+		if id != expected[i] {
+			t.Errorf(`expected ID %d to be "%s" but got "%s"`, i, expected[i], id)
+		}
+	}
+	var id prompts.ID
+	if err := json.Unmarshal([]byte(`true`), &id); err == nil {
+		t.Error("expected an error decoding a boolean prompt ID but did not get one")
+	}
+}
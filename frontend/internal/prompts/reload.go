@@ -0,0 +1,64 @@
+package prompts
+
+// The prompts file can change while the frontend is running - e.g. when the
+// ConfigMap that it is mounted from is updated. Kubernetes updates ConfigMap
+// volumes by swapping a symlink, so the file is compared by its contents
+// instead of its modification time.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// FileChanged returns true if the contents of the prompts file differ from
+// the prompts that were last loaded or saved. It always returns false if the
+// prompts were not loaded from a file.
+func (prompts *PromptsContainer) FileChanged() (bool, error) {
+	if prompts.file == "" {
+		return false, nil
+	}
+	b, err := os.ReadFile(prompts.file)
+	if err != nil {
+		return false, fmt.Errorf("error trying to read prompts file %s: %w", prompts.file, err)
+	}
+	prompts.mux.RLock()
+	defer prompts.mux.RUnlock()
+	return sha256.Sum256(b) != prompts.checksum, nil
+}
+
+// Reload reads the prompts file into a new PromptsContainer. The selected
+// prompt is carried over if its ID still exists - otherwise the default
+// prompt is selected. The existing container is not changed.
+func (prompts *PromptsContainer) Reload() (*PromptsContainer, error) {
+	if prompts.file == "" {
+		return nil, errors.New("prompts were not loaded from a file")
+	}
+	b, err := os.ReadFile(prompts.file)
+	if err != nil {
+		return nil, fmt.Errorf("error trying to read prompts file %s: %w", prompts.file, err)
+	}
+	reloaded, err := NewPromptsContainer(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("error reloading prompts file %s: %w", prompts.file, err)
+	}
+	reloaded.file = prompts.file
+	reloaded.checksum = sha256.Sum256(b)
+
+	prompts.mux.RLock()
+	selected := prompts.selectedPrompt
+	prompts.mux.RUnlock()
+	if _, ok := reloaded.promptsMap[selected]; ok {
+		reloaded.selectedPrompt = selected
+	}
+	return reloaded, nil
+}
+
+// SelectedPromptID returns the ID of the prompt that is currently selected
+func (prompts *PromptsContainer) SelectedPromptID() ID {
+	prompts.mux.RLock()
+	defer prompts.mux.RUnlock()
+	return prompts.selectedPrompt
+}
@@ -0,0 +1,131 @@
+package prompts_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/prompts"
+)
+
+// Test that changes to a prompts file mounted from a ConfigMap are detected,
+// and that the selected prompt is kept if it still exists
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "prompts.yaml")
+	if abort := swapConfigMapFile(t, dir, "prompts.yaml", "1", "prompts:\n- id: a\n  short: first\n- id: b\n  short: second\n"); abort {
+		return
+	}
+	container, err := prompts.NewPromptsContainerFromFile(filename)
+	if err != nil {
+		t.Errorf("could not instantiate PromptsContainer: %v", err)
+		return
+	}
+	if abort := setPromptAndCheckError(t, container, "b", false); abort {
+		return
+	}
+	if changed, err := container.FileChanged(); err != nil || changed {
+		t.Errorf("expected prompts file to be unchanged but got changed = %t, err = %v", changed, err)
+		return
+	}
+
+	// the selected prompt still exists
+	if abort := swapConfigMapFile(t, dir, "prompts.yaml", "2", "prompts:\n- id: b\n  short: second changed\n- id: c\n  short: third\n  default: true\n"); abort {
+		return
+	}
+	if changed, err := container.FileChanged(); err != nil || !changed {
+		t.Errorf("expected prompts file to be changed but got changed = %t, err = %v", changed, err)
+		return
+	}
+	reloaded, err := container.Reload()
+	if err != nil {
+		t.Errorf("error reloading prompts: %v", err)
+		return
+	}
+	if abort := checkSelectedPromptItem(t, reloaded, "b", "second changed", "second changed"); abort {
+		return
+	}
+	if changed, err := reloaded.FileChanged(); err != nil || changed {
+		t.Errorf("expected reloaded prompts file to be unchanged but got changed = %t, err = %v", changed, err)
+		return
+	}
+	// the existing container is not changed
+	if abort := checkSelectedPromptItem(t, container, "b", "second", "second"); abort {
+		return
+	}
+
+	// the selected prompt was removed - the default prompt is selected
+	if abort := swapConfigMapFile(t, dir, "prompts.yaml", "3", "prompts:\n- id: a\n  short: first\n- id: c\n  short: third\n  default: true\n"); abort {
+		return
+	}
+	reloaded, err = reloaded.Reload()
+	if err != nil {
+		t.Errorf("error reloading prompts: %v", err)
+		return
+	}
+	checkSelectedPromptItem(t, reloaded, "c", "third", "third")
+
+	// invalid prompts are not loaded
+	if abort := swapConfigMapFile(t, dir, "prompts.yaml", "4", "prompts:\n- id: a\n"); abort {
+		return
+	}
+	if _, err := reloaded.Reload(); err == nil {
+		t.Error("expected an error reloading an invalid prompts file")
+	}
+}
+
+// Test that saving prompts through the API is not mistaken for a change to
+// the prompts file
+func TestSaveIsNotAChange(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "prompts.txt")
+	if err := os.WriteFile(filename, []byte("line0\nline1\n"), 0644); err != nil {
+		t.Errorf("could not create prompts file: %v", err)
+		return
+	}
+	container, err := prompts.NewPromptsContainerFromFile(filename)
+	if err != nil {
+		t.Errorf("could not instantiate PromptsContainer: %v", err)
+		return
+	}
+	if _, err := container.AddPrompt(prompts.PromptItem{ID: "new", Short: "new prompt"}); err != nil {
+		t.Errorf("error adding prompt: %v", err)
+		return
+	}
+	if changed, err := container.FileChanged(); err != nil || changed {
+		t.Errorf("expected prompts file to be unchanged after saving but got changed = %t, err = %v", changed, err)
+	}
+}
+
+// Writes the file the way Kubernetes updates a ConfigMap volume - the file is
+// a symlink to ..data/name, and ..data is a symlink to a directory that is
+// replaced on every update
+// returns true if subsequent tests should be aborted
+func swapConfigMapFile(t *testing.T, dir, name, version, contents string) bool {
+	versionDir := filepath.Join(dir, "..version"+version)
+	if err := os.Mkdir(versionDir, 0755); err != nil {
+		t.Errorf("could not create ConfigMap directory: %v", err)
+		return true
+	}
+	if err := os.WriteFile(filepath.Join(versionDir, name), []byte(contents), 0644); err != nil {
+		t.Errorf("could not write ConfigMap file: %v", err)
+		return true
+	}
+	tmpLink := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(filepath.Base(versionDir), tmpLink); err != nil {
+		t.Errorf("could not create ConfigMap symlink: %v", err)
+		return true
+	}
+	if err := os.Rename(tmpLink, filepath.Join(dir, "..data")); err != nil {
+		t.Errorf("could not swap ConfigMap symlink: %v", err)
+		return true
+	}
+	link := filepath.Join(dir, name)
+	if _, err := os.Lstat(link); err == nil {
+		return false
+	}
+	if err := os.Symlink(filepath.Join("..data", name), link); err != nil {
+		t.Errorf("could not create ConfigMap file symlink: %v", err)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package prompts
+
+// The descriptive prompt is a text/template that is rendered with the
+// alert's details before it is sent to the LLM, e.g.
+//
+//	Camera {{.Camera}} detected {{.Classes}} at {{.Time}} - is anyone in danger?
+//
+// Prompts without any template actions are sent unchanged. Prompts in the
+// legacy format are only parsed as templates if they refer to a variable or
+// use a control structure, so that prompts that were written before templates
+// were supported can contain a literal {{.
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const templateTimeFormat = "Monday 2 January 2006 15:04 MST"
+
+// matches the start of an action that refers to a variable or that is a
+// control structure, e.g. {{.Camera}} or {{if .PreviousVerdict}}
+var templateActionPattern = regexp.MustCompile(`\{\{-?\s*(\.|\$|(if|range|with|else|end|template|block|define)\b)`)
+
+// TemplateData holds the variables that can be used in a descriptive prompt
+type TemplateData struct {
+	Camera          string    // camera that raised the alert - empty if the alert did not say
+	Time            string    // local time of the alert, e.g. Monday 2 January 2006 15:04 UTC
+	Timestamp       time.Time // for templates that need a different format, e.g. {{.Timestamp.Format "15:04"}}
+	TimeOfDay       string    // morning, afternoon, evening or night
+	Classes         Classes   // objects detected in the image
+	PreviousVerdict string    // threat level of the previous alert - empty if there was no previous alert
+}
+
+// Classes are rendered as a comma-separated list, but templates can also
+// range over them
+type Classes []string
+
+func (classes Classes) String() string {
+	return strings.Join(classes, ", ")
+}
+
+// NewTemplateData fills in the time variables from timestamp - convert
+// timestamp to the time zone that should be shown to the LLM first.
+func NewTemplateData(camera string, timestamp time.Time, classes []string, previousVerdict string) TemplateData {
+	return TemplateData{
+		Camera:          camera,
+		Time:            timestamp.Format(templateTimeFormat),
+		Timestamp:       timestamp,
+		TimeOfDay:       timeOfDay(timestamp),
+		Classes:         Classes(classes),
+		PreviousVerdict: previousVerdict,
+	}
+}
+
+func timeOfDay(t time.Time) string {
+	switch hour := t.Hour(); {
+	case hour >= 5 && hour < 12:
+		return "morning"
+	case hour >= 12 && hour < 17:
+		return "afternoon"
+	case hour >= 17 && hour < 21:
+		return "evening"
+	default:
+		return "night"
+	}
+}
+
+// Render returns the descriptive prompt with the template variables filled
+// in
+func (item PromptItem) Render(data TemplateData) (string, error) {
+	tmpl := item.template
+	if tmpl == nil {
+		if !hasTemplateActions(item.Descriptive) {
+			return item.Descriptive, nil
+		}
+		// the prompt did not go through newPromptItem, e.g. it was read from
+		// the history
+		var err error
+		if tmpl, err = parsePromptTemplate(item.ID, item.Descriptive); err != nil {
+			return "", err
+		}
+	}
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("error rendering prompt %s: %w", item.ID, err)
+	}
+	return rendered.String(), nil
+}
+
+// Templates are executed with sample data so that references to variables
+// that do not exist are caught when the prompts are loaded rather than when
+// an alert comes in.
+func parsePromptTemplate(id ID, descriptive string) (*template.Template, error) {
+	tmpl, err := template.New(string(id)).Option("missingkey=error").Parse(descriptive)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template of prompt %s: %w", id, err)
+	}
+	sample := NewTemplateData("camera", time.Now(), []string{"person"}, "low")
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("error in template of prompt %s: %w", id, err)
+	}
+	return tmpl, nil
+}
+
+func hasTemplateActions(descriptive string) bool {
+	return templateActionPattern.MatchString(descriptive)
+}
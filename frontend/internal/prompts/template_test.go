@@ -0,0 +1,142 @@
+package prompts_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/prompts"
+)
+
+func TestRender(t *testing.T) {
+	const input = `prompts:
+- id: 1
+  short: Describe
+  descriptive: "Camera {{.Camera}} at {{.Time}} ({{.TimeOfDay}}) detected {{.Classes}}{{if .PreviousVerdict}} - the previous threat level was {{.PreviousVerdict}}{{end}}"
+- id: 2
+  short: Plain
+`
+	container, err := prompts.NewPromptsContainer(strings.NewReader(input))
+	if err != nil {
+		t.Errorf("could not instantiate PromptsContainer: %v", err)
+		return
+	}
+	location, err := time.LoadLocation("Asia/Singapore")
+	if err != nil {
+		t.Errorf("could not load time zone: %v", err)
+		return
+	}
+	timestamp := time.Date(2024, time.March, 4, 21, 30, 0, 0, location)
+
+	tests := []struct {
+		id       prompts.ID
+		data     prompts.TemplateData
+		expected string
+	}{
+		{"1", prompts.NewTemplateData("gate", timestamp, []string{"person", "knife"}, "high"), "Camera gate at Monday 4 March 2024 21:30 +08 (night) detected person, knife - the previous threat level was high"},
+		{"1", prompts.NewTemplateData("gate", timestamp.Add(-12*time.Hour), nil, ""), "Camera gate at Monday 4 March 2024 09:30 +08 (morning) detected "},
+		{"2", prompts.NewTemplateData("gate", timestamp, nil, ""), "Plain"},
+	}
+	for _, test := range tests {
+		item, err := container.GetPromptItem(test.id)
+		if err != nil {
+			t.Errorf("error getting prompt %s: %v", test.id, err)
+			return
+		}
+		rendered, err := item.Render(test.data)
+		if err != nil {
+			t.Errorf("error rendering prompt %s: %v", test.id, err)
+			continue
+		}
+		if rendered != test.expected {
+			t.Errorf(`expected prompt %s to be rendered as "%s" but got "%s"`, test.id, test.expected, rendered)
+		}
+	}
+}
+
+// Test that invalid templates are rejected when the prompts are loaded
+func TestInvalidTemplate(t *testing.T) {
+	tests := []string{
+		"What|Is {{.Camera",
+		"What|Is {{.Camra}} safe?",
+		"What|Is {{.Camera.Name}} safe?",
+		"prompts:\n- id: 1\n  short: What\n  descriptive: Fill in the {{blank}}\n",
+	}
+	for _, test := range tests {
+		if _, err := prompts.NewPromptsContainer(strings.NewReader(test)); err == nil {
+			t.Errorf(`expected an error loading prompt "%s" but did not get one`, test)
+		} else {
+			t.Logf("got an expected error: %v", err)
+		}
+	}
+}
+
+// Test that prompts in the legacy format are sent as plain text if they
+// contain a literal {{ but no template actions
+func TestLegacyPrompt(t *testing.T) {
+	tests := []string{
+		`Describe|Respond with JSON such as {{"threat": "low"}}`,
+		"Describe|Fill in the {{blank}}",
+		"Describe|Fill in the {{ blank }}",
+	}
+	for _, test := range tests {
+		container, err := prompts.NewPromptsContainer(strings.NewReader(test))
+		if err != nil {
+			t.Errorf(`error loading prompt "%s": %v`, test, err)
+			continue
+		}
+		item, err := container.GetPromptItem("0")
+		if err != nil {
+			t.Errorf(`error getting prompt "%s": %v`, test, err)
+			continue
+		}
+		rendered, err := item.Render(prompts.NewTemplateData("gate", time.Now(), nil, ""))
+		if err != nil {
+			t.Errorf(`error rendering prompt "%s": %v`, test, err)
+			continue
+		}
+		if expected := item.Descriptive; rendered != expected {
+			t.Errorf(`expected prompt to be sent as "%s" but got "%s"`, expected, rendered)
+		}
+	}
+}
+
+// Test that a literal {{ in a legacy prompt is escaped when the prompts file
+// is converted to the YAML format
+func TestLegacyPromptSaved(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "prompts.txt")
+	if err := os.WriteFile(filename, []byte("Describe|Fill in the {{blank}}\n"), 0644); err != nil {
+		t.Errorf("could not create prompts file: %v", err)
+		return
+	}
+	container, err := prompts.NewPromptsContainerFromFile(filename)
+	if err != nil {
+		t.Errorf("could not instantiate PromptsContainer: %v", err)
+		return
+	}
+	if _, err := container.AddPrompt(prompts.PromptItem{ID: "new", Short: "Plain"}); err != nil {
+		t.Errorf("error adding prompt: %v", err)
+		return
+	}
+	reloaded, err := prompts.NewPromptsContainerFromFile(filename)
+	if err != nil {
+		t.Errorf("could not read converted prompts file: %v", err)
+		return
+	}
+	item, err := reloaded.GetPromptItem("0")
+	if err != nil {
+		t.Errorf("error getting prompt: %v", err)
+		return
+	}
+	rendered, err := item.Render(prompts.NewTemplateData("gate", time.Now(), nil, ""))
+	if err != nil {
+		t.Errorf("error rendering prompt: %v", err)
+		return
+	}
+	if expected := "Fill in the {{blank}}"; rendered != expected {
+		t.Errorf(`expected prompt to be sent as "%s" but got "%s"`, expected, rendered)
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+// The ResultsPublisher publishes the result of every analysis to an MQTT
+// topic so that other systems on the MQTT bus can react to threats without
+// having to connect to the frontend.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/kwkoo/threat-detection-frontend/internal/prompts"
+	"github.com/kwkoo/threat-detection-frontend/internal/verdict"
+)
+
+const resultsPublishTimeout = 10 * time.Second
+
+// MQTTPublisher is the part of MQTT.Client that is used to publish results
+type MQTTPublisher interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token
+}
+
+// AnalysisResult is the message that is published once the pipeline has
+// finished with an alert
+type AnalysisResult struct {
+	AlertID       string           `json:"alert_id"`
+	Camera        string           `json:"camera"`
+	Timestamp     int64            `json:"timestamp"`
+	PromptID      prompts.ID       `json:"prompt_id"`
+	ImageAnalysis string           `json:"image_analysis"`
+	ThreatLevel   string           `json:"threat_level"`
+	Verdict       *verdict.Verdict `json:"verdict"` // null if the pipeline does not have a threat analysis stage
+}
+
+type ResultsPublisher struct {
+	client MQTTPublisher
+	topic  string
+	qos    byte
+	retain bool
+}
+
+func NewResultsPublisher(client MQTTPublisher, topic string, qos int, retain bool) (*ResultsPublisher, error) {
+	if topic == "" {
+		return nil, errors.New("results topic is not set")
+	}
+	if qos < 0 || qos > 2 {
+		return nil, fmt.Errorf("results QoS must be 0, 1 or 2 - got %d", qos)
+	}
+	return &ResultsPublisher{
+		client: client,
+		topic:  topic,
+		qos:    byte(qos),
+		retain: retain,
+	}, nil
+}
+
+// Publish does not wait for the broker - errors are logged when the publish
+// completes so that a slow broker does not hold up the analysis of the next
+// alert.
+func (p *ResultsPublisher) Publish(result AnalysisResult) error {
+	payload, err := json.Marshal(&result)
+	if err != nil {
+		return fmt.Errorf("error converting analysis result to json: %w", err)
+	}
+	token := p.client.Publish(p.topic, p.qos, p.retain, payload)
+	go logPublishErrors(token, "result of alert "+result.AlertID, p.topic)
+	return nil
+}
+
+// waits for the publish to complete - run this in a goroutine
+func logPublishErrors(token MQTT.Token, description, topic string) {
+	if !token.WaitTimeout(resultsPublishTimeout) {
+		log.Printf("timed out publishing %s to %s", description, topic)
+		return
+	}
+	if err := token.Error(); err != nil {
+		log.Printf("error publishing %s to %s: %v", description, topic, err)
+	}
+}
@@ -0,0 +1,92 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/kwkoo/threat-detection-frontend/internal"
+)
+
+type mockPublishedMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+}
+
+type mockPublisher struct {
+	published chan mockPublishedMessage
+}
+
+func (p *mockPublisher) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	p.published <- mockPublishedMessage{
+		topic:    topic,
+		qos:      qos,
+		retained: retained,
+		payload:  payload.([]byte),
+	}
+	return mockToken{}
+}
+
+type mockToken struct{}
+
+func (mockToken) Wait() bool                     { return true }
+func (mockToken) WaitTimeout(time.Duration) bool { return true }
+func (mockToken) Done() <-chan struct{}          { ch := make(chan struct{}); close(ch); return ch }
+func (mockToken) Error() error                   { return nil }
+
+// Test that the result is published once the pipeline has finished
+func TestResultsPublished(t *testing.T) {
+	m := newMocks(t, "")
+	defer m.close()
+
+	client := mockPublisher{published: make(chan mockPublishedMessage, 1)}
+	publisher, err := internal.NewResultsPublisher(&client, "results", 2, true)
+	if err != nil {
+		t.Errorf("could not create results publisher: %v", err)
+		return
+	}
+	m.controller.SetResultsPublisher(publisher)
+
+	m.controller.MQTTHandler(nil, newMockMQTTMessage(`{"annotated_image":"dummy","raw_image":"dummy","timestamp":1234,"camera":"gate"}`))
+
+	var msg mockPublishedMessage
+	select {
+	case msg = <-client.published:
+	case <-time.After(5 * time.Second):
+		t.Error("result was not published")
+		return
+	}
+	if msg.topic != "results" || msg.qos != 2 || !msg.retained {
+		t.Errorf("expected result to be published to results with QoS 2 and retain but got %s, QoS %d, retain %t", msg.topic, msg.qos, msg.retained)
+	}
+	var result internal.AnalysisResult
+	if err := json.Unmarshal(msg.payload, &result); err != nil {
+		t.Errorf("error unmarshalling result: %v", err)
+		return
+	}
+	if result.AlertID == "" {
+		t.Error("expected result to have an alert ID")
+	}
+	if result.Camera != "gate" || result.Timestamp != 1234 {
+		t.Errorf("expected result from camera gate at 1234 but got %s at %d", result.Camera, result.Timestamp)
+	}
+	if result.ImageAnalysis != "dummy ollama response" {
+		t.Errorf(`expected image analysis to be "dummy ollama response" but got "%s"`, result.ImageAnalysis)
+	}
+	if result.ThreatLevel != "medium" || result.Verdict == nil || result.Verdict.Level != "medium" {
+		t.Errorf("expected medium threat level but got %s and verdict %v", result.ThreatLevel, result.Verdict)
+	}
+}
+
+func TestInvalidResultsPublisher(t *testing.T) {
+	client := mockPublisher{}
+	if _, err := internal.NewResultsPublisher(&client, "", 0, false); err == nil {
+		t.Error("expected an error creating a results publisher without a topic")
+	}
+	if _, err := internal.NewResultsPublisher(&client, "results", 3, false); err == nil {
+		t.Error("expected an error creating a results publisher with QoS 3")
+	}
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// BackpressurePolicy decides what happens when a client does not read its
+// events fast enough and its channel fills up
+type BackpressurePolicy string
+
+const (
+	// Discard the message that does not fit
+	BackpressureDropNewest BackpressurePolicy = "drop-newest"
+
+	// Discard the oldest message in the channel to make room
+	BackpressureDropOldest BackpressurePolicy = "drop-oldest"
+
+	// Disconnect the client and tell it when to reconnect - the client
+	// receives the events it missed from the replay buffer when it
+	// reconnects with its last event ID
+	BackpressureDisconnect BackpressurePolicy = "disconnect"
+
+	// Hold back the messages that do not fit and merge consecutive token
+	// events into a single catch-up event - the client is disconnected if it
+	// falls too far behind
+	BackpressureCoalesce BackpressurePolicy = "coalesce"
+)
+
+// clients that are disconnected are told to wait this long before
+// reconnecting
+const slowClientRetryMillis = 1000
+
+// held back messages are sent as soon as there is room in the client
+// channel, or at this interval if no new events arrive
+const overflowFlushInterval = 100 * time.Millisecond
+
+// maximum number of held back messages (after merging token events) before a
+// client is disconnected
+const maxOverflowMessages = clientChannelSize
+
+func ParseBackpressurePolicy(s string) (BackpressurePolicy, error) {
+	policy := BackpressurePolicy(strings.ToLower(strings.TrimSpace(s)))
+	switch policy {
+	case BackpressureDropNewest, BackpressureDropOldest, BackpressureDisconnect, BackpressureCoalesce:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid backpressure policy %s - must be one of %s, %s, %s or %s", s, BackpressureDropNewest, BackpressureDropOldest, BackpressureDisconnect, BackpressureCoalesce)
+	}
+}
+
+// Sends the message to the client, applying the backpressure policy if the
+// client channel is full. The caller must hold the write lock.
+func (b *SSEBroadcaster) deliver(ch chan *sseMessage, client *sseClient, msg *sseMessage) {
+	// messages that are already held back have to be sent first to keep the
+	// events in order
+	if len(client.overflow) > 0 {
+		b.holdBack(ch, client, msg)
+		return
+	}
+	select {
+	case ch <- msg:
+		return
+	default:
+	}
+
+	switch b.policy {
+	case BackpressureDropOldest:
+		select {
+		case <-ch:
+			client.dropped++
+		default:
+		}
+		select {
+		case ch <- msg:
+		default:
+			client.dropped++
+		}
+		log.Printf("SSE client channel %s full - dropped oldest event", client.address)
+	case BackpressureDisconnect:
+		log.Printf("SSE client channel %s full - disconnecting client", client.address)
+		b.evict(ch, client)
+	case BackpressureCoalesce:
+		b.holdBack(ch, client, msg)
+	default:
+		client.dropped++
+		log.Printf("SSE client channel %s full", client.address)
+	}
+}
+
+// the caller must hold the write lock
+func (b *SSEBroadcaster) holdBack(ch chan *sseMessage, client *sseClient, msg *sseMessage) {
+	if n := len(client.overflow); n > 0 && msg.token {
+		if merged := mergeTokenMessages(client.overflow[n-1], msg); merged != nil {
+			client.overflow[n-1] = merged
+			client.coalesced++
+			b.flushOverflow(ch, client)
+			return
+		}
+	}
+	client.overflow = append(client.overflow, msg)
+	b.flushOverflow(ch, client)
+	if len(client.overflow) > maxOverflowMessages {
+		log.Printf("SSE client %s has fallen too far behind - disconnecting client", client.address)
+		b.evict(ch, client)
+	}
+}
+
+// the caller must hold the write lock
+func (b *SSEBroadcaster) flushOverflow(ch chan *sseMessage, client *sseClient) {
+	for len(client.overflow) > 0 {
+		select {
+		case ch <- client.overflow[0]:
+			client.overflow[0] = nil
+			client.overflow = client.overflow[1:]
+		default:
+			return
+		}
+	}
+	client.overflow = nil
+}
+
+// the caller must hold the write lock
+func (b *SSEBroadcaster) flushAllOverflows() {
+	for ch, client := range b.clients {
+		if len(client.overflow) > 0 {
+			b.flushOverflow(ch, client)
+		}
+	}
+}
+
+// Closes the client channel - the handler tells the client to reconnect
+// after it has sent the events that are still in the channel. The caller
+// must hold the write lock.
+func (b *SSEBroadcaster) evict(ch chan *sseMessage, client *sseClient) {
+	client.evicted = true
+	client.overflow = nil
+	delete(b.clients, ch)
+	close(ch)
+	b.disconnectedClients++
+}
+
+// Token events carry {"response":"..."} - returns nil if either message
+// cannot be merged
+func mergeTokenMessages(a, b *sseMessage) *sseMessage {
+	if !a.token || a.eventType != b.eventType || a.camera != b.camera {
+		return nil
+	}
+	var first, second struct {
+		Response string `json:"response"`
+	}
+	if json.Unmarshal(a.data, &first) != nil || json.Unmarshal(b.data, &second) != nil {
+		return nil
+	}
+	data, err := json.Marshal(struct {
+		Response string `json:"response"`
+	}{
+		Response: first.Response + second.Response,
+	})
+	if err != nil {
+		return nil
+	}
+	// the merged message takes the ID of the last message so that the
+	// client's Last-Event-ID is still correct
+	return &sseMessage{
+		seq:       b.seq,
+		id:        b.id,
+		eventType: b.eventType,
+		camera:    b.camera,
+		token:     true,
+		data:      data,
+		formatted: formatSSEMessage(b.id, b.eventType, data),
+	}
+}
+
+func formatSlowClientEvent() []byte {
+	return []byte(fmt.Sprintf("retry: %d\nevent: slow_client\ndata: %s\n\n", slowClientRetryMillis, slowClientData()))
+}
+
+func slowClientData() []byte {
+	data, _ := json.Marshal(struct {
+		RetryMillis int `json:"retry_ms"`
+	}{
+		RetryMillis: slowClientRetryMillis,
+	})
+	return data
+}
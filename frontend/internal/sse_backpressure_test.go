@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+// registers a client that never reads from its channel and sends it count
+// more events than the channel can hold
+func newSlowClient(policy BackpressurePolicy, count int, token bool) (*SSEBroadcaster, chan *sseMessage, *sseClient) {
+	b := NewSSEBroadcaster(policy)
+	client := newSSEClient(httptest.NewRequest("GET", "/api/sse", nil))
+	ch, _, _ := b.registerClient(client, "")
+	b.clientMux.Lock()
+	defer b.clientMux.Unlock()
+	for i := 0; i < clientChannelSize+count; i++ {
+		event := SSEEvent{EventType: "count", Data: []byte(fmt.Sprint(i))}
+		if token && i >= clientChannelSize {
+			event = SSEEvent{EventType: "token", Data: []byte(fmt.Sprintf(`{"response":"%d "}`, i)), Token: true}
+		}
+		msg := b.newMessage(event)
+		if _, ok := b.clients[ch]; ok {
+			b.deliver(ch, client, msg)
+		}
+	}
+	return b, ch, client
+}
+
+func TestBackpressureDropNewest(t *testing.T) {
+	_, ch, client := newSlowClient(BackpressureDropNewest, 10, false)
+	if client.dropped != 10 {
+		t.Errorf("expected 10 dropped events but got %d", client.dropped)
+	}
+	if first := <-ch; string(first.data) != "0" {
+		t.Errorf(`expected first event in channel to be "0" but got "%s"`, first.data)
+	}
+}
+
+func TestBackpressureDropOldest(t *testing.T) {
+	_, ch, client := newSlowClient(BackpressureDropOldest, 10, false)
+	if client.dropped != 10 {
+		t.Errorf("expected 10 dropped events but got %d", client.dropped)
+	}
+	if first := <-ch; string(first.data) != "10" {
+		t.Errorf(`expected first event in channel to be "10" but got "%s"`, first.data)
+	}
+}
+
+func TestBackpressureDisconnect(t *testing.T) {
+	b, ch, client := newSlowClient(BackpressureDisconnect, 1, false)
+	if !client.evicted {
+		t.Error("expected slow client to be evicted")
+	}
+	if len(b.clients) != 0 {
+		t.Errorf("expected slow client to be removed but there are %d clients", len(b.clients))
+	}
+	if b.disconnectedClients != 1 {
+		t.Errorf("expected 1 disconnected client but got %d", b.disconnectedClients)
+	}
+	count := 0
+	for range ch {
+		count++
+	}
+	if count != clientChannelSize {
+		t.Errorf("expected %d events to remain in the closed channel but got %d", clientChannelSize, count)
+	}
+}
+
+func TestBackpressureCoalesce(t *testing.T) {
+	b, ch, client := newSlowClient(BackpressureCoalesce, 3, true)
+	if client.dropped != 0 {
+		t.Errorf("expected no dropped events but got %d", client.dropped)
+	}
+	if client.coalesced != 2 {
+		t.Errorf("expected 2 coalesced events but got %d", client.coalesced)
+	}
+	if len(client.overflow) != 1 {
+		t.Errorf("expected 1 held back event but got %d", len(client.overflow))
+		return
+	}
+
+	// the client catches up
+	for i := 0; i < clientChannelSize; i++ {
+		<-ch
+	}
+	b.clientMux.Lock()
+	b.flushAllOverflows()
+	b.clientMux.Unlock()
+	merged := <-ch
+	var data struct {
+		Response string `json:"response"`
+	}
+	if err := json.Unmarshal(merged.data, &data); err != nil {
+		t.Errorf("could not decode catch-up event: %v", err)
+		return
+	}
+	expected := fmt.Sprintf("%d %d %d ", clientChannelSize, clientChannelSize+1, clientChannelSize+2)
+	if data.Response != expected {
+		t.Errorf(`expected catch-up event to contain "%s" but got "%s"`, expected, data.Response)
+	}
+	if merged.id != b.formatID(b.lastSeq) {
+		t.Errorf("expected catch-up event to have the ID of the last token %s but got %s", b.formatID(b.lastSeq), merged.id)
+	}
+}
+
+// Test that a client that falls too far behind is disconnected
+func TestBackpressureCoalesceOverflow(t *testing.T) {
+	_, _, client := newSlowClient(BackpressureCoalesce, maxOverflowMessages+1, false)
+	if !client.evicted {
+		t.Error("expected slow client to be evicted")
+	}
+}
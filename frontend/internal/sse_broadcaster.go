@@ -3,8 +3,11 @@ package internal
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,22 +15,86 @@ import (
 const pingIntervalSeconds = 15
 const clientChannelSize = 50
 
+// Recent events are kept so that they can be replayed to clients that
+// reconnect with a Last-Event-ID - the oldest events are discarded when
+// either limit is exceeded
+const replayBufferSize = 1000
+const replayBufferMaxBytes = 32 * 1024 * 1024
+
 type SSEEvent struct {
 	EventType string
 	Data      []byte
+	Camera    string // empty if the event is not specific to a camera
+	Token     bool   // set for streamed LLM tokens, which can be merged with BackpressureCoalesce
+}
+
+// An SSEEvent that has been assigned an ID and formatted for the wire
+type sseMessage struct {
+	seq       uint64
+	id        string
+	eventType string
+	camera    string
+	token     bool
+	data      []byte
+	formatted []byte
+}
+
+// Clients can limit the events they receive with the events and camera query
+// parameters
+type sseClient struct {
+	address string
+	events  map[string]bool // nil if the client wants every event type
+	camera  string          // empty if the client wants events from every camera
+
+	// the following are protected by the broadcaster's clientMux
+	overflow  []*sseMessage // messages that did not fit in the channel - only used by BackpressureCoalesce
+	dropped   uint64
+	coalesced uint64
+	evicted   bool // set before the channel is closed when the client is too slow
+}
+
+func newSSEClient(r *http.Request) *sseClient {
+	client := sseClient{
+		address: r.RemoteAddr,
+		camera:  r.URL.Query().Get("camera"),
+	}
+	if events := r.URL.Query().Get("events"); events != "" {
+		client.events = make(map[string]bool)
+		for _, eventType := range strings.Split(events, ",") {
+			if eventType = strings.TrimSpace(eventType); eventType != "" {
+				client.events[eventType] = true
+			}
+		}
+	}
+	return &client
+}
+
+func (c *sseClient) wants(msg *sseMessage) bool {
+	if c.events != nil && !c.events[msg.eventType] {
+		return false
+	}
+	return c.camera == "" || msg.camera == "" || c.camera == msg.camera
 }
 
 type SSEBroadcaster struct {
-	clientMux    sync.RWMutex
-	clients      map[chan []byte]string
-	wg           sync.WaitGroup
-	shuttingDown bool // Set to true when shutting down, so we can't add any new clients
+	clientMux           sync.RWMutex
+	clients             map[chan *sseMessage]*sseClient
+	wg                  sync.WaitGroup
+	shuttingDown        bool   // Set to true when shutting down, so we can't add any new clients
+	epoch               string // distinguishes event IDs from previous runs of the frontend
+	lastSeq             uint64
+	replay              []*sseMessage // oldest first
+	replayBytes         int
+	policy              BackpressurePolicy
+	disconnectedClients uint64 // clients that were disconnected because they were too slow
 }
 
-func NewSSEBroadcaster() *SSEBroadcaster {
+func NewSSEBroadcaster(policy BackpressurePolicy) *SSEBroadcaster {
 	s := SSEBroadcaster{
-		clients:      make(map[chan []byte]string),
+		clients:      make(map[chan *sseMessage]*sseClient),
 		shuttingDown: false,
+		epoch:        strconv.FormatInt(time.Now().UnixNano(), 36),
+		policy:       policy,
 	}
 	return &s
 }
@@ -35,27 +102,37 @@ func NewSSEBroadcaster() *SSEBroadcaster {
 // This should be run in a goroutine.
 // Close the channel to terminate the goroutine.
 func (b *SSEBroadcaster) Listen(in chan SSEEvent) {
-	for event := range in {
-		var buf bytes.Buffer
-		buf.WriteString("event: ")
-		buf.WriteString(event.EventType)
-		buf.WriteString("\ndata: ")
-		if event.Data != nil && len(event.Data) > 0 {
-			buf.Write(event.Data)
-		}
-		buf.WriteString("\n\n")
-		formattedMsg := buf.Bytes()
-		b.clientMux.RLock()
-		for clientCh := range b.clients {
-			select {
-			case clientCh <- formattedMsg:
-				// sent successfully
-				continue
-			default:
-				log.Printf("SSE client channel %s full", b.clients[clientCh])
+	// held back messages only need to be flushed with the coalesce policy
+	var flushTicks <-chan time.Time
+	if b.policy == BackpressureCoalesce {
+		flushTicker := time.NewTicker(overflowFlushInterval)
+		defer flushTicker.Stop()
+		flushTicks = flushTicker.C
+	}
+
+loop:
+	for {
+		select {
+		case event, ok := <-in:
+			if !ok {
+				break loop
 			}
+			// the write lock ensures that a client that is being registered
+			// either receives this message in its replay or on its channel
+			b.clientMux.Lock()
+			msg := b.newMessage(event)
+			b.addToReplayBuffer(msg)
+			for clientCh, client := range b.clients {
+				if client.wants(msg) {
+					b.deliver(clientCh, client, msg)
+				}
+			}
+			b.clientMux.Unlock()
+		case <-flushTicks:
+			b.clientMux.Lock()
+			b.flushAllOverflows()
+			b.clientMux.Unlock()
 		}
-		b.clientMux.RUnlock()
 	}
 
 	log.Print("starting SSEBroadcaster.Listen() graceful shutdown...")
@@ -71,6 +148,13 @@ func (b *SSEBroadcaster) Listen(in chan SSEEvent) {
 	log.Print("SSEBroadcaster.Listen() graceful shutdown complete")
 }
 
+// Clients that reconnect with a Last-Event-ID header (or a lastEventId query
+// parameter) are sent the events they missed. If the missed events are no
+// longer in the replay buffer, the client is sent a reset event instead.
+//
+// Set the events query parameter to a comma-separated list of event types to
+// only receive those events (e.g. /api/sse?events=timestamp,threat_verdict).
+// Set the camera query parameter to only receive events from that camera.
 func (b *SSEBroadcaster) HTTPHandler(w http.ResponseWriter, r *http.Request) {
 	b.wg.Add(1)
 	defer b.wg.Done()
@@ -84,22 +168,48 @@ func (b *SSEBroadcaster) HTTPHandler(w http.ResponseWriter, r *http.Request) {
 	// Used to set write timeouts
 	rc := http.NewResponseController(w)
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
 
 	log.Print("registering new SSE client...")
-	ch := b.registerClient(r.RemoteAddr)
+	client := newSSEClient(r)
+	ch, backlog, reset := b.registerClient(client, lastEventID)
 	if ch == nil {
 		http.Error(w, "shutting down, unable to add new clients", http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
 	pingTicker := time.NewTicker(pingIntervalSeconds * time.Second)
 	defer func() {
 		pingTicker.Stop()
 		b.deregisterClient(ch)
 		log.Print("SSE client connection shutdown")
 	}()
+
+	if reset {
+		log.Printf("SSE client %s missed events that are no longer available - sending reset", r.RemoteAddr)
+		if err := writeWithTimeout(rc, w, formatResetEvent(lastEventID)); err != nil {
+			log.Printf("error writing to SSE client %s: %v", r.RemoteAddr, err)
+			return
+		}
+	}
+	if len(backlog) > 0 {
+		log.Printf("replaying %d events to SSE client %s", len(backlog), r.RemoteAddr)
+	}
+	for _, msg := range backlog {
+		if err := writeWithTimeout(rc, w, msg.formatted); err != nil {
+			log.Printf("error writing to SSE client %s: %v", r.RemoteAddr, err)
+			return
+		}
+	}
+	flusher.Flush()
+
 	log.Print("SSE HTTP handler loop")
 	for {
 		select {
@@ -114,10 +224,16 @@ func (b *SSEBroadcaster) HTTPHandler(w http.ResponseWriter, r *http.Request) {
 			flusher.Flush()
 		case msg, ok := <-ch:
 			if !ok {
+				if client.evicted {
+					log.Printf("SSE client %s is too slow - telling it to reconnect", r.RemoteAddr)
+					writeWithTimeout(rc, w, formatSlowClientEvent())
+					flusher.Flush()
+					return
+				}
 				log.Printf("SSE client channel %s closed", r.RemoteAddr)
 				return
 			}
-			if err := writeWithTimeout(rc, w, msg); err != nil {
+			if err := writeWithTimeout(rc, w, msg.formatted); err != nil {
 				log.Printf("error writing to SSE client %s: %v", r.RemoteAddr, err)
 				return
 			}
@@ -137,34 +253,152 @@ func writeWithTimeout(rc *http.ResponseController, w http.ResponseWriter, data [
 
 func (b *SSEBroadcaster) StatusHandler(w http.ResponseWriter, r *http.Request) {
 	clientChannels := make(map[string]int)
+	clientDropped := make(map[string]uint64)
+	clientCoalesced := make(map[string]uint64)
 	b.clientMux.RLock()
-	for ch, address := range b.clients {
-		clientChannels[address] = len(ch)
+	for ch, client := range b.clients {
+		clientChannels[client.address] = len(ch) + len(client.overflow)
+		clientDropped[client.address] = client.dropped
+		clientCoalesced[client.address] = client.coalesced
 	}
+	replayEvents := len(b.replay)
+	replayBytes := b.replayBytes
+	lastEventID := b.formatID(b.lastSeq)
+	disconnectedClients := b.disconnectedClients
 	b.clientMux.RUnlock()
 	status := struct {
-		ClientChannels map[string]int `json:"client_channels"`
+		ClientChannels      map[string]int    `json:"client_channels"`
+		ClientDropped       map[string]uint64 `json:"client_dropped"`
+		ClientCoalesced     map[string]uint64 `json:"client_coalesced"`
+		BackpressurePolicy  string            `json:"backpressure_policy"`
+		DisconnectedClients uint64            `json:"disconnected_clients"`
+		ReplayEvents        int               `json:"replay_events"`
+		ReplayBytes         int               `json:"replay_bytes"`
+		LastEventID         string            `json:"last_event_id"`
 	}{
-		ClientChannels: clientChannels,
+		ClientChannels:      clientChannels,
+		ClientDropped:       clientDropped,
+		ClientCoalesced:     clientCoalesced,
+		BackpressurePolicy:  string(b.policy),
+		DisconnectedClients: disconnectedClients,
+		ReplayEvents:        replayEvents,
+		ReplayBytes:         replayBytes,
+		LastEventID:         lastEventID,
 	}
 	json.NewEncoder(w).Encode(&status)
 }
 
-// The returned channel expects a formatted SSE event message
-func (b *SSEBroadcaster) registerClient(clientAddress string) chan []byte {
+// The returned channel carries formatted SSE event messages. The backlog
+// contains the events after lastEventID that should be sent before reading
+// from the channel. reset is true if some of those events are no longer
+// available.
+func (b *SSEBroadcaster) registerClient(client *sseClient, lastEventID string) (ch chan *sseMessage, backlog []*sseMessage, reset bool) {
+	b.clientMux.Lock()
+	defer b.clientMux.Unlock()
 	if b.shuttingDown {
-		return nil
+		return nil, nil, false
 	}
-	b.clientMux.Lock()
-	ch := make(chan []byte, clientChannelSize)
-	b.clients[ch] = clientAddress
-	b.clientMux.Unlock()
+	if lastEventID != "" {
+		backlog, reset = b.eventsAfter(lastEventID, client)
+	}
+	ch = make(chan *sseMessage, clientChannelSize)
+	b.clients[ch] = client
 
-	return ch
+	return ch, backlog, reset
 }
 
-func (b *SSEBroadcaster) deregisterClient(ch chan []byte) {
+func (b *SSEBroadcaster) deregisterClient(ch chan *sseMessage) {
 	b.clientMux.Lock()
 	delete(b.clients, ch)
 	b.clientMux.Unlock()
 }
+
+// the caller must hold the write lock
+func (b *SSEBroadcaster) newMessage(event SSEEvent) *sseMessage {
+	b.lastSeq++
+	id := b.formatID(b.lastSeq)
+	return &sseMessage{
+		seq:       b.lastSeq,
+		id:        id,
+		eventType: event.EventType,
+		camera:    event.Camera,
+		token:     event.Token,
+		data:      event.Data,
+		formatted: formatSSEMessage(id, event.EventType, event.Data),
+	}
+}
+
+func formatSSEMessage(id, eventType string, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("id: ")
+	buf.WriteString(id)
+	buf.WriteString("\nevent: ")
+	buf.WriteString(eventType)
+	buf.WriteString("\ndata: ")
+	if len(data) > 0 {
+		buf.Write(data)
+	}
+	buf.WriteString("\n\n")
+	return buf.Bytes()
+}
+
+// the caller must hold the write lock
+func (b *SSEBroadcaster) addToReplayBuffer(msg *sseMessage) {
+	b.replay = append(b.replay, msg)
+	b.replayBytes += len(msg.formatted)
+	for len(b.replay) > 1 && (len(b.replay) > replayBufferSize || b.replayBytes > replayBufferMaxBytes) {
+		b.replayBytes -= len(b.replay[0].formatted)
+		b.replay[0] = nil
+		b.replay = b.replay[1:]
+	}
+}
+
+// returns the buffered events after lastEventID that the client wants -
+// reset is true if the buffer does not cover every event after lastEventID
+// the caller must hold the lock
+func (b *SSEBroadcaster) eventsAfter(lastEventID string, client *sseClient) (events []*sseMessage, reset bool) {
+	seq, ok := b.parseID(lastEventID)
+	if !ok || seq > b.lastSeq {
+		return nil, true
+	}
+	if seq == b.lastSeq {
+		return nil, false
+	}
+	if len(b.replay) == 0 || b.replay[0].seq > seq+1 {
+		return nil, true
+	}
+	start := int(seq + 1 - b.replay[0].seq)
+	for _, msg := range b.replay[start:] {
+		if client.wants(msg) {
+			events = append(events, msg)
+		}
+	}
+	return events, false
+}
+
+func (b *SSEBroadcaster) formatID(seq uint64) string {
+	return b.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// returns false if the ID is invalid or if it was issued by a previous run
+// of the frontend
+func (b *SSEBroadcaster) parseID(id string) (uint64, bool) {
+	epoch, seqString, found := strings.Cut(id, "-")
+	if !found || epoch != b.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(seqString, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+func formatResetEvent(lastEventID string) []byte {
+	data, _ := json.Marshal(struct {
+		LastEventID string `json:"last_event_id"`
+	}{
+		LastEventID: lastEventID,
+	})
+	return []byte(fmt.Sprintf("event: reset\ndata: %s\n\n", data))
+}
@@ -0,0 +1,174 @@
+package internal_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kwkoo/threat-detection-frontend/internal"
+)
+
+type sseTestEvent struct {
+	id        string
+	eventType string
+	data      string
+}
+
+// Test that a client reconnecting with Last-Event-ID receives the events it
+// missed
+func TestSSEReplay(t *testing.T) {
+	sse, ch, server := newTestSSEServer()
+	defer server.Close()
+	defer close(ch)
+
+	for i := 0; i < 5; i++ {
+		ch <- internal.SSEEvent{EventType: "count", Data: []byte{byte('0' + i)}}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	status := getSSEStatus(t, sse)
+	lastEventID := status.LastEventID
+	if lastEventID == "" {
+		t.Error("last event ID was not set")
+		return
+	}
+	// the ID of the 3rd event
+	epoch, _, _ := strings.Cut(lastEventID, "-")
+	thirdEventID := epoch + "-3"
+
+	events := readSSEEvents(t, server.URL, thirdEventID, 2)
+	if len(events) != 2 {
+		t.Errorf("expected 2 replayed events but got %d", len(events))
+		return
+	}
+	if events[0].data != "3" || events[1].data != "4" {
+		t.Errorf("expected events 3 and 4 to be replayed but got %v", events)
+	}
+	if events[1].id != lastEventID {
+		t.Errorf("expected the last replayed event to have ID %s but got %s", lastEventID, events[1].id)
+	}
+}
+
+// Test that a client reconnecting with an unknown Last-Event-ID receives a
+// reset event
+func TestSSEReset(t *testing.T) {
+	_, ch, server := newTestSSEServer()
+	defer server.Close()
+	defer close(ch)
+
+	ch <- internal.SSEEvent{EventType: "count", Data: []byte("0")}
+	time.Sleep(100 * time.Millisecond)
+
+	events := readSSEEvents(t, server.URL, "previousrun-42", 1)
+	if len(events) != 1 {
+		t.Errorf("expected 1 event but got %d", len(events))
+		return
+	}
+	if events[0].eventType != "reset" {
+		t.Errorf("expected a reset event but got %v", events[0])
+	}
+}
+
+func newTestSSEServer() (*internal.SSEBroadcaster, chan internal.SSEEvent, *httptest.Server) {
+	return newTestSSEServerWithPolicy(internal.BackpressureDropNewest)
+}
+
+func newTestSSEServerWithPolicy(policy internal.BackpressurePolicy) (*internal.SSEBroadcaster, chan internal.SSEEvent, *httptest.Server) {
+	sse := internal.NewSSEBroadcaster(policy)
+	ch := make(chan internal.SSEEvent, 10)
+	go sse.Listen(ch)
+	server := httptest.NewServer(http.HandlerFunc(sse.HTTPHandler))
+	return sse, ch, server
+}
+
+type sseStatus struct {
+	LastEventID string `json:"last_event_id"`
+}
+
+func getSSEStatus(t *testing.T, sse *internal.SSEBroadcaster) sseStatus {
+	w := httptest.NewRecorder()
+	sse.StatusHandler(w, httptest.NewRequest(http.MethodGet, "/api/ssestatus", nil))
+	var status sseStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Errorf("could not decode SSE status: %v", err)
+	}
+	return status
+}
+
+// reads count events, excluding pings
+func readSSEEvents(t *testing.T, url, lastEventID string, count int) []sseTestEvent {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Errorf("could not create SSE request: %v", err)
+		return nil
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("could not connect to SSE server: %v", err)
+		return nil
+	}
+	defer res.Body.Close()
+
+	var events []sseTestEvent
+	var current sseTestEvent
+	scanner := bufio.NewScanner(res.Body)
+	for len(events) < count && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if current.eventType != "" && current.eventType != "ping" {
+				events = append(events, current)
+			}
+			current = sseTestEvent{}
+		case strings.HasPrefix(line, "id: "):
+			current.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			current.eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	return events
+}
+
+// Test that clients only receive the event types and cameras they ask for
+func TestSSEFilter(t *testing.T) {
+	_, ch, server := newTestSSEServer()
+	defer server.Close()
+	defer close(ch)
+
+	received := make(chan []sseTestEvent)
+	go func() {
+		received <- readSSEEvents(t, server.URL+"?events=threat_verdict,openai_response&camera=cam1", "", 3)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	ch <- internal.SSEEvent{EventType: "raw_image", Data: []byte("image"), Camera: "cam1"}
+	ch <- internal.SSEEvent{EventType: "threat_verdict", Data: []byte("cam2"), Camera: "cam2"}
+	ch <- internal.SSEEvent{EventType: "threat_verdict", Data: []byte("cam1"), Camera: "cam1"}
+	ch <- internal.SSEEvent{EventType: "ollama_response", Data: []byte("token")}
+	ch <- internal.SSEEvent{EventType: "openai_response", Data: []byte("all cameras")}
+	ch <- internal.SSEEvent{EventType: "threat_verdict", Data: []byte("cam1 again"), Camera: "cam1"}
+
+	events := <-received
+	if len(events) != 3 {
+		t.Errorf("expected 3 events but got %d", len(events))
+		return
+	}
+	expected := []string{"cam1", "all cameras", "cam1 again"}
+	for i, event := range events {
+		if event.data != expected[i] {
+			t.Errorf(`expected event %d to have data "%s" but got "%s"`, i, expected[i], event.data)
+		}
+	}
+}
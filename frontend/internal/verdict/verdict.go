@@ -0,0 +1,196 @@
+package verdict
+
+// Parses the output of the threat classification stage into a typed Verdict.
+// Models are asked to reply with JSON that conforms to schema.json, but they
+// do not always comply - if no valid JSON object is found in the output, the
+// level and confidence are extracted with regular expressions instead.
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+type Level string
+
+const (
+	LevelUnknown Level = "unknown"
+	LevelLow     Level = "low"
+	LevelMedium  Level = "medium"
+	LevelHigh    Level = "high"
+)
+
+// Source values
+const (
+	SourceJSON  = "json"
+	SourceRegex = "regex"
+	SourceNone  = "none"
+)
+
+// DefaultPrompt asks the classifier for a verdict that conforms to
+// schema.json - it is used if the deployment does not set its own prompt
+const DefaultPrompt = `Does the text in the following paragraph describe a dangerous situation? Reply with only a JSON object with the fields "level" (the threat level - low, medium or high), "confidence" (a number between 0 and 1) and "rationale" (one sentence that explains the threat level), e.g. {"level":"low","confidence":0.8,"rationale":"A delivery driver is leaving a parcel at the door."}`
+
+var errNoJSON = errors.New("no JSON object found")
+
+//go:embed schema.json
+var schemaJSON string
+
+var schema = jsonschema.MustCompileString("verdict.schema.json", schemaJSON)
+
+var levelPattern = regexp.MustCompile(`(?i)\b(low|medium|moderate|high|severe|critical)\b`)
+
+// an explicit label such as "threat level: high" or "risk is low"
+var labelPattern = regexp.MustCompile(`(?i)\b(?:(?:threat|risk)(?:\s+level)?|level)\s*(?:is|:|=|-)\s*\**\s*(low|medium|moderate|high|severe|critical)\b`)
+
+// a level that is preceded by this is ignored, e.g. "not a high threat"
+var negationPattern = regexp.MustCompile(`(?i)\b(?:not|no|isn't|never)\s+(?:(?:a|an|the|very|particularly)\s+)?$`)
+var confidencePattern = regexp.MustCompile(`(?i)confiden(?:ce|t)\D{0,20}?(\d+(?:\.\d+)?)\s*(%?)`)
+var percentagePattern = regexp.MustCompile(`(\d+(?:\.\d+)?)\s*%`)
+
+type Verdict struct {
+	Level      Level    `json:"level"`
+	Confidence *float64 `json:"confidence,omitempty"` // between 0 and 1
+	Rationale  string   `json:"rationale,omitempty"`
+	Source     string   `json:"source"` // how the verdict was extracted - json, regex or none
+}
+
+// Parse never fails - the verdict's level is LevelUnknown if the level could
+// not be determined
+func Parse(text string) Verdict {
+	v, err := parseJSON(text)
+	if err == nil {
+		return v
+	}
+	if err != errNoJSON {
+		log.Printf("could not parse threat verdict as JSON - falling back to regex: %v", err)
+	}
+	return parseRegex(text)
+}
+
+// Rank orders levels from unknown (0) to high (3)
+func (l Level) Rank() int {
+	switch l {
+	case LevelLow:
+		return 1
+	case LevelMedium:
+		return 2
+	case LevelHigh:
+		return 3
+	default:
+		return 0
+	}
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "unknown":
+		return LevelUnknown, nil
+	case "low":
+		return LevelLow, nil
+	case "medium", "moderate":
+		return LevelMedium, nil
+	case "high", "severe", "critical":
+		return LevelHigh, nil
+	default:
+		return LevelUnknown, fmt.Errorf("invalid threat level %s", s)
+	}
+}
+
+// looks for the outermost JSON object in the text and validates it against
+// the schema
+func parseJSON(text string) (Verdict, error) {
+	start := strings.Index(text, "{")
+	end := strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return Verdict{}, errNoJSON
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(text[start:end+1]), &doc); err != nil {
+		return Verdict{}, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	// models are inconsistent with capitalization
+	if obj, ok := doc.(map[string]interface{}); ok {
+		if level, ok := obj["level"].(string); ok {
+			obj["level"] = strings.ToLower(strings.TrimSpace(level))
+		}
+	}
+	if err := schema.Validate(doc); err != nil {
+		return Verdict{}, fmt.Errorf("JSON does not conform to the verdict schema: %w", err)
+	}
+
+	normalized, err := json.Marshal(doc)
+	if err != nil {
+		return Verdict{}, err
+	}
+	var v Verdict
+	if err := json.Unmarshal(normalized, &v); err != nil {
+		return Verdict{}, err
+	}
+	v.Source = SourceJSON
+	return v, nil
+}
+
+// uses the first level that is labelled as the threat level, or the highest
+// level mentioned in the text if there is no label - levels that are negated
+// (e.g. "not a high threat") are ignored
+func parseRegex(text string) Verdict {
+	v := Verdict{
+		Level:      LevelUnknown,
+		Rationale:  strings.TrimSpace(text),
+		Source:     SourceNone,
+		Confidence: extractConfidence(text),
+	}
+	if m := labelPattern.FindStringSubmatch(text); m != nil {
+		if level, err := ParseLevel(m[1]); err == nil {
+			v.Level = level
+			v.Source = SourceRegex
+			return v
+		}
+	}
+	for _, loc := range levelPattern.FindAllStringIndex(text, -1) {
+		if negationPattern.MatchString(text[:loc[0]]) {
+			continue
+		}
+		level, err := ParseLevel(text[loc[0]:loc[1]])
+		if err != nil {
+			continue
+		}
+		if level.Rank() > v.Level.Rank() {
+			v.Level = level
+			v.Source = SourceRegex
+		}
+	}
+	return v
+}
+
+func extractConfidence(text string) *float64 {
+	var value, percent string
+	if m := confidencePattern.FindStringSubmatch(text); m != nil {
+		value, percent = m[1], m[2]
+	} else if m := percentagePattern.FindStringSubmatch(text); m != nil {
+		value, percent = m[1], "%"
+	} else {
+		return nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+	// whole numbers above 1 are assumed to be percentages
+	if percent != "" || (f > 1 && !strings.Contains(value, ".")) {
+		f /= 100
+	}
+	if f < 0 || f > 1 {
+		return nil
+	}
+	return &f
+}
@@ -0,0 +1,53 @@
+package verdict_test
+
+import (
+	"testing"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/verdict"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text       string
+		level      verdict.Level
+		confidence float64 // -1 if confidence should not be set
+		source     string
+	}{
+		{`{"level":"high","confidence":0.9,"rationale":"person is holding a knife"}`, verdict.LevelHigh, 0.9, verdict.SourceJSON},
+		{"Here is my assessment:\n```json\n{\"level\": \"Medium\"}\n```", verdict.LevelMedium, -1, verdict.SourceJSON},
+		{`{"level":"extreme"}`, verdict.LevelUnknown, -1, verdict.SourceNone},
+		{`{"level":"low","confidence":1.5} but actually the threat is high`, verdict.LevelHigh, -1, verdict.SourceRegex},
+		{" Medium threat", verdict.LevelMedium, -1, verdict.SourceRegex},
+		{"Low threat, confidence: 80%", verdict.LevelLow, 0.8, verdict.SourceRegex},
+		{"The threat level is HIGH (confidence 0.75)", verdict.LevelHigh, 0.75, verdict.SourceRegex},
+		{"Moderate", verdict.LevelMedium, -1, verdict.SourceRegex},
+		{"I cannot tell", verdict.LevelUnknown, -1, verdict.SourceNone},
+		{"This is not a high threat; risk is low", verdict.LevelLow, -1, verdict.SourceRegex},
+		{"Threat level: low. A high fence is visible behind the person", verdict.LevelLow, -1, verdict.SourceRegex},
+		{"Not a high threat - the person appears to be a low risk", verdict.LevelLow, -1, verdict.SourceRegex},
+		{"There is no high threat in the image", verdict.LevelUnknown, -1, verdict.SourceNone},
+	}
+
+	for _, test := range tests {
+		v := verdict.Parse(test.text)
+		if v.Level != test.level {
+			t.Errorf(`expected level %s for "%s" but got %s`, test.level, test.text, v.Level)
+		}
+		if v.Source != test.source {
+			t.Errorf(`expected source %s for "%s" but got %s`, test.source, test.text, v.Source)
+		}
+		if test.confidence < 0 {
+			if v.Confidence != nil {
+				t.Errorf(`expected confidence to be unset for "%s" but got %f`, test.text, *v.Confidence)
+			}
+			continue
+		}
+		if v.Confidence == nil {
+			t.Errorf(`expected confidence %f for "%s" but it was not set`, test.confidence, test.text)
+			continue
+		}
+		if *v.Confidence != test.confidence {
+			t.Errorf(`expected confidence %f for "%s" but got %f`, test.confidence, test.text, *v.Confidence)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package internal
+
+// The WebSocketTransport delivers the same events as the SSEBroadcaster to
+// clients that cannot use SSE (e.g. because a proxy buffers
+// text/event-stream responses). Each event is sent as a JSON envelope. Clients
+// can also send control messages over the same connection instead of making
+// separate REST calls.
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kwkoo/threat-detection-frontend/internal/prompts"
+)
+
+const wsWriteTimeout = 5 * time.Second
+
+// Clients must answer the pings within this time or the connection is closed
+// - this reaps half-open connections that would otherwise stay subscribed to
+// the broadcaster forever
+const wsPongWait = 2 * pingIntervalSeconds * time.Second
+const wsMaxControlMessageBytes = 64 * 1024
+const wsRepliesChannelSize = 10
+
+// Control message types sent by clients
+const (
+	wsSetPrompt        = "set_prompt"
+	wsResumeEvents     = "resume_events"
+	wsCancelAnalysis   = "cancel_analysis"
+	wsAcknowledgeAlert = "acknowledge_alert"
+)
+
+// WebSocketControls is implemented by the AlertsController
+type WebSocketControls interface {
+	SetPrompt(camera string, id prompts.ID) error
+	ResumeEvents(camera string)
+	CancelAnalysis(camera string) []string
+	AcknowledgeAlert(id string) error
+}
+
+// Every message sent to the client is wrapped in this envelope. The ID can
+// be passed in the lastEventId query parameter when reconnecting, just like
+// SSE clients do.
+type wsEnvelope struct {
+	Type string          `json:"type"`
+	ID   string          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Message sent by the client
+type wsControlMessage struct {
+	Type      string      `json:"type"`
+	RequestID string      `json:"request_id,omitempty"` // echoed in the result so clients can match it up
+	PromptID  *prompts.ID `json:"prompt_id,omitempty"`  // for set_prompt
+	AlertID   string      `json:"alert_id,omitempty"`   // for acknowledge_alert
+	Camera    string      `json:"camera,omitempty"`     // for set_prompt, resume_events and cancel_analysis - empty for every camera
+}
+
+// Sent to the client in a control_result envelope after each control message
+type wsControlResult struct {
+	RequestID string `json:"request_id,omitempty"`
+	Type      string `json:"control"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+}
+
+type WebSocketTransport struct {
+	broadcaster *SSEBroadcaster
+	controls    WebSocketControls
+	upgrader    websocket.Upgrader
+}
+
+// Set allowOrigin to the CORS setting - cross-origin connections are
+// rejected unless allowOrigin is * or matches the origin.
+func NewWebSocketTransport(broadcaster *SSEBroadcaster, controls WebSocketControls, allowOrigin string) *WebSocketTransport {
+	t := WebSocketTransport{
+		broadcaster: broadcaster,
+		controls:    controls,
+	}
+	t.upgrader.CheckOrigin = func(r *http.Request) bool {
+		return checkOrigin(r, allowOrigin)
+	}
+	return &t
+}
+
+// The events, camera and lastEventId query parameters work the same way as
+// they do for SSE clients.
+func (t *WebSocketTransport) HTTPHandler(w http.ResponseWriter, r *http.Request) {
+	b := t.broadcaster
+	b.wg.Add(1)
+	defer b.wg.Done()
+
+	conn, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied to the client
+		log.Printf("could not upgrade websocket connection from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	lastEventID := r.URL.Query().Get("lastEventId")
+	log.Print("registering new websocket client...")
+	client := newSSEClient(r)
+	ch, backlog, reset := b.registerClient(client, lastEventID)
+	if ch == nil {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(wsWriteTimeout))
+		return
+	}
+
+	pingTicker := time.NewTicker(pingIntervalSeconds * time.Second)
+	quit := make(chan struct{})
+	defer func() {
+		close(quit)
+		pingTicker.Stop()
+		b.deregisterClient(ch)
+		log.Print("websocket client connection shutdown")
+	}()
+
+	replies := make(chan []byte, wsRepliesChannelSize)
+	readerDone := make(chan struct{})
+	go func() {
+		t.readControlMessages(conn, replies, quit)
+		close(readerDone)
+	}()
+
+	if reset {
+		log.Printf("websocket client %s missed events that are no longer available - sending reset", r.RemoteAddr)
+		data, _ := json.Marshal(struct {
+			LastEventID string `json:"last_event_id"`
+		}{
+			LastEventID: lastEventID,
+		})
+		if err := writeWSMessage(conn, wsEnvelope{Type: "reset", Data: data}); err != nil {
+			log.Printf("error writing to websocket client %s: %v", r.RemoteAddr, err)
+			return
+		}
+	}
+	if len(backlog) > 0 {
+		log.Printf("replaying %d events to websocket client %s", len(backlog), r.RemoteAddr)
+	}
+	for _, msg := range backlog {
+		if err := writeWSMessage(conn, newWSEnvelope(msg)); err != nil {
+			log.Printf("error writing to websocket client %s: %v", r.RemoteAddr, err)
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-readerDone:
+			log.Printf("websocket client connection %s terminated", r.RemoteAddr)
+			return
+		case <-pingTicker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				log.Printf("error writing to websocket client %s: %v", r.RemoteAddr, err)
+				return
+			}
+		case reply := <-replies:
+			if err := writeWSData(conn, reply); err != nil {
+				log.Printf("error writing to websocket client %s: %v", r.RemoteAddr, err)
+				return
+			}
+		case msg, ok := <-ch:
+			if !ok {
+				if client.evicted {
+					log.Printf("websocket client %s is too slow - telling it to reconnect", r.RemoteAddr)
+					writeWSMessage(conn, wsEnvelope{Type: "slow_client", Data: slowClientData()})
+					conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "client too slow"), time.Now().Add(wsWriteTimeout))
+					return
+				}
+				log.Printf("websocket client channel %s closed", r.RemoteAddr)
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(wsWriteTimeout))
+				return
+			}
+			if err := writeWSMessage(conn, newWSEnvelope(msg)); err != nil {
+				log.Printf("error writing to websocket client %s: %v", r.RemoteAddr, err)
+				return
+			}
+		}
+	}
+}
+
+// Reads control messages until the connection is closed or the client stops
+// answering pings. The results are passed to the writer through the replies
+// channel because a websocket connection only supports one concurrent writer.
+func (t *WebSocketTransport) readControlMessages(conn *websocket.Conn, replies chan<- []byte, quit <-chan struct{}) {
+	conn.SetReadLimit(wsMaxControlMessageBytes)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("error reading from websocket client %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		result := t.handleControlMessage(data)
+		marshaled, err := json.Marshal(&result)
+		if err != nil {
+			log.Printf("error converting websocket control result to json: %v", err)
+			continue
+		}
+		reply, err := json.Marshal(wsEnvelope{Type: "control_result", Data: marshaled})
+		if err != nil {
+			log.Printf("error converting websocket control result to json: %v", err)
+			continue
+		}
+		select {
+		case replies <- reply:
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (t *WebSocketTransport) handleControlMessage(data []byte) wsControlResult {
+	var msg wsControlMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return wsControlResult{Error: "error decoding control message: " + err.Error()}
+	}
+	result := wsControlResult{
+		RequestID: msg.RequestID,
+		Type:      msg.Type,
+	}
+	var err error
+	switch msg.Type {
+	case wsSetPrompt:
+		if msg.PromptID == nil {
+			err = errors.New(`required field "prompt_id" missing`)
+			break
+		}
+		err = t.controls.SetPrompt(msg.Camera, *msg.PromptID)
+	case wsResumeEvents:
+		t.controls.ResumeEvents(msg.Camera)
+	case wsCancelAnalysis:
+		t.controls.CancelAnalysis(msg.Camera)
+	case wsAcknowledgeAlert:
+		if msg.AlertID == "" {
+			err = errors.New(`required field "alert_id" missing`)
+			break
+		}
+		err = t.controls.AcknowledgeAlert(msg.AlertID)
+	default:
+		err = errors.New("unknown control message type " + msg.Type)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.OK = true
+	return result
+}
+
+func newWSEnvelope(msg *sseMessage) wsEnvelope {
+	envelope := wsEnvelope{
+		Type: msg.eventType,
+		ID:   msg.id,
+	}
+	switch {
+	case len(msg.data) == 0:
+		envelope.Data = json.RawMessage("null")
+	case json.Valid(msg.data):
+		envelope.Data = msg.data
+	default:
+		// events that do not carry JSON are sent as strings
+		envelope.Data, _ = json.Marshal(string(msg.data))
+	}
+	return envelope
+}
+
+func writeWSMessage(conn *websocket.Conn, envelope wsEnvelope) error {
+	data, err := json.Marshal(&envelope)
+	if err != nil {
+		return err
+	}
+	return writeWSData(conn, data)
+}
+
+func writeWSData(conn *websocket.Conn, data []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// same-origin requests and requests without an Origin header are always
+// allowed
+func checkOrigin(r *http.Request, allowOrigin string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || allowOrigin == "*" || strings.EqualFold(origin, allowOrigin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
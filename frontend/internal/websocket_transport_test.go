@@ -0,0 +1,199 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kwkoo/threat-detection-frontend/internal"
+	"github.com/kwkoo/threat-detection-frontend/internal/prompts"
+)
+
+type mockControls struct {
+	promptID     chan prompts.ID
+	promptCamera chan string
+	resumed      chan string
+	cancelled    chan string
+	acknowledged chan string
+}
+
+func newMockControls() *mockControls {
+	return &mockControls{
+		promptID:     make(chan prompts.ID, 1),
+		promptCamera: make(chan string, 1),
+		resumed:      make(chan string, 1),
+		cancelled:    make(chan string, 1),
+		acknowledged: make(chan string, 1),
+	}
+}
+
+func (c *mockControls) SetPrompt(camera string, id prompts.ID) error {
+	c.promptID <- id
+	c.promptCamera <- camera
+	return nil
+}
+
+func (c *mockControls) ResumeEvents(camera string) {
+	c.resumed <- camera
+}
+
+func (c *mockControls) CancelAnalysis(camera string) []string {
+	c.cancelled <- camera
+	return []string{camera}
+}
+
+func (c *mockControls) AcknowledgeAlert(id string) error {
+	if id == "does-not-exist" {
+		return errors.New("alert not found")
+	}
+	c.acknowledged <- id
+	return nil
+}
+
+type wsTestEnvelope struct {
+	Type string          `json:"type"`
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Test that websocket clients receive events in the JSON envelope
+func TestWebSocketEvents(t *testing.T) {
+	_, ch, server := newTestWebSocketServer(newMockControls())
+	defer server.Close()
+	defer close(ch)
+
+	conn := dialTestWebSocket(t, server, "?events=timestamp,threat_verdict")
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	ch <- internal.SSEEvent{EventType: "raw_image", Data: []byte(`{"url":"/dummy"}`)}
+	ch <- internal.SSEEvent{EventType: "timestamp", Data: []byte("1234")}
+	ch <- internal.SSEEvent{EventType: "threat_verdict", Data: []byte(`{"level":"high"}`)}
+
+	expected := []struct {
+		eventType string
+		data      string
+	}{
+		{"timestamp", "1234"},
+		{"threat_verdict", `{"level":"high"}`},
+	}
+	for _, e := range expected {
+		envelope, abort := readTestWebSocket(t, conn)
+		if abort {
+			return
+		}
+		if envelope.Type != e.eventType {
+			t.Errorf("expected %s event but got %s", e.eventType, envelope.Type)
+		}
+		if string(envelope.Data) != e.data {
+			t.Errorf("expected data %s but got %s", e.data, envelope.Data)
+		}
+		if envelope.ID == "" {
+			t.Errorf("expected %s event to have an ID", envelope.Type)
+		}
+	}
+}
+
+// Test that control messages are passed to the controller
+func TestWebSocketControls(t *testing.T) {
+	controls := newMockControls()
+	_, ch, server := newTestWebSocketServer(controls)
+	defer server.Close()
+	defer close(ch)
+
+	conn := dialTestWebSocket(t, server, "?events=none")
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		message string
+		ok      bool
+	}{
+		{`{"type":"set_prompt","request_id":"1","prompt_id":2,"camera":"gate"}`, true},
+		{`{"type":"resume_events","request_id":"2"}`, true},
+		{`{"type":"acknowledge_alert","request_id":"3","alert_id":"123"}`, true},
+		{`{"type":"acknowledge_alert","request_id":"4","alert_id":"does-not-exist"}`, false},
+		{`{"type":"set_prompt","request_id":"5"}`, false},
+		{`{"type":"unknown","request_id":"6"}`, false},
+		{`{"type":"cancel_analysis","request_id":"7","camera":"gate"}`, true},
+		{`abc`, false},
+	}
+	for _, test := range tests {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(test.message)); err != nil {
+			t.Errorf("error writing control message: %v", err)
+			return
+		}
+		envelope, abort := readTestWebSocket(t, conn)
+		if abort {
+			return
+		}
+		var result struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		}
+		if envelope.Type != "control_result" || json.Unmarshal(envelope.Data, &result) != nil {
+			t.Errorf("expected control_result for %s but got %s %s", test.message, envelope.Type, envelope.Data)
+			continue
+		}
+		if result.OK != test.ok {
+			t.Errorf("expected ok to be %t for %s but got %t (%s)", test.ok, test.message, result.OK, result.Error)
+		}
+	}
+
+	if id := <-controls.promptID; id != "2" {
+		t.Errorf(`expected prompt to be set to "2" but got "%s"`, id)
+	}
+	if camera := <-controls.promptCamera; camera != "gate" {
+		t.Errorf(`expected prompt to be set for camera "gate" but got "%s"`, camera)
+	}
+	if camera := <-controls.resumed; camera != "" {
+		t.Errorf(`expected events to be resumed for every camera but got "%s"`, camera)
+	}
+	if camera := <-controls.cancelled; camera != "gate" {
+		t.Errorf(`expected analysis of camera "gate" to be cancelled but got "%s"`, camera)
+	}
+	if id := <-controls.acknowledged; id != "123" {
+		t.Errorf(`expected alert "123" to be acknowledged but got "%s"`, id)
+	}
+}
+
+func newTestWebSocketServer(controls internal.WebSocketControls) (*internal.SSEBroadcaster, chan internal.SSEEvent, *httptest.Server) {
+	sse := internal.NewSSEBroadcaster(internal.BackpressureDropNewest)
+	ch := make(chan internal.SSEEvent, 10)
+	go sse.Listen(ch)
+	ws := internal.NewWebSocketTransport(sse, controls, "")
+	server := httptest.NewServer(http.HandlerFunc(ws.HTTPHandler))
+	return sse, ch, server
+}
+
+// returns nil if the connection could not be established
+func dialTestWebSocket(t *testing.T, server *httptest.Server, query string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Errorf("could not connect to websocket server: %v", err)
+		return nil
+	}
+	return conn
+}
+
+// returns true if subsequent tests should be aborted
+func readTestWebSocket(t *testing.T, conn *websocket.Conn) (wsTestEnvelope, bool) {
+	var envelope wsTestEnvelope
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&envelope); err != nil {
+		t.Errorf("error reading from websocket: %v", err)
+		return envelope, true
+	}
+	return envelope, false
+}
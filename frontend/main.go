@@ -4,11 +4,14 @@ import (
 	"context"
 	"embed"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -17,27 +20,74 @@ import (
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/kwkoo/configparser"
 	"github.com/kwkoo/threat-detection-frontend/internal"
+	"github.com/kwkoo/threat-detection-frontend/internal/history"
+	"github.com/kwkoo/threat-detection-frontend/internal/pipeline"
+	"github.com/kwkoo/threat-detection-frontend/internal/verdict"
 )
 
 const sseChannelSize = 50
 
+const mockOllamaOutput = "/tmp/ollama.txt"
+const mockOpenAIOutput = "/tmp/openai.txt"
+
 //go:embed docroot/*
 var content embed.FS
 
 type Config struct {
-	AlertsTopic        string `usage:"MQTT topic for incoming alerts" default:"alerts"`
-	CORS               string `usage:"Value of Access-Control-Allow-Origin HTTP header - header will not be set if this is not set"`
-	Docroot            string `usage:"HTML document root - will use the embedded docroot if not specified"`
-	KeepAlive          string `usage:"The duration that Ollama should keep the model in memory" default:"300m"`
-	MQTTBroker         string `usage:"MQTT broker URL" default:"tcp://localhost:1883" mandatory:"true"`
-	OllamaModel        string `usage:"Model name used in query to Ollama" default:"llava"`
-	OllamaURL          string `usage:"URL for the LLM REST endpoint" default:"http://localhost:11434/api/generate"`
-	OpenAIModel        string `usage:"Model for the OpenAI API" default:"/mnt/models"`
-	OpenAIPrompt       string `usage:"The prompt to be sent to the OpenAI model" default:"Does the text in the following paragraph describe a dangerous situation - answer yes or no"`
-	OpenAIURL          string `usage:"URL for the OpenAI API" default:"http://localhost:8012/v1"`
-	Port               int    `default:"8080" usage:"HTTP listener port"`
-	Prompts            string `usage:"Path to file containing prompts to use - will use hardcoded prompts if this is not set"`
-	SaveModelResponses bool   `usage:"Save model responses to a file"`
+	AlertMaxAge         string `usage:"Alerts with a timestamp older than this are expired instead of being analyzed - set to 0 to analyze alerts regardless of age" default:"0"`
+	AlertMaxClockSkew   string `usage:"Alerts with a timestamp further than this in the future are rejected - set to 0 to accept any timestamp" default:"5m"`
+	AlertMaxImageHeight int    `usage:"Alerts with a taller image are rejected - set to 0 for no limit" default:"4320"`
+	AlertMaxImageKB     int    `usage:"Alerts with a larger image are rejected - set to 0 for no limit" default:"10240"`
+	AlertMaxImageWidth  int    `usage:"Alerts with a wider image are rejected - set to 0 for no limit" default:"7680"`
+	AlertsTopic         string `usage:"MQTT topic for incoming alerts" default:"alerts"`
+	CameraPausePolicies string `usage:"Comma-separated pause policies of cameras that do not use PausePolicy, e.g. gate=never,lobby=timeout:10s"`
+	ClassifierBackend   string `usage:"Backend used to classify the image analysis - ollama, openai, mock or none - the classifier is not called if this is openai and OpenAIURL is not set" default:"openai"`
+	ClassifierModel     string `usage:"Model used by the classifier - defaults to OllamaModel for ollama or OpenAIModel for openai"`
+	ClassifierURL       string `usage:"URL for the classifier - defaults to OllamaURL for ollama or OpenAIURL for openai"`
+	CORS                string `usage:"Value of Access-Control-Allow-Origin HTTP header - header will not be set if this is not set"`
+	DeadLetterTopic     string `usage:"MQTT topic to publish rejected alerts to - rejected alerts are only logged if this is not set"`
+	Docroot             string `usage:"HTML document root - will use the embedded docroot if not specified"`
+	HighRiskCameras     string `usage:"Comma-separated cameras whose alerts are analyzed before alerts from other cameras"`
+	HistoryDir          string `usage:"Directory to save the alert history to - history will only be kept in memory if this is not set"`
+	HistoryMaxAge       string `usage:"Alerts older than this duration will be removed from the history - set to 0 to keep alerts regardless of age" default:"168h"`
+	HistoryMaxMB        int    `usage:"Oldest alerts will be removed from the history when it grows beyond this size in megabytes - set to 0 for no limit" default:"100"`
+	IngestToken         string `usage:"Shared token that alerts submitted to /api/alerts/ingest must be authenticated with - the endpoint is disabled if this is not set"`
+	KeepAlive           string `usage:"The duration that Ollama should keep the model in memory" default:"300m"`
+	LLMQueueSize        int    `usage:"Number of alerts that can wait to be analyzed - the oldest alert with the lowest priority is dropped when the queue is full" default:"100"`
+	LLMWorkers          int    `usage:"Number of alerts that can be analyzed at the same time - alerts from the same camera are always analyzed one at a time" default:"1"`
+	MQTTBroker          string `usage:"MQTT broker URL - use ssl:// to connect with TLS" default:"tcp://localhost:1883" mandatory:"true"`
+	MQTTCACert          string `usage:"Path to PEM bundle of CAs that the MQTT broker's certificate is verified against - defaults to the system CAs"`
+	MQTTCert            string `usage:"Path to PEM client certificate for the MQTT broker"`
+	MQTTCleanSession    string `usage:"Set the clean session flag when connecting to the MQTT broker - true or false" default:"true"`
+	MQTTClientID        string `usage:"MQTT client ID - the broker assigns one if this is not set"`
+	MQTTKeepAlive       string `usage:"Interval between MQTT keepalive pings" default:"30s"`
+	MQTTKey             string `usage:"Path to PEM client key for the MQTT broker"`
+	MQTTPassword        string `usage:"MQTT password"`
+	MQTTPasswordFile    string `usage:"Path to file containing the MQTT password, e.g. a mounted Kubernetes secret - cannot be used with MQTTPassword"`
+	MQTTRetryMax        string `usage:"Longest interval between attempts to connect to the MQTT broker" default:"1m"`
+	MQTTRetryMin        string `usage:"Interval before the first retry to connect to the MQTT broker - the interval doubles after every failed attempt" default:"1s"`
+	MQTTUsername        string `usage:"MQTT username"`
+	OllamaModel         string `usage:"Model name used in query to Ollama" default:"llava"`
+	OllamaURL           string `usage:"URL for the LLM REST endpoint" default:"http://localhost:11434/api/generate"`
+	OpenAIModel         string `usage:"Model for the OpenAI API" default:"/mnt/models"`
+	OpenAIPrompt        string `usage:"The prompt to be sent to the OpenAI model - defaults to asking for a JSON verdict with the level, confidence and rationale"`
+	OpenAIURL           string `usage:"URL for the OpenAI API" default:"http://localhost:8012/v1"`
+	PausePolicy         string `usage:"When a camera is resumed after an alert is analyzed - manual, never (do not pause), timeout[:delay] or low[:delay] (resume after the delay only if the threat level is low) - the delay defaults to 30s" default:"manual"`
+	PendingAlerts       int    `usage:"Number of alerts to keep for each camera while its events are paused - set to 0 to discard alerts while paused" default:"10"`
+	Pipeline            string `usage:"Path to YAML or JSON file defining the stages of the analysis pipeline - the vision and classifier settings are ignored if this is set"`
+	Port                int    `default:"8080" usage:"HTTP listener port"`
+	PriorityClasses     string `usage:"Comma-separated YOLO classes - alerts with any of these classes are analyzed before other alerts"`
+	Prompts             string `usage:"Path to file containing prompts to use - will use hardcoded prompts if this is not set"`
+	PromptsReload       string `usage:"How often to check the prompts file for changes - set to 0 to disable reloading" default:"5s"`
+	ResultsQoS          int    `usage:"QoS of the analysis results published to ResultsTopic - 0, 1 or 2" default:"1"`
+	ResultsRetain       bool   `usage:"Publish the analysis results as retained messages"`
+	ResultsTopic        string `usage:"MQTT topic to publish the result of every analysis to - results are not published if this is not set"`
+	SaveModelResponses  bool   `usage:"Save model responses to a file"`
+	SSEBackpressure     string `usage:"What to do when a browser does not keep up with the events - drop-newest, drop-oldest, disconnect or coalesce (keeps streamed LLM tokens intact)" default:"drop-newest"`
+	Timezone            string `usage:"Time zone of the time in prompt templates, e.g. Asia/Singapore - defaults to the local time zone"`
+	VisionBackend       string `usage:"Backend used to analyze images - ollama, openai or mock" default:"ollama"`
+	VisionModel         string `usage:"Model used to analyze images - defaults to OllamaModel for ollama or OpenAIModel for openai"`
+	VisionURL           string `usage:"URL for the vision backend - defaults to OllamaURL for ollama or OpenAIURL for openai"`
 }
 
 func main() {
@@ -49,9 +99,7 @@ func main() {
 	shutdownCtx, cancelSignalNotify := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	var wg sync.WaitGroup
 
-	http.HandleFunc("/healthz", healthHandler)
-
-	sse := initializeSSEBroadcaster("/api/sse", config.CORS)
+	sse := initializeSSEBroadcaster("/api/sse", config.CORS, config.SSEBackpressure)
 	http.HandleFunc("/api/ssestatus", internal.InitCORSMiddleware(config.CORS, sse.StatusHandler).Handler)
 	sseCh := make(chan internal.SSEEvent, sseChannelSize)
 	wg.Add(1)
@@ -60,27 +108,57 @@ func main() {
 		wg.Done()
 	}()
 
-	alertsController := internal.NewAlertsController(sseCh, config.OllamaURL, config.OllamaModel, config.KeepAlive, config.Prompts, config.OpenAIModel, config.OpenAIPrompt, config.OpenAIURL)
+	historyStore := initializeHistoryStore(config)
+	var recorders modelResponseRecorders
 	if config.SaveModelResponses {
-		alertsController.SaveModelResponses()
+		recorders = createModelResponseRecorders()
+		defer recorders.close()
 	}
+	analysisPipeline := initializePipeline(config, recorders)
+	alertsController := internal.NewAlertsController(sseCh, config.Prompts, analysisPipeline, historyStore, config.AlertsTopic, loadLocation(config.Timezone))
+	alertsController.SetAlertValidator(initializeAlertValidator(config))
+	alertsController.SetMaxPendingAlerts(config.PendingAlerts)
+	alertsController.SetLLMWorkers(config.LLMWorkers)
+	initializePausePolicies(config, alertsController)
+	initializeQueuePolicy(config, alertsController)
 	http.HandleFunc("/api/prompt", internal.InitCORSMiddleware(config.CORS, alertsController.PromptHandler).Handler)
+	http.HandleFunc("/api/prompts", internal.InitCORSMiddleware(config.CORS, alertsController.PromptsListHandler).Handler)
+	http.Handle("/api/prompts/", http.StripPrefix("/api/prompts/", http.HandlerFunc(internal.InitCORSMiddleware(config.CORS, alertsController.PromptItemHandler).Handler)))
 	http.HandleFunc("/api/alertsstatus", internal.InitCORSMiddleware(config.CORS, alertsController.StatusHandler).Handler)
 	http.HandleFunc("/api/resumeevents", internal.InitCORSMiddleware(config.CORS, alertsController.ResumeEventsHandler).Handler)
+	http.HandleFunc("/api/cancel", internal.InitCORSMiddleware(config.CORS, alertsController.CancelHandler).Handler)
+	ws := internal.NewWebSocketTransport(sse, alertsController, config.CORS)
+	http.HandleFunc("/api/ws", ws.HTTPHandler)
 	http.HandleFunc("/api/currentstate", internal.InitCORSMiddleware(config.CORS, alertsController.CurrentStateHandler).Handler)
+	http.HandleFunc("/api/alerts", internal.InitCORSMiddleware(config.CORS, historyStore.ListHandler).Handler)
+	// the longer pattern takes precedence over /api/alerts/
+	alertsController.SetIngestToken(config.IngestToken)
+	http.HandleFunc("/api/alerts/ingest", internal.InitCORSMiddleware(config.CORS, alertsController.IngestHandler).Handler)
+	http.Handle("/api/alerts/", http.StripPrefix("/api/alerts/", http.HandlerFunc(internal.InitCORSMiddleware(config.CORS, historyStore.RecordHandler).Handler)))
+	promptsReload, err := time.ParseDuration(config.PromptsReload)
+	if err != nil {
+		log.Fatalf("could not parse prompts reload interval %s: %v", config.PromptsReload, err)
+	}
+	wg.Add(1)
+	go func() {
+		alertsController.WatchPromptsFile(shutdownCtx, promptsReload)
+		wg.Done()
+	}()
 	wg.Add(1)
 	go func() {
 		alertsController.LLMChannelProcessor(shutdownCtx)
 		close(sseCh)
-		alertsController.Shutdown()
 		wg.Done()
 	}()
 
-	mqttClient := initializeMQTTClient(config, alertsController)
+	mqttSupervisor := initializeMQTTSupervisor(config, alertsController)
+	http.HandleFunc("/healthz", mqttSupervisor.HealthHandler)
+	http.HandleFunc("/readyz", mqttSupervisor.ReadyHandler)
+	initializeResultsPublisher(config, mqttSupervisor.Client(), alertsController)
+	initializeDeadLetterPublisher(config, mqttSupervisor.Client(), alertsController)
 	wg.Add(1)
 	go func() {
-		<-shutdownCtx.Done()
-		shutdownMQTTClient(mqttClient)
+		mqttSupervisor.Run(shutdownCtx)
 		wg.Done()
 	}()
 
@@ -101,29 +179,140 @@ func main() {
 	log.Print("all goroutines terminated")
 }
 
-func initializeMQTTClient(config Config, controller *internal.AlertsController) MQTT.Client {
-	opts := MQTT.NewClientOptions()
-	opts.AddBroker(config.MQTTBroker)
-	opts.SetAutoReconnect(true)
-	opts.OnConnect = func(mqttClient MQTT.Client) {
-		if token := mqttClient.Subscribe(config.AlertsTopic, 1, controller.MQTTHandler); token.Wait() && token.Error() != nil {
-			log.Fatalf("could not subscribe to %s: %v", config.AlertsTopic, token.Error())
+// the supervisor keeps retrying until it connects, so the frontend starts even
+// if the broker is down
+func initializeMQTTSupervisor(config Config, controller *internal.AlertsController) *internal.MQTTSupervisor {
+	opts, err := internal.NewMQTTClientOptions(mqttSettings(config))
+	if err != nil {
+		log.Fatalf("invalid MQTT settings: %v", err)
+	}
+	minBackoff, err := time.ParseDuration(config.MQTTRetryMin)
+	if err != nil {
+		log.Fatalf("could not parse MQTT minimum retry interval %s: %v", config.MQTTRetryMin, err)
+	}
+	maxBackoff, err := time.ParseDuration(config.MQTTRetryMax)
+	if err != nil {
+		log.Fatalf("could not parse MQTT maximum retry interval %s: %v", config.MQTTRetryMax, err)
+	}
+	// alerts can also be published to <alerts topic>/<camera>
+	topics := map[string]byte{
+		config.AlertsTopic:        1,
+		config.AlertsTopic + "/+": 1,
+	}
+	checkPublishTopics(config, topics)
+	return internal.NewMQTTSupervisor(opts, topics, controller.MQTTHandler, minBackoff, maxBackoff, controller.BroadcastMQTTStatus)
+}
+
+// the frontend would receive its own dead letters and results as alerts if
+// they were published to a topic that it subscribes to
+func checkPublishTopics(config Config, subscriptions map[string]byte) {
+	for name, topic := range map[string]string{"dead-letter": config.DeadLetterTopic, "results": config.ResultsTopic} {
+		if topic == "" {
+			continue
+		}
+		for filter := range subscriptions {
+			if internal.TopicMatches(filter, topic) {
+				log.Fatalf("%s topic %s cannot be one of the topics that alerts are received on (%s)", name, topic, filter)
+			}
 		}
 	}
+}
 
-	mqttClient := MQTT.NewClient(opts)
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("error connecting to MQTT broker %s: %v", config.MQTTBroker, token.Error())
+func mqttSettings(config Config) internal.MQTTSettings {
+	cleanSession, err := strconv.ParseBool(config.MQTTCleanSession)
+	if err != nil {
+		log.Fatalf("could not parse MQTT clean session %s: %v", config.MQTTCleanSession, err)
+	}
+	keepAlive, err := time.ParseDuration(config.MQTTKeepAlive)
+	if err != nil {
+		log.Fatalf("could not parse MQTT keepalive %s: %v", config.MQTTKeepAlive, err)
+	}
+	return internal.MQTTSettings{
+		Broker:       config.MQTTBroker,
+		CACert:       config.MQTTCACert,
+		Cert:         config.MQTTCert,
+		Key:          config.MQTTKey,
+		Username:     config.MQTTUsername,
+		Password:     config.MQTTPassword,
+		PasswordFile: config.MQTTPasswordFile,
+		ClientID:     config.MQTTClientID,
+		CleanSession: cleanSession,
+		KeepAlive:    keepAlive,
 	}
-	log.Printf("successfully connected to MQTT broker %s", config.MQTTBroker)
+}
 
-	return mqttClient
+func initializeResultsPublisher(config Config, mqttClient MQTT.Client, controller *internal.AlertsController) {
+	if config.ResultsTopic == "" {
+		log.Print("results topic is not set - analysis results will not be published to MQTT")
+		return
+	}
+	publisher, err := internal.NewResultsPublisher(mqttClient, config.ResultsTopic, config.ResultsQoS, config.ResultsRetain)
+	if err != nil {
+		log.Fatal(err)
+	}
+	controller.SetResultsPublisher(publisher)
+	log.Printf("analysis results will be published to %s", config.ResultsTopic)
 }
 
-func shutdownMQTTClient(mqttClient MQTT.Client) {
-	log.Print("shutting down MQTT client...")
-	mqttClient.Disconnect(5000)
-	log.Print("MQTT client successfully shutdown")
+func initializeDeadLetterPublisher(config Config, mqttClient MQTT.Client, controller *internal.AlertsController) {
+	if config.DeadLetterTopic == "" {
+		return
+	}
+	publisher, err := internal.NewDeadLetterPublisher(mqttClient, config.DeadLetterTopic)
+	if err != nil {
+		log.Fatal(err)
+	}
+	controller.SetDeadLetterPublisher(publisher)
+	log.Printf("rejected alerts will be published to %s", config.DeadLetterTopic)
+}
+
+func initializePausePolicies(config Config, controller *internal.AlertsController) {
+	global, err := internal.ParsePausePolicy(config.PausePolicy)
+	if err != nil {
+		log.Fatalf("could not parse pause policy %s: %v", config.PausePolicy, err)
+	}
+	cameras, err := internal.ParseCameraPausePolicies(config.CameraPausePolicies)
+	if err != nil {
+		log.Fatalf("could not parse camera pause policies %s: %v", config.CameraPausePolicies, err)
+	}
+	controller.SetPausePolicies(global, cameras)
+}
+
+func initializeQueuePolicy(config Config, controller *internal.AlertsController) {
+	maxAge, err := time.ParseDuration(config.AlertMaxAge)
+	if err != nil {
+		log.Fatalf("could not parse alert max age %s: %v", config.AlertMaxAge, err)
+	}
+	controller.SetQueuePolicy(internal.QueuePolicy{
+		Size:            config.LLMQueueSize,
+		HighRiskCameras: splitList(config.HighRiskCameras),
+		PriorityClasses: splitList(config.PriorityClasses),
+		MaxAge:          maxAge,
+	})
+}
+
+// splitList returns the non-empty items of a comma-separated list
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func initializeAlertValidator(config Config) *internal.AlertValidator {
+	skew, err := time.ParseDuration(config.AlertMaxClockSkew)
+	if err != nil {
+		log.Fatalf("could not parse alert max clock skew %s: %v", config.AlertMaxClockSkew, err)
+	}
+	return internal.NewAlertValidator(internal.AlertLimits{
+		MaxImageBytes:  config.AlertMaxImageKB * 1024,
+		MaxImageWidth:  config.AlertMaxImageWidth,
+		MaxImageHeight: config.AlertMaxImageHeight,
+		MaxClockSkew:   skew,
+	})
 }
 
 func initializeDocroot(path string) http.FileSystem {
@@ -141,8 +330,168 @@ func initializeDocroot(path string) http.FileSystem {
 	}
 }
 
-func initializeSSEBroadcaster(uri, cors string) *internal.SSEBroadcaster {
-	sse := internal.NewSSEBroadcaster()
+// Used to save mock data
+type modelResponseRecorders map[string]*modelResponseRecorder
+
+// the analysis workers record responses at the same time, so writes to the
+// file are serialized - each response line is written with a single Write
+type modelResponseRecorder struct {
+	mux  sync.Mutex
+	file *os.File
+}
+
+func (r *modelResponseRecorder) Write(p []byte) (int, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.file.Write(p)
+}
+
+func createModelResponseRecorders() modelResponseRecorders {
+	recorders := make(modelResponseRecorders)
+	for backendType, filename := range map[string]string{"ollama": mockOllamaOutput, "openai": mockOpenAIOutput} {
+		f, err := os.Create(filename)
+		if err != nil {
+			log.Printf("could not create %s: %v", filename, err)
+			continue
+		}
+		recorders[backendType] = &modelResponseRecorder{file: f}
+	}
+	return recorders
+}
+
+func (recorders modelResponseRecorders) get(backendType string) io.Writer {
+	if r, ok := recorders[backendType]; ok {
+		return r
+	}
+	return nil
+}
+
+func (recorders modelResponseRecorders) close() {
+	for _, r := range recorders {
+		r.file.Close()
+	}
+}
+
+func initializePipeline(config Config, recorders modelResponseRecorders) *pipeline.Pipeline {
+	if config.Pipeline != "" {
+		p, err := pipeline.Load(config.Pipeline, recorders.get)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded analysis pipeline from %s", config.Pipeline)
+		return p
+	}
+
+	p := defaultPipeline(config)
+	if err := p.Init(recorders.get); err != nil {
+		log.Fatalf("could not initialize analysis pipeline: %v", err)
+	}
+	return &p
+}
+
+// analyzes the image with the vision backend, and then classifies the image
+// analysis with the classifier backend
+func defaultPipeline(config Config) pipeline.Pipeline {
+	p := pipeline.Pipeline{
+		Backends: map[string]pipeline.BackendConfig{
+			"vision": backendConfig(config, config.VisionBackend, config.VisionURL, config.VisionModel),
+		},
+		Stages: []*pipeline.Stage{
+			{
+				Name:    pipeline.ImageAnalysisStage,
+				Backend: "vision",
+				Input:   pipeline.InputImage,
+				Events: pipeline.Events{
+					Start: "ollama_response_start",
+					Token: "ollama_response",
+					Stop:  "ollama_response_stop",
+				},
+			},
+		},
+	}
+
+	if config.ClassifierBackend == "none" || (config.ClassifierBackend == "openai" && config.ClassifierURL == "" && config.OpenAIURL == "") {
+		log.Print("classifier is not set so we will not call it - will stream image analysis to client")
+		return p
+	}
+	p.Backends["classifier"] = backendConfig(config, config.ClassifierBackend, config.ClassifierURL, config.ClassifierModel)
+	prompt := config.OpenAIPrompt
+	if prompt == "" {
+		prompt = verdict.DefaultPrompt
+	}
+	p.Stages = append(p.Stages, &pipeline.Stage{
+		Name:    pipeline.ThreatAnalysisStage,
+		Backend: "classifier",
+		Input:   pipeline.ImageAnalysisStage,
+		Prompt:  prompt,
+		Events: pipeline.Events{
+			Start: "openai_response_start",
+			Token: "openai_response",
+			Stop:  "openai_response_stop",
+		},
+	})
+	return p
+}
+
+// url and model default to the Ollama or OpenAI settings if they are not set
+func backendConfig(config Config, backendType, url, model string) pipeline.BackendConfig {
+	switch backendType {
+	case "ollama":
+		if url == "" {
+			url = config.OllamaURL
+		}
+		if model == "" {
+			model = config.OllamaModel
+		}
+	case "openai":
+		if url == "" {
+			url = config.OpenAIURL
+		}
+		if model == "" {
+			model = config.OpenAIModel
+		}
+	}
+	return pipeline.BackendConfig{
+		Type:      backendType,
+		URL:       url,
+		Model:     model,
+		KeepAlive: config.KeepAlive,
+	}
+}
+
+func initializeHistoryStore(config Config) *history.Store {
+	maxAge, err := time.ParseDuration(config.HistoryMaxAge)
+	if err != nil {
+		log.Fatalf("could not parse history max age %s: %v", config.HistoryMaxAge, err)
+	}
+	store, err := history.NewStore(config.HistoryDir, maxAge, int64(config.HistoryMaxMB)*1024*1024)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return store
+}
+
+// the time zone database is embedded so that this works in containers that
+// do not have one
+func loadLocation(name string) *time.Location {
+	if name == "" {
+		return time.Local
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		log.Fatalf("could not load time zone %s: %v", name, err)
+	}
+	log.Printf("times in prompts will be shown in the %s time zone", name)
+	return location
+}
+
+func initializeSSEBroadcaster(uri, cors, backpressure string) *internal.SSEBroadcaster {
+	policy, err := internal.ParseBackpressurePolicy(backpressure)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("SSE backpressure policy set to %s", policy)
+	sse := internal.NewSSEBroadcaster(policy)
 	http.HandleFunc(uri, internal.InitCORSMiddleware(cors, sse.HTTPHandler).Handler)
 	return sse
 }
@@ -174,7 +523,3 @@ func startWebServer(server *http.Server) {
 		log.Fatal(err)
 	}
 }
-
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "OK")
-}
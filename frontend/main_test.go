@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kwkoo/threat-detection-frontend/internal/llm"
+	"github.com/kwkoo/threat-detection-frontend/internal/verdict"
+)
+
+// Test that the threat analysis of the default configuration is parsed into
+// a threat level
+func TestDefaultPipelineVerdict(t *testing.T) {
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"response":"A person is holding a knife at the gate.","done":true}`))
+	}))
+	defer ollama.Close()
+
+	// like a model that follows the prompt, a JSON verdict is only returned if
+	// the prompt asks for one
+	openai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Messages) == 0 {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		prompt := req.Messages[len(req.Messages)-1].Content
+		reply := "Yes"
+		if strings.Contains(prompt, `"level"`) && strings.Contains(prompt, `"confidence"`) && strings.Contains(prompt, `"rationale"`) {
+			reply = `{"level":"high","confidence":0.9,"rationale":"The person is holding a knife."}`
+		}
+		chunk, _ := json.Marshal(map[string]interface{}{
+			"id":     "chatcmpl-1",
+			"object": "chat.completion.chunk",
+			"choices": []map[string]interface{}{
+				{"index": 0, "delta": map[string]string{"content": reply}, "finish_reason": "stop"},
+			},
+		})
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", chunk)
+	}))
+	defer openai.Close()
+
+	config, abort := defaultConfig(t)
+	if abort {
+		return
+	}
+	config.OllamaURL = ollama.URL
+	config.OpenAIURL = openai.URL + "/v1"
+	p := defaultPipeline(config)
+	if err := p.Init(nil); err != nil {
+		t.Errorf("could not initialize pipeline: %v", err)
+		return
+	}
+
+	outputs := make(map[string]string)
+	for _, stage := range p.Stages {
+		output, err := stage.Execute(context.Background(), "dummy", "Describe the image", llm.Options{}, outputs, func(string) {})
+		if err != nil {
+			t.Errorf("error executing stage %s: %v", stage.Name, err)
+			return
+		}
+		outputs[stage.Name] = output
+	}
+	v := verdict.Parse(outputs["threat_analysis"])
+	if v.Level == verdict.LevelUnknown {
+		t.Errorf(`expected a threat level from the threat analysis "%s" but got %+v`, outputs["threat_analysis"], v)
+	}
+}
+
+// returns the Config with the default of every field, as if no environment
+// variables or flags were set
+// returns true if subsequent tests should be aborted
+func defaultConfig(t *testing.T) (Config, bool) {
+	var config Config
+	value := reflect.ValueOf(&config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		def, ok := field.Tag.Lookup("default")
+		if !ok {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String:
+			value.Field(i).SetString(def)
+		case reflect.Int:
+			n, err := strconv.Atoi(def)
+			if err != nil {
+				t.Errorf("invalid default %s of %s: %v", def, field.Name, err)
+				return config, true
+			}
+			value.Field(i).SetInt(int64(n))
+		case reflect.Bool:
+			value.Field(i).SetBool(def == "true")
+		}
+	}
+	return config, false
+}
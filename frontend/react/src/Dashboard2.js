@@ -57,7 +57,7 @@ function Photo({ annotatedImage, rawImage }) {
             clearPhoto();
             return;
           }else{
-              setPhoto('data:image/jpeg;charset=utf-8;base64,' + data);
+              setPhoto(baseurl + data);
           }
           setRefresh(false);
         }, [refresh, checked, annotatedImage, rawImage]);
@@ -112,7 +112,7 @@ function PlaySound ({timestamp}) {
 }
 
 // Process GET prompt list from server
-function Promptlist () {
+function Promptlist ({ version }) {
     const [promptlist, setPromptlist] = useState([]);
   
     useEffect(() => {
@@ -122,7 +122,7 @@ function Promptlist () {
           setPromptlist(json);
         })
         .catch(error => console.error(error));
-    }, []);
+    }, [version]);
   
     let dropdownArr = [];
     for (let i=0; i<promptlist.length; i++) {
@@ -133,7 +133,7 @@ function Promptlist () {
   }
   
   // Prompt dropdown menu and POST prompt to server
-  function Dropdown ({ promptID }) {
+  function Dropdown ({ promptID, promptsVersion }) {
     const toast = useToast();
   
     const handleChangePrompt = async (event) => {
@@ -147,7 +147,7 @@ function Promptlist () {
         let data = await axios.post(
           (baseurl + '/api/prompt'),
             JSON.stringify({
-              id: parseInt(newPromptID),
+              id: newPromptID,
             }),
           config
         );
@@ -179,7 +179,7 @@ function Promptlist () {
               onChange={handleChangePrompt}
               value={ promptID }
             >
-              <Promptlist/>
+              <Promptlist version={ promptsVersion }/>
             </Select>
   }
   
@@ -249,21 +249,36 @@ function Dashboard2 () {
     const [ rawImage, setRawImage ] = useState('');
     const [ timestamp, setTimestamp ] = useState('');
     const [ prompt, setPrompt ] = useState(0);
+    const [ promptsVersion, setPromptsVersion ] = useState(0);
     const [ llm_response, setLLMResponse ] = useState('');
     const [ ai_response, setAIResponse ] = useState('');
     const [ showButton, setShowButton ] = useState(true);
+    const [ mqttState, setMQTTState ] = useState('connected');
+    const [ pendingCount, setPendingCount ] = useState(0);
+    const [ resumeAt, setResumeAt ] = useState(0);
+    const [ now, setNow ] = useState(Date.now());
+
+    // tick while the stream is counting down to being resumed
+    useEffect(() => {
+        if (resumeAt <= 0) return;
+        setNow(Date.now());
+        const timer = setInterval(() => setNow(Date.now()), 1000);
+        return () => clearInterval(timer);
+    }, [resumeAt]);
 
     useEffect(() => {
         const evtSource = new EventSource(baseurl + "/api/sse");
         setIsLoaded(false);
 
         evtSource.addEventListener("annotated_image", event => {
-        setAnnotatedImage(event.data);
+        const obj = JSON.parse(event.data);
+        setAnnotatedImage(obj.url || '');
         setIsLoaded(true);
         })
 
         evtSource.addEventListener("raw_image", event => {
-        setRawImage(event.data);
+        const obj = JSON.parse(event.data);
+        setRawImage(obj.url || '');
         setIsLoaded(true);
         })
 
@@ -279,6 +294,13 @@ function Dashboard2 () {
         setPrompt(obj.id);
         });
 
+        // the prompts file was reloaded
+        evtSource.addEventListener("prompts_changed", event => {
+        let obj = JSON.parse(event.data);
+        if (obj != null && obj.selected != null) setPrompt(obj.selected);
+        setPromptsVersion(version => version + 1);
+        });
+
         evtSource.addEventListener("ollama_response_start", event => {
         setLLMResponse('');
         });
@@ -303,15 +325,36 @@ function Dashboard2 () {
         
         evtSource.addEventListener("resume_events", event => {
           setShowButton(false);
+          setResumeAt(0);
         });
 
+        // the stream will be resumed without an operator because of the pause policy
+        evtSource.addEventListener("resume_countdown", event => {
+          const obj = JSON.parse(event.data);
+          if (obj == null) return;
+          setResumeAt(obj.remaining > 0 && obj.resume_at != null ? obj.resume_at : 0);
+        });
+
+        // alerts that arrived while the events were paused
+        evtSource.addEventListener("pending_count", event => {
+          const obj = JSON.parse(event.data);
+          if (obj != null && obj.count != null) setPendingCount(obj.count);
+        });
+
+        // alerts are not received while the frontend is not connected to the MQTT broker
+        evtSource.addEventListener("mqtt_status", event => {
+          const obj = JSON.parse(event.data);
+          if (obj != null && obj.state != null) setMQTTState(obj.state);
+        });
+
+        const loadCurrentState = () => {
         fetch(baseurl + '/api/currentstate')
         .then(response => response.json())
         .then(json => {
           if (json == null) return;
-          if (json.annotated_image != null && json.annotated_image !== "") setAnnotatedImage(json.annotated_image);
-          if (json.raw_image != null && json.raw_image !== "") setRawImage(json.raw_image);
-          if ((json.annotated_image != null && json.annotated_image !== "") || (json.raw_image != null && json.raw_image !== "")) setIsLoaded(true);
+          if (json.annotated_image_url != null && json.annotated_image_url !== "") setAnnotatedImage(json.annotated_image_url);
+          if (json.raw_image_url != null && json.raw_image_url !== "") setRawImage(json.raw_image_url);
+          if ((json.annotated_image_url != null && json.annotated_image_url !== "") || (json.raw_image_url != null && json.raw_image_url !== "")) setIsLoaded(true);
           if (json.timestamp != null) {
             let date = new Date(json.timestamp * 1000);
             setTimestamp(date.toString().split(' ')[4]);
@@ -320,8 +363,16 @@ function Dashboard2 () {
           if (json.image_analysis != null) setLLMResponse(json.image_analysis);
           if (json.threat_analysis != null) setAIResponse(json.threat_analysis);
           if (json.events_paused != null) setShowButton(json.events_paused);
+          if (json.pending_count != null) setPendingCount(json.pending_count);
+          setResumeAt(json.resume_at || 0);
         })
         .catch(error => console.error(error));
+        };
+
+        // events were missed while we were disconnected and they cannot be replayed
+        evtSource.addEventListener("reset", loadCurrentState);
+
+        loadCurrentState();
     }, []);
 
     //GET Display Data on Button Click
@@ -353,6 +404,7 @@ function Dashboard2 () {
           <Image objectFit='cover' src={ncsrhlogo} />
         </Box>
         <Heading size='lg'>Threat Detection Dashboard</Heading>
+        {mqttState !== 'connected' && <Badge ml='4' colorScheme='red'>MQTT { mqttState }</Badge>}
       </Center>
     </HStack>
 
@@ -393,7 +445,8 @@ function Dashboard2 () {
                             isDisabled={!showButton}
                             onClick={SubmitHandler}
                           > 
-                            Resume Stream 
+                            Resume Stream { pendingCount > 0 && `(${pendingCount} pending)` }
+                            { resumeAt > 0 && ` - resuming in ${Math.max(0, Math.round(resumeAt - now / 1000))}s` }
                           </Button>
                         </Stack>
                     </CardBody>
@@ -407,7 +460,7 @@ function Dashboard2 () {
               <Heading as='h3' size='md'>
                 Image Analysis
               </Heading>  
-              <Dropdown promptID={prompt}/>
+              <Dropdown promptID={prompt} promptsVersion={promptsVersion}/>
               <Divider orientation="horizontal" /> 
               <Card w='100%'>
                 <CardBody>